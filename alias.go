@@ -0,0 +1,76 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// aliasTarget returns the path the aliases of r link to: the checkout,
+// or the link to it in temp and staging mode, which stays the same.
+func (r *Repo) aliasTarget() string {
+	if r.linkPath != "" {
+		return r.linkPath
+	}
+	return r.Path
+}
+
+// refreshAliases creates the links in r.Aliases to the checkout, or
+// updates them if they point elsewhere. A link that is replaced is
+// renamed over, so it never goes missing. An alias that exists and is
+// not a link is left as it is and logged.
+func (r *Repo) refreshAliases() {
+	target, err := filepath.Abs(r.aliasTarget())
+	if err != nil {
+		r.logger().Printf("Cannot link aliases of %v: %v\n", r.URL, err)
+		return
+	}
+	for _, alias := range r.Aliases {
+		if err := linkAlias(alias, target); err != nil {
+			r.logger().Printf("Cannot link alias %v to %v: %v\n", alias, target, err)
+		}
+	}
+}
+
+// linkAlias points the link alias to target.
+func linkAlias(alias, target string) error {
+	if info, err := gos.Lstat(alias); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			return fmt.Errorf("%v exists and is not a link", alias)
+		}
+		if dest, err := gos.Readlink(alias); err == nil && dest == target {
+			return nil
+		}
+	}
+	if err := gos.MkdirAll(filepath.Dir(alias), os.FileMode(0755)); err != nil {
+		return err
+	}
+	tmp := alias + ".caddy-git"
+	gos.Remove(tmp)
+	if err := gos.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := gos.Rename(tmp, alias); err != nil {
+		gos.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// removeAliases removes the links in r.Aliases at shutdown. Links that
+// were changed to point elsewhere are kept.
+func (r *Repo) removeAliases() error {
+	r.Lock()
+	defer r.Unlock()
+
+	target, err := filepath.Abs(r.aliasTarget())
+	if err != nil {
+		return err
+	}
+	for _, alias := range r.Aliases {
+		if dest, e := gos.Readlink(alias); e == nil && dest == target {
+			err = mergeErrors(err, gos.Remove(alias))
+		}
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package git
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestAliases(t *testing.T) {
+	defer func() {
+		gittest.Symlinks = map[string]string{}
+		gittest.Renames = map[string]string{}
+	}()
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.Aliases = []string{"/var/www/current", "/srv/site"}
+	gittest.Symlinks["/srv/site"] = "/srv/old"
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+
+	target, err := filepath.Abs("newdir")
+	check(t, err)
+	for _, alias := range repo.Aliases {
+		if gittest.Symlinks[alias] != target {
+			t.Errorf("Expected %v to link to %v found %v", alias, target, gittest.Symlinks[alias])
+		}
+		if gittest.Renames[alias] != alias+".caddy-git" {
+			t.Errorf("Expected %v to be renamed into place found %v", alias, gittest.Renames[alias])
+		}
+	}
+
+	// files and directories are not replaced
+	if err := linkAlias("keydir", target); err == nil {
+		t.Errorf("Expected error for existing directory")
+	}
+
+	// only links still pointing to the checkout are removed
+	gittest.Symlinks["/srv/site"] = "/srv/other"
+	check(t, repo.removeAliases())
+	if _, ok := gittest.Symlinks["/var/www/current"]; ok {
+		t.Errorf("Expected alias to be removed")
+	}
+	if gittest.Symlinks["/srv/site"] != "/srv/other" {
+		t.Errorf("Expected changed alias to be kept")
+	}
+}
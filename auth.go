@@ -0,0 +1,202 @@
+package git
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialHelper is a git credential helper that reads the username
+// and password from the environment of the git process. This keeps
+// credentials out of the repository URL and the process arguments.
+const credentialHelper = `!f() { test "$1" = get && echo "username=${CADDY_GIT_USERNAME}" && echo "password=${CADDY_GIT_PASSWORD}"; }; f`
+
+// credentials provides the username and password for HTTPS
+// authentication.
+type credentials interface {
+	credentials() (username, password string, err error)
+}
+
+// gitCmdWithCredentials is used for private repositories over HTTPS.
+// The credentials are provided to git by credentialHelper.
+func (r *Repo) gitCmdWithCredentials(stdout io.Writer, params []string, dir string) error {
+	username, password, err := r.creds.credentials()
+	if err != nil {
+		return err
+	}
+	args := append([]string{
+		// clear other configured helpers
+		"-c", "credential.helper=",
+		"-c", "credential.helper=" + credentialHelper,
+	}, params...)
+	env := []string{
+		"CADDY_GIT_USERNAME=" + username,
+		"CADDY_GIT_PASSWORD=" + password,
+	}
+	command, args := r.rateLimited(gitBinary, args)
+	return runGitCmd(stdout, command, args, dir, env, r.timeout(params))
+}
+
+// errMultipleCredentials is the error if more than one kind of HTTPS
+// credentials is configured.
+const errMultipleCredentials = "only one of oauth, token_file and app_password can be used"
+
+// oauthUsername is the username used with OAuth access tokens.
+const oauthUsername = "oauth2"
+
+// oauthClient is the http client used to request OAuth access tokens.
+var oauthClient = &http.Client{Timeout: time.Second * 30}
+
+// oauthCredentials exchanges a refresh token for short-lived access
+// tokens at the token endpoint of an OAuth provider. Access tokens are
+// refreshed when they expire.
+type oauthCredentials struct {
+	tokenURL     string
+	refreshToken string
+	clientID     string
+	clientSecret string
+	accessToken  string
+	expiry       time.Time
+	sync.Mutex
+}
+
+// oauthToken is the response of an OAuth token endpoint.
+type oauthToken struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+func (o *oauthCredentials) credentials() (string, string, error) {
+	o.Lock()
+	defer o.Unlock()
+
+	// refresh a minute early to avoid expiry during a pull
+	if o.accessToken == "" || time.Now().Add(time.Minute).After(o.expiry) {
+		if err := o.refresh(); err != nil {
+			return "", "", err
+		}
+	}
+	return oauthUsername, o.accessToken, nil
+}
+
+// expire drops the cached access token, so the next git command
+// refreshes it.
+func (o *oauthCredentials) expire() {
+	o.Lock()
+	defer o.Unlock()
+	o.accessToken = ""
+}
+
+// refresh requests a new access token. Caller must hold the lock.
+func (o *oauthCredentials) refresh() error {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {o.refreshToken},
+	}
+	if o.clientID != "" {
+		form.Set("client_id", o.clientID)
+	}
+	if o.clientSecret != "" {
+		form.Set("client_secret", o.clientSecret)
+	}
+
+	resp, err := oauthClient.PostForm(o.tokenURL, form)
+	if err != nil {
+		return fmt.Errorf("could not refresh OAuth access token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var token oauthToken
+	if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("could not refresh OAuth access token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || token.AccessToken == "" {
+		return fmt.Errorf("could not refresh OAuth access token: %v %v", resp.Status, token.Error)
+	}
+
+	o.accessToken = token.AccessToken
+	// providers may rotate the refresh token
+	if token.RefreshToken != "" {
+		o.refreshToken = token.RefreshToken
+	}
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = time.Hour
+	}
+	o.expiry = time.Now().Add(expiresIn)
+	Logger().Println("OAuth access token refreshed.")
+	return nil
+}
+
+// tokenFileCredentials reads an access token from a file, e.g. mounted
+// by a secret manager. The file is read for every git command, so a
+// rotated token is used without a restart.
+type tokenFileCredentials struct {
+	path     string
+	username string
+}
+
+func (t *tokenFileCredentials) credentials() (string, string, error) {
+	content, err := gos.ReadFile(t.path)
+	if err != nil {
+		return "", "", fmt.Errorf("could not read token file: %v", err)
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", "", fmt.Errorf("token file %v is empty", t.path)
+	}
+	return t.username, token, nil
+}
+
+// ReloadCredentials loads the credentials of r again after they were
+// rotated. The key, key_passphrase_file, token_file and hook_secret_file
+// are read from disk on each use; they are checked so a broken rotation
+// is reported, and a cached OAuth access token is dropped. It waits for
+// an active pull to finish, which keeps the credentials it started with.
+func (r *Repo) ReloadCredentials() error {
+	r.Lock()
+	defer r.Unlock()
+
+	var errs error
+	if r.KeyPath != "" {
+		errs = mergeErrors(errs, validateKey(r.KeyPath))
+	}
+	if r.PassphraseFile != "" {
+		_, err := r.keyPassphrase()
+		errs = mergeErrors(errs, err)
+	}
+	switch c := r.creds.(type) {
+	case *tokenFileCredentials:
+		_, _, err := c.credentials()
+		errs = mergeErrors(errs, err)
+	case *oauthCredentials:
+		c.expire()
+	}
+	if r.Hook.SecretFile != "" {
+		_, err := r.Hook.LoadSecret()
+		errs = mergeErrors(errs, err)
+	}
+	if errs != nil {
+		return errs
+	}
+	r.logger().Printf("Credentials of %v reloaded.\n", r.URL)
+	return nil
+}
+
+// appPasswordCredentials is a username and an app password, e.g. of
+// Bitbucket Cloud, passed by the credential helper instead of the URL.
+type appPasswordCredentials struct {
+	username string
+	password string
+}
+
+func (a *appPasswordCredentials) credentials() (string, string, error) {
+	return a.username, a.password, nil
+}
@@ -0,0 +1,128 @@
+package git
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestOAuthCredentials(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.FormValue("grant_type") != "refresh_token" || r.FormValue("client_id") != "client" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_request"}`)
+			return
+		}
+		if r.FormValue("refresh_token") != fmt.Sprintf("refresh%v", requests-1) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "invalid_grant"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "access%v", "refresh_token": "refresh%v", "expires_in": 3600}`, requests, requests)
+	}))
+	defer server.Close()
+
+	o := &oauthCredentials{tokenURL: server.URL, refreshToken: "refresh0", clientID: "client"}
+
+	username, password, err := o.credentials()
+	check(t, err)
+	if username != oauthUsername || password != "access1" {
+		t.Errorf("Expected %v:access1 found %v:%v", oauthUsername, username, password)
+	}
+
+	// valid token is reused
+	_, password, err = o.credentials()
+	check(t, err)
+	if password != "access1" || requests != 1 {
+		t.Errorf("Expected cached token, found %v after %v requests", password, requests)
+	}
+
+	// expired token is refreshed with the rotated refresh token
+	o.expiry = o.expiry.Add(-time.Hour)
+	_, password, err = o.credentials()
+	check(t, err)
+	if password != "access2" || requests != 2 {
+		t.Errorf("Expected refreshed token, found %v after %v requests", password, requests)
+	}
+
+	o = &oauthCredentials{tokenURL: server.URL, refreshToken: "invalid"}
+	if _, _, err = o.credentials(); err == nil {
+		t.Errorf("Expected error for invalid refresh token")
+	}
+}
+
+func TestTokenFileCredentials(t *testing.T) {
+	defer delete(gittest.FileContents, "/run/secrets/token")
+
+	creds := &tokenFileCredentials{path: "/run/secrets/token", username: oauthUsername}
+	if _, _, err := creds.credentials(); err == nil {
+		t.Errorf("Expected error for missing token file")
+	}
+
+	gittest.FileContents["/run/secrets/token"] = "token1\n"
+	username, password, err := creds.credentials()
+	check(t, err)
+	if username != oauthUsername || password != "token1" {
+		t.Errorf("Expected %v:token1 found %v:%v", oauthUsername, username, password)
+	}
+
+	// rotated token is used without a restart
+	gittest.FileContents["/run/secrets/token"] = "token2"
+	if _, password, _ = creds.credentials(); password != "token2" {
+		t.Errorf("Expected rotated token2 found %v", password)
+	}
+
+	gittest.FileContents["/run/secrets/token"] = "  "
+	if _, _, err = creds.credentials(); err == nil {
+		t.Errorf("Expected error for empty token file")
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	defer delete(gittest.FileContents, "/run/secrets/token")
+	defer delete(gittest.FileContents, "/run/secrets/hook")
+
+	repo := createRepo(&Repo{URL: "https://github.com/user/repo.git"})
+	repo.creds = &tokenFileCredentials{path: "/run/secrets/token", username: oauthUsername}
+	repo.Hook.SecretFile = "/run/secrets/hook"
+	if err := repo.ReloadCredentials(); err == nil {
+		t.Errorf("Expected error for missing files")
+	}
+	gittest.FileContents["/run/secrets/token"] = "token"
+	gittest.FileContents["/run/secrets/hook"] = "secret"
+	check(t, repo.ReloadCredentials())
+
+	// the reload waits for an active pull
+	repo.Lock()
+	done := make(chan error)
+	go func() { done <- repo.ReloadCredentials() }()
+	select {
+	case <-done:
+		t.Errorf("Expected reload to wait for the pull")
+	case <-time.After(50 * time.Millisecond):
+	}
+	repo.Unlock()
+	check(t, <-done)
+
+	o := &oauthCredentials{accessToken: "cached", expiry: time.Now().Add(time.Hour)}
+	repo.creds, repo.Hook.SecretFile = o, ""
+	check(t, repo.ReloadCredentials())
+	if o.accessToken != "" {
+		t.Errorf("Expected cached access token to be dropped found %v", o.accessToken)
+	}
+}
+
+func TestAppPasswordCredentials(t *testing.T) {
+	creds := &appPasswordCredentials{username: "user", password: "secret"}
+	username, password, err := creds.credentials()
+	check(t, err)
+	if username != "user" || password != "secret" {
+		t.Errorf("Expected user:secret found %v:%v", username, password)
+	}
+}
@@ -22,7 +22,10 @@ type bbPush struct {
 	Push struct {
 		Changes []struct {
 			New struct {
-				Name string `json:"name,omitempty"`
+				Name   string `json:"name,omitempty"`
+				Target struct {
+					Hash string `json:"hash,omitempty"`
+				} `json:"target,omitempty"`
 			} `json:"new,omitempty"`
 		} `json:"changes,omitempty"`
 	} `json:"push,omitempty"`
@@ -40,18 +43,26 @@ func (b BitbucketHook) DoesHandle(h http.Header) bool {
 
 func (b BitbucketHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error) {
 	if !b.verifyBitbucketIP(r.RemoteAddr) {
-		return http.StatusForbidden, errors.New("the request doesn't come from a valid IP")
+		return http.StatusForbidden, signatureError{errors.New("the request doesn't come from a valid IP")}
 	}
 
 	if r.Method != "POST" {
 		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
 	}
 
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return http.StatusRequestTimeout, errors.New("could not read body from request")
 	}
 
+	if body, err = hookPayload(r, body); err != nil {
+		return http.StatusBadRequest, err
+	}
+
 	event := r.Header.Get("X-Event-Key")
 	if event == "" {
 		return http.StatusBadRequest, errors.New("the 'X-Event-Key' header is required but was missing.")
@@ -89,10 +100,7 @@ func (b BitbucketHook) handlePush(body []byte, repo *Repo) error {
 	}
 
 	branch := change.New.Name
-	if branch == repo.Branch {
-		Logger().Print("Received pull notification for the tracking branch, updating...\n")
-		repo.Pull()
-	}
+	repo.hookPush(branch, change.New.Target.Hash)
 
 	return nil
 }
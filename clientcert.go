@@ -0,0 +1,87 @@
+package git
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ClientCerts are the TLS client certificates accepted for a webhook.
+// A certificate is accepted if it is issued by one of Roots for client
+// authentication, or if its SHA-256 fingerprint is one of Fingerprints.
+type ClientCerts struct {
+	Roots        *x509.CertPool
+	Fingerprints [][sha256.Size]byte
+}
+
+// parseClientCerts parses the arguments of hook_client_cert. Each is
+// either sha256:fingerprint, in hex with optional colons, or the path
+// to a PEM file of CA certificates.
+func parseClientCerts(args []string) (*ClientCerts, error) {
+	if len(args) == 0 {
+		return nil, errors.New("hook_client_cert requires a CA file or fingerprint")
+	}
+	certs := &ClientCerts{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "sha256:") {
+			fingerprint, err := hex.DecodeString(strings.Replace(arg[len("sha256:"):], ":", "", -1))
+			if err != nil || len(fingerprint) != sha256.Size {
+				return nil, fmt.Errorf("invalid hook_client_cert fingerprint %v", arg)
+			}
+			var f [sha256.Size]byte
+			copy(f[:], fingerprint)
+			certs.Fingerprints = append(certs.Fingerprints, f)
+			continue
+		}
+		pem, err := gos.ReadFile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read hook_client_cert CA file %v: %v", arg, err)
+		}
+		if certs.Roots == nil {
+			certs.Roots = x509.NewCertPool()
+		}
+		if !certs.Roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in hook_client_cert CA file %v", arg)
+		}
+	}
+	return certs, nil
+}
+
+// verify checks that the request was sent with an accepted client
+// certificate. It requires Caddy to request client certificates, see
+// the tls directive, as r.TLS has none otherwise.
+func (c *ClientCerts) verify(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return errors.New("no client certificate")
+	}
+	leaf := r.TLS.PeerCertificates[0]
+
+	fingerprint := sha256.Sum256(leaf.Raw)
+	for _, f := range c.Fingerprints {
+		if subtle.ConstantTimeCompare(fingerprint[:], f[:]) == 1 {
+			return nil
+		}
+	}
+
+	if c.Roots != nil {
+		intermediates := x509.NewCertPool()
+		for _, cert := range r.TLS.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Roots:         c.Roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		})
+		if err == nil {
+			return nil
+		}
+		return fmt.Errorf("client certificate %q not accepted: %v", leaf.Subject.CommonName, err)
+	}
+	return fmt.Errorf("client certificate %q not accepted", leaf.Subject.CommonName)
+}
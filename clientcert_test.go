@@ -0,0 +1,94 @@
+package git
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+// newCert creates a certificate for name signed by parent, or self
+// signed if parent is nil.
+func newCert(t *testing.T, name string, ca bool, usage x509.ExtKeyUsage, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	check(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	check(t, err)
+	cert, err := x509.ParseCertificate(der)
+	check(t, err)
+	return cert, key
+}
+
+func TestHookClientCert(t *testing.T) {
+	ca, caKey := newCert(t, "hooks CA", true, x509.ExtKeyUsageClientAuth, nil, nil)
+	client, _ := newCert(t, "ci", false, x509.ExtKeyUsageClientAuth, ca, caKey)
+	server, _ := newCert(t, "server", false, x509.ExtKeyUsageServerAuth, ca, caKey)
+	pinned, _ := newCert(t, "pinned", false, x509.ExtKeyUsageClientAuth, nil, nil)
+	other, _ := newCert(t, "other", false, x509.ExtKeyUsageClientAuth, nil, nil)
+
+	caFile := "/etc/caddy/hooks-ca.pem"
+	gittest.FileContents[caFile] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}))
+	defer delete(gittest.FileContents, caFile)
+	fingerprint := sha256.Sum256(pinned.Raw)
+	certs, err := parseClientCerts([]string{caFile, "sha256:" + hex.EncodeToString(fingerprint[:])})
+	check(t, err)
+
+	defer func(output string) { gittest.CmdOutput = output }(gittest.CmdOutput)
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook = HookConfig{Url: "/gitee_deploy", Type: "gitee", ClientCerts: certs}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		cert *x509.Certificate
+		code int
+	}{
+		{nil, http.StatusForbidden},
+		{client, http.StatusOK},
+		{server, http.StatusForbidden},
+		{pinned, http.StatusOK},
+		{other, http.StatusForbidden},
+	}
+	for i, test := range tests {
+		gittest.Sleep(time.Second * 5)
+		req, err := http.NewRequest("POST", "/gitee_deploy", strings.NewReader(`{"ref": "refs/heads/master"}`))
+		check(t, err)
+		req.Header.Set("X-Gitee-Event", "Push Hook")
+		if test.cert != nil {
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{test.cert}}
+		}
+		if code, _ := hook.ServeHTTP(httptest.NewRecorder(), req); code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+	}
+	if stats := repo.hookCounts(); stats.SignatureFailed != 3 {
+		t.Errorf("Expected 3 signature failures found %+v", stats)
+	}
+}
@@ -0,0 +1,113 @@
+package git
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type CodingHook struct{}
+
+type codingPush struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+}
+
+func (c CodingHook) DoesHandle(h http.Header) bool {
+	return h.Get("X-Coding-Event") != ""
+}
+
+func (c CodingHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusRequestTimeout, errors.New("could not read body from request")
+	}
+
+	secret, err := repo.Hook.LoadSecret()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := c.handleSignature(r, body, secret); err != nil {
+		return http.StatusBadRequest, signatureError{err}
+	}
+
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
+	}
+
+	if body, err = hookPayload(r, body); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	event := r.Header.Get("X-Coding-Event")
+	if event == "" {
+		return http.StatusBadRequest, errors.New("the 'X-Coding-Event' header is required but was missing.")
+	}
+
+	switch event {
+	case "push":
+		err := c.handlePush(body, repo)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+	// other events e.g. merge_request or ping are ignored.
+	default:
+		return http.StatusOK, nil
+	}
+
+	return http.StatusOK, nil
+}
+
+// handleSignature verifies the X-Coding-Signature header, the
+// sha1 HMAC of the body keyed with the token set for the webhook
+// on Coding, against the secret.
+func (c CodingHook) handleSignature(r *http.Request, body []byte, secret string) error {
+	if secret == "" {
+		Logger().Print("Unable to verify request signature. Secret not set in caddyfile!\n")
+		return nil
+	}
+
+	signature := r.Header.Get("X-Coding-Signature")
+	if !strings.HasPrefix(signature, "sha1=") {
+		return errors.New("could not verify request signature. The signature is missing or invalid!")
+	}
+
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	expectedMac := hex.EncodeToString(mac.Sum(nil))
+
+	if !hmac.Equal([]byte(signature[5:]), []byte(expectedMac)) {
+		return errors.New("could not verify request signature. The signature is invalid!")
+	}
+	return nil
+}
+
+func (c CodingHook) handlePush(body []byte, repo *Repo) error {
+	var push codingPush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return err
+	}
+
+	// extract the branch being pushed from the ref string
+	// and if it matches with our locally tracked one, pull.
+	if !strings.HasPrefix(push.Ref, "refs/heads/") {
+		return errors.New("the push request contained an invalid reference string.")
+	}
+
+	branch := strings.TrimPrefix(push.Ref, "refs/heads/")
+	repo.hookPush(branch, push.After)
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package git
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCodingDeployPush(t *testing.T) {
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/coding_deploy", Secret: "supersecret"}}
+	codingHook := CodingHook{}
+
+	for i, test := range []struct {
+		body      string
+		event     string
+		signature string
+		code      int
+	}{
+		{"", "", "", 400},
+		{"", "push", "", 400},
+		{"", "push", "sha1=wrongsignature", 400},
+		{pushCodingBodyOther, "push", codingSignature(pushCodingBodyOther, "wrongsecret"), 400},
+		{"", "push", codingSignature("", "supersecret"), 400},
+		{pushCodingBodyOther, "push", codingSignature(pushCodingBodyOther, "supersecret"), 200},
+		{pushCodingBodyPartial, "push", codingSignature(pushCodingBodyPartial, "supersecret"), 400},
+		{"", "merge_request", codingSignature("", "supersecret"), 200},
+	} {
+
+		req, err := http.NewRequest("POST", "/coding_deploy", bytes.NewBuffer([]byte(test.body)))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+
+		if test.event != "" {
+			req.Header.Add("X-Coding-Event", test.event)
+		}
+		if test.signature != "" {
+			req.Header.Add("X-Coding-Signature", test.signature)
+		}
+
+		rec := httptest.NewRecorder()
+
+		code, _ := codingHook.Handle(rec, req, repo)
+
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+	}
+
+}
+
+func codingSignature(body, secret string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var pushCodingBodyPartial = `
+{
+  "ref": ""
+}
+`
+
+var pushCodingBodyOther = `
+{
+  "ref": "refs/heads/some-other-branch",
+  "before": "0000000000000000000000000000000000000000",
+  "after": "41f0bd5a43371ba2d29c6d3c6ef7bed7c2ad3a5e"
+}
+`
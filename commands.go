@@ -2,16 +2,59 @@ package git
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/abiosoft/caddy-git/gitos"
 )
 
+// thenSlots limits the number of repositories executing their Then
+// commands at once.
+var thenSlots = &semaphore{}
+
+// SetThenConcurrency limits the number of repositories executing their
+// Then commands at once, across all repositories, to n. Pulls are not
+// limited; the commands of other repositories wait for a free slot.
+// If n is zero or less, there is no limit, the default.
+func SetThenConcurrency(n int) {
+	thenSlots.Lock()
+	defer thenSlots.Unlock()
+
+	thenSlots.slots = nil
+	if n > 0 {
+		thenSlots.slots = make(chan struct{}, n)
+	}
+}
+
+// semaphore limits concurrent executions to the capacity of slots.
+// A nil slots is unlimited.
+type semaphore struct {
+	slots chan struct{}
+	sync.Mutex
+}
+
+// acquire waits for a free slot and returns the function to release it.
+func (s *semaphore) acquire() func() {
+	s.Lock()
+	slots := s.slots
+	s.Unlock()
+
+	if slots == nil {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() { <-slots }
+}
+
 // Then is the command executed after successful pull.
 type Then interface {
 	Command() string
-	Exec(string) error
+	Exec(string, *PullEvent) error
 }
 
 // NewThen creates a new Then command.
@@ -24,10 +67,34 @@ func NewLongThen(command string, args ...string) Then {
 	return &gitCmd{command: command, args: args, background: true, haltChan: make(chan struct{})}
 }
 
+// NewThenIf creates a new Then command that is only executed if a file
+// matching pattern changed in the pull. See matchGlob for the syntax.
+func NewThenIf(pattern, command string, args ...string) Then {
+	return &pathThen{Then: NewThen(command, args...), pattern: pattern}
+}
+
+// pathThen is a Then command executed only if a file matching pattern
+// changed in the pull.
+type pathThen struct {
+	Then
+	pattern string
+}
+
+// matches checks if any of the changed files matches the pattern.
+func (p *pathThen) matches(files []string) bool {
+	for _, file := range files {
+		if matchGlob(p.pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
 type gitCmd struct {
 	command    string
 	args       []string
 	dir        string
+	event      *PullEvent
 	background bool
 	process    *os.Process
 
@@ -41,10 +108,13 @@ func (g *gitCmd) Command() string {
 	return g.command + " " + strings.Join(g.args, " ")
 }
 
-// Exec executes the command initiated in GitCmd
-func (g *gitCmd) Exec(dir string) error {
+// Exec executes the command initiated in GitCmd.
+// Details of the pull in event are passed to the command through
+// environment variables and standard input. See PullEvent.
+func (g *gitCmd) Exec(dir string, event *PullEvent) error {
 	g.Lock()
 	g.dir = dir
+	g.event = event
 	g.Unlock()
 
 	if g.background {
@@ -54,7 +124,7 @@ func (g *gitCmd) Exec(dir string) error {
 }
 
 func (g *gitCmd) restart() error {
-	err := g.Exec(g.dir)
+	err := g.Exec(g.dir, g.event)
 	if err == nil {
 		Logger().Printf("Restart successful for '%v'.\n", g.Command())
 	} else {
@@ -64,7 +134,7 @@ func (g *gitCmd) restart() error {
 }
 
 func (g *gitCmd) exec(dir string) error {
-	return runCmd(g.command, g.args, dir)
+	return runCmdWithInput(g.event.stdout(), g.command, g.args, dir, g.event.Env(), g.event.Input(), g.event.runAs())
 }
 
 func (g *gitCmd) execBackground(dir string) error {
@@ -75,7 +145,7 @@ func (g *gitCmd) execBackground(dir string) error {
 	}
 	g.RUnlock()
 
-	process, err := runCmdBackground(g.command, g.args, dir)
+	process, err := runCmdBackground(g.event.stdout(), g.command, g.args, dir, g.event.Env(), g.event.Input(), g.event.runAs())
 	if err == nil {
 		g.Lock()
 		g.process = process
@@ -176,37 +246,101 @@ func (g *gitCmd) haltProcess() {
 // It runs command with args from directory at dir.
 // The executed process outputs to os.Stderr
 func runCmd(command string, args []string, dir string) error {
+	return runCmdWithInput(os.Stderr, command, args, dir, nil, nil, nil)
+}
+
+// runCmdWithInput is like runCmd but additionally sets env on top of the
+// current environment, feeds input to the process's standard input and
+// writes its output to stdout. If user is set the process runs as user.
+func runCmdWithInput(stdout io.Writer, command string, args []string, dir string, env []string, input []byte, user *fileOwner) error {
 	cmd := gos.Command(command, args...)
-	cmd.Stdout(os.Stderr)
-	cmd.Stderr(os.Stderr)
+	cmd.Stdout(stdout)
+	cmd.Stderr(stdout)
 	cmd.Dir(dir)
+	setCmdInput(cmd, env, input)
+	setCmdUser(cmd, user)
 	if err := cmd.Start(); err != nil {
 		return err
 	}
 	return cmd.Wait()
 }
 
+// runGitCmd is like runCmdWithInput for git commands, with the output
+// written to stdout. The error output is captured as well to describe
+// failures with a gitError. If timeout is positive, the process is
+// killed if it runs longer than timeout.
+func runGitCmd(stdout io.Writer, command string, args []string, dir string, env []string, timeout time.Duration) error {
+	var stderr bytes.Buffer
+	cmd := gos.Command(command, args...)
+	cmd.Stdout(stdout)
+	cmd.Stderr(io.MultiWriter(os.Stderr, &stderr))
+	cmd.Dir(dir)
+	setCmdInput(cmd, env, nil)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var timedOut int32
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			if process := cmd.Process(); process != nil {
+				atomic.StoreInt32(&timedOut, 1)
+				process.Kill()
+			}
+		})
+		defer timer.Stop()
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return fmt.Errorf("git command timed out after %v", timeout)
+		}
+		return newGitError(err, stderr.String())
+	}
+	return nil
+}
+
 // runCmdBackground is a helper function to run commands in the background.
 // It returns the resulting process and an error that occurs during while
 // starting the process (if any).
-func runCmdBackground(command string, args []string, dir string) (*os.Process, error) {
+func runCmdBackground(stdout io.Writer, command string, args []string, dir string, env []string, input []byte, user *fileOwner) (*os.Process, error) {
 	cmd := gos.Command(command, args...)
 	cmd.Dir(dir)
-	cmd.Stdout(os.Stderr)
-	cmd.Stderr(os.Stderr)
+	cmd.Stdout(stdout)
+	cmd.Stderr(stdout)
+	setCmdUser(cmd, user)
+	setCmdInput(cmd, env, input)
 	err := cmd.Start()
 	return cmd.Process(), err
 }
 
+// setCmdInput sets env on top of the current environment and input
+// as standard input of cmd.
+func setCmdInput(cmd gitos.Cmd, env []string, input []byte) {
+	if len(env) > 0 {
+		cmd.Env(append(os.Environ(), env...))
+	}
+	if input != nil {
+		cmd.Stdin(bytes.NewReader(input))
+	}
+}
+
+// setCmdUser sets cmd to run as user, if set.
+func setCmdUser(cmd gitos.Cmd, user *fileOwner) {
+	if user != nil {
+		cmd.User(user.uid, user.gid)
+	}
+}
+
 // runCmdOutput is a helper function to run commands and return output.
 // It runs command with args from directory at dir.
 // If successful, returns output and nil error
 func runCmdOutput(command string, args []string, dir string) (string, error) {
 	cmd := gos.Command(command, args...)
 	cmd.Dir(dir)
-	var err error
-	if output, err := cmd.Output(); err == nil {
-		return string(bytes.TrimSpace(output)), nil
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
 	}
-	return "", err
+	return string(bytes.TrimSpace(output)), nil
 }
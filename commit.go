@@ -0,0 +1,71 @@
+package git
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// DefaultCommitEndpoint is the path of the commit endpoint if
+// commit_endpoint is set without a path.
+const DefaultCommitEndpoint = "/git/commit"
+
+// CommitEndpoint is middleware that responds with the commit checked out
+// by the repository with the ID in the repo query parameter, as plain
+// text, e.g. for CDN purge tooling. Requests must send Token in the
+// Authorization header as a bearer token.
+type CommitEndpoint struct {
+	Path  string
+	Token string
+	Next  middleware.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (e CommitEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != e.Path {
+		return e.Next.ServeHTTP(w, r)
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if e.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(e.Token)) != 1 {
+		return http.StatusUnauthorized, errors.New("invalid commit endpoint token")
+	}
+
+	id := r.URL.Query().Get("repo")
+	repos := registry.lookup(id)
+	if id == "" || len(repos) == 0 {
+		return http.StatusNotFound, fmt.Errorf("unknown repo %v", id)
+	}
+	// repositories sharing an ID are listed once per distinct commit
+	var commits []string
+	seen := make(map[string]bool)
+	for _, repo := range repos {
+		commit := repo.servedCommit()
+		if commit == "" {
+			return http.StatusServiceUnavailable, fmt.Errorf("no commit checked out for repo %v", id)
+		}
+		if !seen[commit] {
+			seen[commit] = true
+			commits = append(commits, commit)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(strings.Join(commits, "\n") + "\n"))
+	return 0, nil
+}
+
+// servedCommit returns the commit served by r as of the end of its most
+// recent pull, or "" if none is. In staging mode it is the commit of the
+// published release, not of the staging checkout.
+func (r *Repo) servedCommit() string {
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	return r.state.served
+}
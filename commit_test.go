@@ -0,0 +1,69 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestCommitEndpoint(t *testing.T) {
+	check(t, Init())
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.ID = "site"
+	defer func(output string) { gittest.CmdOutput = output }(gittest.CmdOutput)
+	gittest.CmdOutput = repo.URL
+	gittest.CmdOutputs["--no-pager"] = "a1b2c3"
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	check(t, repo.Prepare())
+	registry.add(repo)
+	defer registry.remove(repo)
+
+	endpoint := CommitEndpoint{Path: DefaultCommitEndpoint, Token: "supersecret", Next: okHandler{}}
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+		body   string
+	}{
+		{"GET", "/git/repos", "", http.StatusOK, ""},
+		{"POST", "/git/commit?repo=site", "supersecret", http.StatusMethodNotAllowed, ""},
+		{"GET", "/git/commit?repo=site", "", http.StatusUnauthorized, ""},
+		{"GET", "/git/commit?repo=site", "wrongsecret", http.StatusUnauthorized, ""},
+		{"GET", "/git/commit?repo=other", "supersecret", http.StatusNotFound, ""},
+		{"GET", "/git/commit", "supersecret", http.StatusNotFound, ""},
+		{"GET", "/git/commit?repo=site", "supersecret", 0, "a1b2c3\n"},
+	}
+	// the commit is served without waiting for a pull in progress
+	repo.Lock()
+	defer repo.Unlock()
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		check(t, err)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		if code, _ := endpoint.ServeHTTP(rec, req); code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+		if test.body != "" && rec.Body.String() != test.body {
+			t.Errorf("Test %v: expected body %q found %q", i, test.body, rec.Body.String())
+		}
+	}
+
+	// a repository without a checkout is unavailable
+	empty := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/empty.git"})
+	empty.ID = "empty"
+	check(t, empty.Prepare())
+	registry.add(empty)
+	defer registry.remove(empty)
+	req, err := http.NewRequest("GET", "/git/commit?repo=empty", nil)
+	check(t, err)
+	req.Header.Set("Authorization", "Bearer supersecret")
+	if code, _ := endpoint.ServeHTTP(httptest.NewRecorder(), req); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected code %v found %v", http.StatusServiceUnavailable, code)
+	}
+}
@@ -0,0 +1,574 @@
+package git
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config is the JSON representation of a repository configuration.
+// It allows the git middleware to be configured outside the Caddyfile.
+// Fields map to the Caddyfile directive of the same name, except some
+// optional arguments, which have fields of their own: HookSecret and
+// HookRetries of hook and hook_delay, NightWindow of night_multiplier,
+// DeployMethod of on_deploy_webhook and TokenUser of token_file. The
+// commands of Then, ThenLong and ThenIf run in that order.
+type Config struct {
+	ID             string       `json:"id,omitempty"`
+	Repo           string       `json:"repo"`
+	Path           string       `json:"path,omitempty"`
+	RawURL         bool         `json:"raw_url,omitempty"`
+	StrictHost     bool         `json:"strict_host,omitempty"`
+	HTTPHeader     []string     `json:"http_header,omitempty"` // Name: value
+	DeployHook     string       `json:"on_deploy_webhook,omitempty"`
+	DeployMethod   string       `json:"on_deploy_method,omitempty"`
+	DeployHeader   []string     `json:"on_deploy_header,omitempty"` // Name: value
+	DeployBody     string       `json:"on_deploy_body,omitempty"`
+	Mirror         []string     `json:"mirror,omitempty"`
+	Overlay        [][]string   `json:"overlay,omitempty"` // URL followed by optional branch
+	Branch         string       `json:"branch,omitempty"`
+	RefFile        string       `json:"ref_file,omitempty"`
+	Key            string       `json:"key,omitempty"`
+	KeyPassphrase  string       `json:"key_passphrase,omitempty"`
+	KeyPassFile    string       `json:"key_passphrase_file,omitempty"`
+	SSHAgent       *string      `json:"ssh_agent,omitempty"`
+	Interval       int          `json:"interval,omitempty"`       // seconds
+	GCInterval     int          `json:"gc_interval,omitempty"`    // seconds
+	ShutdownGrace  *int         `json:"shutdown_grace,omitempty"` // seconds
+	CloneTimeout   int          `json:"clone_timeout,omitempty"`  // seconds
+	PullTimeout    int          `json:"pull_timeout,omitempty"`   // seconds
+	Stagger        bool         `json:"stagger,omitempty"`
+	AsyncStartup   bool         `json:"async_startup,omitempty"`
+	SkipIfFresh    int          `json:"skip_if_fresh,omitempty"` // seconds
+	FailOpen       bool         `json:"fail_open,omitempty"`
+	LogFile        string       `json:"log_file,omitempty"`
+	CheckRemote    bool         `json:"check_remote,omitempty"`
+	ServeGitDir    bool         `json:"serve_git_dir,omitempty"`
+	Maintenance    *string      `json:"maintenance,omitempty"`
+	Fallback       *string      `json:"fallback,omitempty"`
+	ReposEndpoint  *string      `json:"repos_endpoint,omitempty"`
+	PauseEndpoint  []string     `json:"pause_endpoint,omitempty"`  // token followed by optional path
+	CommitEndpoint []string     `json:"commit_endpoint,omitempty"` // token followed by optional path
+	PausedHooks    string       `json:"paused_hooks,omitempty"`
+	CommitBack     *string      `json:"commit_back,omitempty"`
+	Hook           string       `json:"hook,omitempty"`
+	HookSecret     string       `json:"hook_secret,omitempty"`
+	HookSecretFile string       `json:"hook_secret_file,omitempty"`
+	HookClientCert []string     `json:"hook_client_cert,omitempty"` // CA files or sha256: fingerprints
+	HookType       string       `json:"hook_type,omitempty"`
+	TrustPayload   *bool        `json:"trust_payload,omitempty"`
+	HookFollowRef  bool         `json:"hook_follow_ref,omitempty"`
+	HookVerify     *int         `json:"hook_verify_commit,omitempty"`
+	HookDelay      int          `json:"hook_delay,omitempty"`    // seconds
+	HookRetries    int          `json:"hook_retries,omitempty"`  // retries after hook_delay
+	HookMaxSize    int64        `json:"hook_max_size,omitempty"` // bytes
+	Refspec        []string     `json:"refspec,omitempty"`
+	NoTags         bool         `json:"no_tags,omitempty"`
+	ShallowSince   string       `json:"shallow_since,omitempty"` // YYYY-MM-DD
+	Partial        bool         `json:"partial,omitempty"`
+	Reference      string       `json:"reference,omitempty"`
+	SubmoduleDepth int          `json:"submodule_depth,omitempty"`
+	SubmodulePaths []string     `json:"submodule_paths,omitempty"`
+	VerifyManifest []string     `json:"verify_manifest,omitempty"` // manifest, signature and key file
+	Verify         bool         `json:"verify,omitempty"`
+	RequireAuth    bool         `json:"require_auth_at_startup,omitempty"`
+	RateLimit      int          `json:"rate_limit,omitempty"` // KB/s
+	FetchRetries   int          `json:"fetch_retries,omitempty"`
+	OnConflict     string       `json:"conflict_strategy,omitempty"`
+	AllowForce     bool         `json:"allow_force,omitempty"`
+	ThenOnError    string       `json:"then_on_error,omitempty"`
+	Chmod          []string     `json:"chmod,omitempty"` // file mode followed by directory mode
+	Chown          string       `json:"chown,omitempty"`
+	ThenUser       string       `json:"then_user,omitempty"`
+	ServeSubdir    string       `json:"serve_subdir,omitempty"`
+	WatchPath      string       `json:"watch_path,omitempty"`
+	SkipMessage    string       `json:"skip_message,omitempty"`
+	IgnorePaths    []string     `json:"ignore_paths,omitempty"`
+	Socket         string       `json:"socket,omitempty"`
+	Temp           bool         `json:"temp,omitempty"`
+	Staging        string       `json:"staging,omitempty"`
+	Aliases        []string     `json:"alias,omitempty"`
+	PauseFile      string       `json:"pause_file,omitempty"`
+	OAuth          *OAuthConfig `json:"oauth,omitempty"`
+	AppPassword    []string     `json:"app_password,omitempty"` // username followed by password
+	TokenFile      string       `json:"token_file,omitempty"`
+	TokenUser      string       `json:"token_username,omitempty"`
+	QuietPeriod    []string     `json:"quiet_period,omitempty"` // HH:MM-HH:MM
+	NightMult      int          `json:"night_multiplier,omitempty"`
+	NightWindow    string       `json:"night_window,omitempty"` // HH:MM-HH:MM
+	Timezone       string       `json:"timezone,omitempty"`
+	Then           [][]string   `json:"then,omitempty"`      // command followed by args
+	ThenLong       [][]string   `json:"then_long,omitempty"` // command followed by args
+	ThenIf         [][]string   `json:"then_if,omitempty"`   // pattern followed by command and args
+	ThenOnce       [][]string   `json:"then_once,omitempty"` // command followed by args
+	ThenLimit      int          `json:"then_concurrency,omitempty"`
+	Priority       int          `json:"priority,omitempty"`
+	CloneJobs      int          `json:"clone_jobs,omitempty"`
+	PrePull        [][]string   `json:"pre_pull,omitempty"` // command followed by args
+}
+
+// OAuthConfig is the JSON representation of the oauth directive.
+type OAuthConfig struct {
+	TokenURL     string `json:"token_url"`
+	RefreshToken string `json:"refresh_token"`
+	ClientID     string `json:"client_id,omitempty"`
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+// ParseJSON parses a JSON array of repository configurations and
+// prepares the repositories for use. Paths are relative to root.
+func ParseJSON(root string, data []byte) (Git, error) {
+	return Git(nil).parseJSON(root, data)
+}
+
+// parseJSON is like ParseJSON but also ensures the repositories do not
+// clash with the repositories in g.
+func (g Git) parseJSON(root string, data []byte) (Git, error) {
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+
+	all := append(Git{}, g...)
+	var git Git
+	for _, config := range configs {
+		repo, err := config.repo(root)
+		if err != nil {
+			return nil, err
+		}
+		if err = all.checkHook(repo); err != nil {
+			return nil, err
+		}
+		if err = all.setupRepo(repo); err != nil {
+			return nil, err
+		}
+		all = append(all, repo)
+		git = append(git, repo)
+	}
+	return git, nil
+}
+
+// includeDir loads the repository configurations in the JSON files in
+// dir, see ParseJSON. Files that cannot be loaded are skipped with a
+// warning, so a malformed file does not stop the server.
+func (g Git) includeDir(root, dir string) (Git, error) {
+	files, err := gos.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	all := append(Git{}, g...)
+	var git Git
+	for _, file := range files {
+		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+		name := filepath.Join(dir, file.Name())
+		data, err := gos.ReadFile(name)
+		if err != nil {
+			Logger().Printf("Skipping %v: %v\n", name, err)
+			continue
+		}
+		repos, err := all.parseJSON(root, data)
+		if err != nil {
+			Logger().Printf("Skipping %v: %v\n", name, err)
+			continue
+		}
+		all = append(all, repos...)
+		git = append(git, repos...)
+	}
+	return git, nil
+}
+
+// repo converts c to a Repo with paths relative to root.
+func (c Config) repo(root string) (*Repo, error) {
+	repo := &Repo{Interval: DefaultInterval, Path: root, ShutdownGrace: DefaultShutdownGrace}
+
+	if c.Repo == "" {
+		return nil, fmt.Errorf("repo is required")
+	}
+	repo.ID = c.ID
+	repo.URL = c.Repo
+	repo.RawURL = c.RawURL
+	repo.StrictHost = c.StrictHost
+	if c.Path != "" {
+		repo.Path = filepath.Clean(root + string(filepath.Separator) + c.Path)
+	}
+	if c.Branch != "" {
+		repo.Branch = c.Branch
+	}
+	repo.RefFile = c.RefFile
+	repo.Mirrors = c.Mirror
+	for _, o := range c.Overlay {
+		if len(o) == 0 || len(o) > 2 || o[0] == "" {
+			return nil, fmt.Errorf("invalid overlay %v, must be URL followed by optional branch", o)
+		}
+		overlay := Overlay{URL: o[0]}
+		if len(o) == 2 {
+			overlay.Branch = o[1]
+		}
+		repo.Overlays = append(repo.Overlays, overlay)
+	}
+	for _, h := range c.HTTPHeader {
+		fields := strings.SplitN(h, ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid http_header %v, must be Name: value", h)
+		}
+		header, err := httpHeader(strings.TrimSpace(fields[0]), strings.TrimSpace(fields[1]))
+		if err != nil {
+			return nil, err
+		}
+		repo.HTTPHeaders = append(repo.HTTPHeaders, header)
+	}
+	if c.DeployHook != "" || c.DeployMethod != "" || len(c.DeployHeader) > 0 || c.DeployBody != "" {
+		repo.DeployHook = &DeployHook{
+			URL:     c.DeployHook,
+			Method:  strings.ToUpper(c.DeployMethod),
+			Headers: c.DeployHeader,
+			Body:    c.DeployBody,
+		}
+	}
+	if err := checkPatterns(c.IgnorePaths); err != nil {
+		return nil, err
+	}
+	repo.IgnorePaths = c.IgnorePaths
+	repo.NoTags = c.NoTags
+	if c.ShallowSince != "" {
+		if _, err := time.Parse(shallowSinceFormat, c.ShallowSince); err != nil {
+			return nil, fmt.Errorf("invalid shallow_since date %v, must be YYYY-MM-DD", c.ShallowSince)
+		}
+		repo.ShallowSince = c.ShallowSince
+	}
+	repo.Partial = c.Partial
+	if c.Reference != "" {
+		repo.Reference = filepath.Clean(c.Reference)
+	}
+	if c.SubmoduleDepth < 0 {
+		return nil, fmt.Errorf("invalid submodule depth %v", c.SubmoduleDepth)
+	}
+	repo.SubmoduleDepth = c.SubmoduleDepth
+	for _, p := range c.SubmodulePaths {
+		repo.SubmodulePaths = append(repo.SubmodulePaths, filepath.Clean(p))
+	}
+	if len(c.VerifyManifest) > 0 {
+		if len(c.VerifyManifest) != 3 {
+			return nil, fmt.Errorf("verify_manifest must be the manifest, signature and key file")
+		}
+		if err := repo.setManifest(c.VerifyManifest[0], c.VerifyManifest[1], c.VerifyManifest[2]); err != nil {
+			return nil, err
+		}
+	}
+	repo.Verify = c.Verify
+	repo.RequireAuth = c.RequireAuth
+	if c.ThenLimit < 0 {
+		return nil, fmt.Errorf("invalid then concurrency %v", c.ThenLimit)
+	}
+	repo.thenConcurrency = c.ThenLimit
+	if c.CloneJobs < 0 {
+		return nil, fmt.Errorf("invalid clone jobs %v", c.CloneJobs)
+	}
+	repo.cloneJobs = c.CloneJobs
+	repo.Priority = c.Priority
+	if c.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate limit %v", c.RateLimit)
+	}
+	repo.RateLimit = c.RateLimit
+	if c.FetchRetries < 0 {
+		return nil, fmt.Errorf("invalid fetch retries %v", c.FetchRetries)
+	}
+	repo.FetchRetries = c.FetchRetries
+	if c.OnConflict != "" && !validConflictStrategy(c.OnConflict) {
+		return nil, fmt.Errorf("invalid conflict strategy %v", c.OnConflict)
+	}
+	repo.OnConflict = c.OnConflict
+	repo.AllowForce = c.AllowForce
+	if c.ThenOnError != "" && !validThenOnError(c.ThenOnError) {
+		return nil, fmt.Errorf("invalid then_on_error %v, must be fail, continue or stop", c.ThenOnError)
+	}
+	repo.ThenOnError = c.ThenOnError
+	if len(c.Chmod) > 2 {
+		return nil, fmt.Errorf("chmod takes a file mode and a directory mode")
+	}
+	for i, m := range c.Chmod {
+		mode, err := parseMode(m)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			repo.FileMode = mode
+		} else {
+			repo.DirMode = mode
+		}
+	}
+	if c.ServeSubdir != "" {
+		dir, err := cleanSubdir("serve_subdir", c.ServeSubdir)
+		if err != nil {
+			return nil, err
+		}
+		repo.ServeSubdir = dir
+	}
+	if c.WatchPath != "" {
+		path, err := cleanSubdir("watch_path", c.WatchPath)
+		if err != nil {
+			return nil, err
+		}
+		repo.WatchPath = filepath.ToSlash(path)
+	}
+	repo.SkipMessage = c.SkipMessage
+	if c.Chown != "" {
+		owner, err := parseOwner(c.Chown)
+		if err != nil {
+			return nil, err
+		}
+		repo.owner = owner
+	}
+	if c.ThenUser != "" {
+		user, err := parseUser(c.ThenUser)
+		if err != nil {
+			return nil, err
+		}
+		repo.thenUser = user
+	}
+	repo.KeyPath = c.Key
+	repo.passphrase = c.KeyPassphrase
+	repo.PassphraseFile = c.KeyPassFile
+	if c.SSHAgent != nil {
+		repo.SSHAgent = *c.SSHAgent
+		if repo.SSHAgent == "" {
+			repo.SSHAgent = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if repo.SSHAgent == "" {
+			return nil, fmt.Errorf("ssh_agent requires SSH_AUTH_SOCK to be set or a socket")
+		}
+	}
+	repo.Stagger = c.Stagger
+	repo.AsyncStartup = c.AsyncStartup
+	if c.SkipIfFresh < 0 {
+		return nil, fmt.Errorf("invalid freshness window %v", c.SkipIfFresh)
+	}
+	repo.SkipIfFresh = time.Duration(c.SkipIfFresh) * time.Second
+	repo.FailOpen = c.FailOpen
+	repo.CheckRemote = c.CheckRemote
+	repo.LogFile = c.LogFile
+	repo.ServeGitDir = c.ServeGitDir
+	if c.CommitBack != nil {
+		repo.CommitBack = *c.CommitBack
+		if repo.CommitBack == "" {
+			repo.CommitBack = DefaultCommitMessage
+		}
+	}
+	if c.Maintenance != nil {
+		repo.Maintenance = true
+		repo.MaintenancePage = *c.Maintenance
+	}
+	if c.Fallback != nil {
+		repo.Fallback = true
+		repo.FallbackPage = *c.Fallback
+	}
+	if c.PauseEndpoint != nil {
+		if len(c.PauseEndpoint) < 1 || len(c.PauseEndpoint) > 2 || c.PauseEndpoint[0] == "" {
+			return nil, fmt.Errorf("pause_endpoint takes a token and an optional path")
+		}
+		repo.pauseToken = c.PauseEndpoint[0]
+		repo.PauseEndpoint = DefaultPauseEndpoint
+		if len(c.PauseEndpoint) == 2 {
+			repo.PauseEndpoint = path.Clean("/" + c.PauseEndpoint[1])
+		}
+	}
+	if c.CommitEndpoint != nil {
+		if len(c.CommitEndpoint) < 1 || len(c.CommitEndpoint) > 2 || c.CommitEndpoint[0] == "" {
+			return nil, fmt.Errorf("commit_endpoint takes a token and an optional path")
+		}
+		repo.commitToken = c.CommitEndpoint[0]
+		repo.CommitEndpoint = DefaultCommitEndpoint
+		if len(c.CommitEndpoint) == 2 {
+			repo.CommitEndpoint = path.Clean("/" + c.CommitEndpoint[1])
+		}
+	}
+	switch c.PausedHooks {
+	case "", "drop":
+	case "queue":
+		repo.QueueHooks = true
+	default:
+		return nil, fmt.Errorf("invalid paused_hooks %v, must be drop or queue", c.PausedHooks)
+	}
+	if c.ReposEndpoint != nil {
+		repo.ReposEndpoint = DefaultReposEndpoint
+		if *c.ReposEndpoint != "" {
+			repo.ReposEndpoint = path.Clean("/" + *c.ReposEndpoint)
+		}
+	}
+	if c.Interval > 0 {
+		repo.Interval = time.Duration(c.Interval) * time.Second
+	}
+	if c.GCInterval < 0 {
+		return nil, fmt.Errorf("invalid gc interval %v", c.GCInterval)
+	}
+	repo.GCInterval = time.Duration(c.GCInterval) * time.Second
+	if c.ShutdownGrace != nil {
+		if *c.ShutdownGrace < 0 {
+			return nil, fmt.Errorf("invalid shutdown grace %v", *c.ShutdownGrace)
+		}
+		repo.ShutdownGrace = time.Duration(*c.ShutdownGrace) * time.Second
+	}
+	if c.CloneTimeout < 0 || c.PullTimeout < 0 {
+		return nil, fmt.Errorf("invalid clone timeout %v or pull timeout %v", c.CloneTimeout, c.PullTimeout)
+	}
+	repo.CloneTimeout = time.Duration(c.CloneTimeout) * time.Second
+	repo.PullTimeout = time.Duration(c.PullTimeout) * time.Second
+
+	repo.Hook.Url = c.Hook
+	repo.Hook.Secret = c.HookSecret
+	repo.Hook.SecretFile = c.HookSecretFile
+	if c.HookClientCert != nil {
+		certs, err := parseClientCerts(c.HookClientCert)
+		if err != nil {
+			return nil, err
+		}
+		repo.Hook.ClientCerts = certs
+	}
+	repo.Hook.IgnorePayload = c.TrustPayload != nil && !*c.TrustPayload
+	repo.Hook.FollowRef = c.HookFollowRef
+	if c.HookVerify != nil {
+		if *c.HookVerify < 0 {
+			return nil, fmt.Errorf("invalid hook_verify_commit retries %v", *c.HookVerify)
+		}
+		repo.Hook.CommitRetries = DefaultCommitRetries
+		if *c.HookVerify > 0 {
+			repo.Hook.CommitRetries = *c.HookVerify
+		}
+	}
+	if c.HookDelay < 0 || c.HookRetries < 0 {
+		return nil, fmt.Errorf("invalid hook delay %v or retries %v", c.HookDelay, c.HookRetries)
+	}
+	repo.Hook.Delay = time.Duration(c.HookDelay) * time.Second
+	repo.Hook.Retries = c.HookRetries
+	if c.HookMaxSize < 0 {
+		return nil, fmt.Errorf("invalid hook max size %v", c.HookMaxSize)
+	}
+	repo.Hook.MaxSize = c.HookMaxSize
+	if c.HookType != "" {
+		if _, ok := handlers[c.HookType]; !ok {
+			return nil, fmt.Errorf("invalid hook type %v", c.HookType)
+		}
+		repo.Hook.Type = c.HookType
+	}
+
+	for _, refspec := range c.Refspec {
+		if !validRefspec(refspec) {
+			return nil, fmt.Errorf("invalid refspec %v", refspec)
+		}
+		repo.Refspecs = append(repo.Refspecs, refspec)
+	}
+
+	repo.SocketPath = c.Socket
+	repo.Temp = c.Temp
+	if c.Staging != "" {
+		repo.Staging = filepath.Clean(c.Staging)
+	}
+	for _, alias := range c.Aliases {
+		repo.Aliases = append(repo.Aliases, filepath.Clean(alias))
+	}
+	repo.PauseFile = c.PauseFile
+
+	if c.OAuth != nil {
+		if c.OAuth.TokenURL == "" || c.OAuth.RefreshToken == "" {
+			return nil, fmt.Errorf("oauth requires token_url and refresh_token")
+		}
+		repo.creds = &oauthCredentials{
+			tokenURL:     c.OAuth.TokenURL,
+			refreshToken: c.OAuth.RefreshToken,
+			clientID:     c.OAuth.ClientID,
+			clientSecret: c.OAuth.ClientSecret,
+		}
+	}
+	if c.TokenFile != "" {
+		if repo.creds != nil {
+			return nil, errors.New(errMultipleCredentials)
+		}
+		t := &tokenFileCredentials{path: c.TokenFile, username: oauthUsername}
+		if c.TokenUser != "" {
+			t.username = c.TokenUser
+		}
+		repo.creds = t
+	}
+	if c.AppPassword != nil {
+		if len(c.AppPassword) != 2 || c.AppPassword[0] == "" || c.AppPassword[1] == "" {
+			return nil, fmt.Errorf("app_password takes a username and a password")
+		}
+		if repo.creds != nil {
+			return nil, errors.New(errMultipleCredentials)
+		}
+		repo.creds = &appPasswordCredentials{username: c.AppPassword[0], password: c.AppPassword[1]}
+	}
+
+	for _, period := range c.QuietPeriod {
+		w, err := parseTimeWindow(period)
+		if err != nil {
+			return nil, err
+		}
+		repo.QuietPeriods = append(repo.QuietPeriods, w)
+	}
+	if c.NightMult < 0 {
+		return nil, fmt.Errorf("invalid night multiplier %v", c.NightMult)
+	}
+	if c.NightMult > 0 {
+		window := DefaultNightWindow
+		if c.NightWindow != "" {
+			window = c.NightWindow
+		}
+		w, err := parseTimeWindow(window)
+		if err != nil {
+			return nil, err
+		}
+		repo.NightMultiplier, repo.NightWindow = c.NightMult, w
+	}
+	if c.Timezone != "" {
+		loc, err := time.LoadLocation(c.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %v", c.Timezone)
+		}
+		repo.Timezone = loc
+	}
+
+	for _, command := range c.Then {
+		if len(command) == 0 {
+			return nil, fmt.Errorf("then requires a command")
+		}
+		repo.Then = append(repo.Then, NewThen(command[0], command[1:]...))
+	}
+	for _, command := range c.ThenLong {
+		if len(command) == 0 {
+			return nil, fmt.Errorf("then_long requires a command")
+		}
+		repo.Then = append(repo.Then, NewLongThen(command[0], command[1:]...))
+	}
+	for _, command := range c.ThenIf {
+		if len(command) < 2 {
+			return nil, fmt.Errorf("then_if requires a pattern and a command")
+		}
+		if _, err := path.Match(command[0], ""); err != nil {
+			return nil, fmt.Errorf("invalid then_if pattern %v", command[0])
+		}
+		repo.Then = append(repo.Then, NewThenIf(command[0], command[1], command[2:]...))
+	}
+	for _, command := range c.ThenOnce {
+		if len(command) == 0 {
+			return nil, fmt.Errorf("then_once requires a command")
+		}
+		repo.ThenOnce = append(repo.ThenOnce, NewThen(command[0], command[1:]...))
+	}
+	for _, command := range c.PrePull {
+		if len(command) == 0 {
+			return nil, fmt.Errorf("pre_pull requires a command")
+		}
+		repo.PrePull = append(repo.PrePull, NewThen(command[0], command[1:]...))
+	}
+
+	return repo, nil
+}
@@ -0,0 +1,91 @@
+package git
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestParseJSON(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expected  *Repo
+	}{
+		{`[{"repo": "https://github.com/user/repo"}]`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			Branch:   "master",
+			Interval: DefaultInterval,
+		}},
+		{`[{"repo": "https://github.com/user/repo", "path": "subfolder", "branch": "dev", "interval": 600}]`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			Path:     "subfolder",
+			Branch:   "dev",
+			Interval: time.Second * 600,
+		}},
+		{`[{"repo": "https://github.com/user/repo", "key": "~/.key"}]`, false, &Repo{
+			KeyPath: "~/.key",
+			URL:     "git@github.com:user/repo.git",
+		}},
+		{`[{"repo": "https://github.com/user/repo", "then": [["echo", "hello", "world"]]}]`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Then: []Then{NewThen("echo", "hello world")},
+		}},
+		{`[{"repo": "https://github.com/user/repo", "hook_type": "unknown"}]`, true, nil},
+		{`[{"repo": "https://github.com/user/repo", "then": [[]]}]`, true, nil},
+		{`[{"repo": "https://github.com/user/repo", "app_password": ["user"]}]`, true, nil},
+		{`[{"repo": "https://github.com/user/repo", "http_header": ["X-Proxy-Token: abc123"]}]`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			HTTPHeaders: []string{"X-Proxy-Token: abc123"},
+		}},
+		{`[{"repo": "https://github.com/user/repo", "http_header": ["X-Proxy-Token"]}]`, true, nil},
+		{`[{"repo": "https://github.com/user/repo", "key": "~/.key", "http_header": ["X-Proxy-Token: abc123"]}]`, true, nil},
+		{`[{"repo": "https://github.com/user/repo", "path": "one", "serve_subdir": "public"},
+			{"repo": "https://github.com/user/other", "path": "two", "serve_subdir": "public"}]`, true, nil},
+		{`[{"path": "subfolder"}]`, true, nil},
+		{`{"repo": "https://github.com/user/repo"}`, true, nil},
+	}
+
+	for i, test := range tests {
+		git, err := ParseJSON(".", []byte(test.input))
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %v should not error but found %v", i, err)
+			continue
+		}
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v should error but found nil", i)
+			continue
+		}
+		repo := git.Repo(0)
+		if !reposEqual(test.expected, repo) {
+			t.Errorf("Test %v expects %v but found %v", i, test.expected, repo)
+		}
+	}
+}
+
+func TestIncludeDir(t *testing.T) {
+	files := map[string]string{
+		"git.d/a.json":      `[{"repo": "https://github.com/user/a", "path": "a"}]`,
+		"git.d/b.json":      `[{"repo": "https://github.com/user/b", "path": "b"}, {"repo": "https://github.com/user/c", "path": "c"}]`,
+		"git.d/broken.json": `[{"repo": `,
+		"git.d/clash.json":  `[{"repo": "https://github.com/user/d", "path": "a"}]`,
+		"git.d/notes.txt":   `not a config`,
+	}
+	for name, content := range files {
+		gittest.FileContents[name] = content
+		defer delete(gittest.FileContents, name)
+	}
+
+	git, err := Git(nil).includeDir(".", "git.d")
+	check(t, err)
+	var urls []string
+	for _, repo := range git {
+		urls = append(urls, repo.URL)
+	}
+	expected := "[https://github.com/user/a.git https://github.com/user/b.git https://github.com/user/c.git]"
+	if fmt.Sprint(urls) != expected {
+		t.Errorf("Expected repos %v found %v", expected, urls)
+	}
+}
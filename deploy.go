@@ -0,0 +1,152 @@
+package git
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultDeployBody is the body template of the deploy webhook if
+// on_deploy_body is not set.
+const DefaultDeployBody = `{"id":{{json .ID}},"url":{{json .URL}},"branch":{{json .Branch}},` +
+	`"old_commit":{{json .OldCommit}},"new_commit":{{json .NewCommit}},"changed_files":{{.ChangedFiles}},` +
+	`"commits":{{.CommitCount}},"duration":{{.Duration}},"time":{{json .Time}},"error":{{json .Error}}}`
+
+// deployClient is the http client used to send deploy webhooks.
+var deployClient = &http.Client{Timeout: time.Second * 10}
+
+// DeployHook is an HTTP request sent after each pull that brought new
+// changes, e.g. to add a deploy marker to an APM. The body and the
+// values of the headers are templates executed with a DeployEvent.
+type DeployHook struct {
+	URL     string   // URL to send the request to
+	Method  string   // HTTP method, POST if empty
+	Headers []string // "Name: value" headers
+	Body    string   // body template, DefaultDeployBody if empty
+
+	body    *template.Template
+	headers []*template.Template
+}
+
+// DeployEvent holds the details of a deploy passed to the templates of
+// a DeployHook.
+type DeployEvent struct {
+	ID           string    // ID of the repository
+	URL          string    // URL of the repository, without credentials
+	Branch       string    // branch pulled
+	OldCommit    string    // commit before the pull, empty if unknown
+	NewCommit    string    // commit after the pull
+	ChangedFiles int       // number of files changed by the pull
+	CommitCount  int       // number of commits pulled, -1 if unknown
+	Duration     float64   // seconds taken by the pull and its commands
+	Time         time.Time // time the deploy finished
+	Error        string    // error of the commands, empty if they succeeded
+}
+
+// deployFuncs are the functions available in the templates.
+var deployFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+// parse parses the templates of d.
+func (d *DeployHook) parse() error {
+	if d.Method == "" {
+		d.Method = "POST"
+	}
+	body := d.Body
+	if body == "" {
+		body = DefaultDeployBody
+	}
+	var err error
+	if d.body, err = template.New("body").Funcs(deployFuncs).Parse(body); err != nil {
+		return fmt.Errorf("invalid on_deploy_body: %v", err)
+	}
+	d.headers = nil
+	for _, header := range d.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t\r\n") {
+			return fmt.Errorf("invalid on_deploy_header %v", header)
+		}
+		t, err := template.New(parts[0]).Funcs(deployFuncs).Parse(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return fmt.Errorf("invalid on_deploy_header %v: %v", parts[0], err)
+		}
+		d.headers = append(d.headers, t)
+	}
+	return nil
+}
+
+// request creates the request of d for event.
+func (d *DeployHook) request(event DeployEvent) (*http.Request, error) {
+	var body bytes.Buffer
+	if err := d.body.Execute(&body, event); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(d.Method, d.URL, &body)
+	if err != nil {
+		return nil, err
+	}
+	if d.Body == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for _, t := range d.headers {
+		var value bytes.Buffer
+		if err = t.Execute(&value, event); err != nil {
+			return nil, err
+		}
+		if strings.ContainsAny(value.String(), "\r\n") {
+			return nil, fmt.Errorf("invalid value of header %v", t.Name())
+		}
+		req.Header.Set(t.Name(), value.String())
+	}
+	return req, nil
+}
+
+// send sends the request of d for event. Failures are logged and do not
+// fail the pull.
+func (d *DeployHook) send(r *Repo, event DeployEvent) {
+	req, err := d.request(event)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = deployClient.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("%v responded %v", redactURL(d.URL), resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		r.logger().Printf("Deploy webhook of %v failed: %v\n", r.URL, err)
+	}
+}
+
+// notifyDeploy sends the deploy webhook of r, if set, in the background
+// for the pull of event that started at start, with err the error of
+// the commands.
+func (r *Repo) notifyDeploy(event *PullEvent, start time.Time, err error) {
+	if r.DeployHook == nil {
+		return
+	}
+	e := DeployEvent{
+		ID:           redactURL(r.ID),
+		URL:          redactURL(r.URL),
+		Branch:       r.Branch,
+		OldCommit:    event.OldCommit,
+		NewCommit:    event.NewCommit,
+		ChangedFiles: len(event.ChangedFiles),
+		CommitCount:  event.CommitCount,
+		Duration:     time.Since(start).Seconds(),
+		Time:         time.Now(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	go r.DeployHook.send(r, e)
+}
@@ -0,0 +1,90 @@
+package git
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestDeployHook(t *testing.T) {
+	type request struct {
+		method string
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{r.Method, r.Header, body}
+	}))
+	defer server.Close()
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.ID = "site"
+	repo.DeployHook = &DeployHook{URL: server.URL, Headers: []string{"X-Deploy: {{.ID}}@{{.NewCommit}}"}}
+	check(t, repo.DeployHook.parse())
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+
+	var req request
+	select {
+	case req = <-requests:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Expected deploy webhook")
+	}
+	if req.method != "POST" || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("Expected POST of JSON found %v %v", req.method, req.header.Get("Content-Type"))
+	}
+	if expected := "site@" + repo.lastCommit; req.header.Get("X-Deploy") != expected {
+		t.Errorf("Expected header %v found %v", expected, req.header.Get("X-Deploy"))
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(req.body, &body); err != nil {
+		t.Fatalf("Expected JSON body found %s: %v", req.body, err)
+	}
+	if body["id"] != "site" || body["new_commit"] != repo.lastCommit || body["error"] != "" {
+		t.Errorf("Unexpected body %s", req.body)
+	}
+
+	// no webhook without new changes
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	select {
+	case req = <-requests:
+		t.Errorf("Expected no deploy webhook without changes found %s", req.body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDeployHookParse(t *testing.T) {
+	tests := []struct {
+		hook      DeployHook
+		shouldErr bool
+	}{
+		{DeployHook{}, false},
+		{DeployHook{Body: `{{.NewCommit}}`, Headers: []string{"Authorization: Bearer token"}}, false},
+		{DeployHook{Body: `{{.NewCommit`}, true},
+		{DeployHook{Headers: []string{"X-Deploy {{.ID}}"}}, true},
+		{DeployHook{Headers: []string{"X-Deploy: {{.ID"}}, true},
+	}
+	for i, test := range tests {
+		err := test.hook.parse()
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+		}
+	}
+
+	hook := DeployHook{URL: "https://apm.example.com/markers", Method: "PUT", Body: `{"sha":{{json .NewCommit}},"files":{{.ChangedFiles}}}`}
+	check(t, hook.parse())
+	req, err := hook.request(DeployEvent{NewCommit: "abc", ChangedFiles: 3})
+	check(t, err)
+	body, _ := ioutil.ReadAll(req.Body)
+	if req.Method != "PUT" || string(body) != `{"sha":"abc","files":3}` {
+		t.Errorf("Unexpected request %v %s", req.Method, body)
+	}
+}
@@ -0,0 +1,213 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Errors of common git failures. The errors of failed git commands
+// returned by Pull, Prepare and the other methods of Repo match them
+// with errors.Is, and wrap the error of the command, e.g. *exec.ExitError.
+var (
+	ErrHostKey        = errors.New("git host key unknown")
+	ErrAuth           = errors.New("git authentication failed")
+	ErrRepoNotFound   = errors.New("git repository not found")
+	ErrBranchNotFound = errors.New("git branch not found")
+	ErrMergeConflict  = errors.New("git merge conflict")
+	ErrDiverged       = errors.New("git branch cannot be fast-forwarded")
+	ErrNetwork        = errors.New("git network failure")
+)
+
+// isPermanent checks if err is a git failure that is not fixed by
+// retrying, e.g. invalid credentials or a missing repository.
+func isPermanent(err error) bool {
+	for _, kind := range []error{ErrHostKey, ErrAuth, ErrRepoNotFound, ErrBranchNotFound} {
+		if errors.Is(err, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxErrorOutput is the maximum number of lines of git output kept in
+// a gitError.
+const maxErrorOutput = 10
+
+// errorCategory is a common git failure, recognized by any of patterns
+// in the git error output.
+type errorCategory struct {
+	kind     error
+	hint     string
+	patterns []string
+}
+
+// errorCategories are the recognized git failures, in order of precedence.
+var errorCategories = []errorCategory{
+	{
+		kind: ErrHostKey,
+		hint: "add the host key of the git server to known_hosts of the user running Caddy, e.g. with ssh-keyscan",
+		patterns: []string{
+			"Host key verification failed",
+			"REMOTE HOST IDENTIFICATION HAS CHANGED",
+			"No RSA host key is known",
+		},
+	},
+	{
+		kind: ErrAuth,
+		hint: "check the key or credentials are valid and have access to the repository",
+		patterns: []string{
+			"Authentication failed",
+			"Permission denied",
+			"could not read Username",
+			"could not read Password",
+			"terminal prompts disabled",
+			"Invalid username or password",
+			"The requested URL returned error: 401",
+			"The requested URL returned error: 403",
+		},
+	},
+	{
+		kind: ErrRepoNotFound,
+		hint: "check the repository URL; private repositories also report this without valid credentials",
+		patterns: []string{
+			"Repository not found",
+			"does not appear to be a git repository",
+			"The requested URL returned error: 404",
+		},
+	},
+	{
+		kind: ErrBranchNotFound,
+		hint: "check the branch or tag exists on the remote",
+		patterns: []string{
+			"Couldn't find remote ref",
+			"not found in upstream origin",
+			"did not match any file(s) known to git",
+		},
+	},
+	{
+		kind: ErrDiverged,
+		hint: "the remote branch was force-pushed or the checkout has local commits; set allow_force to reset to the remote branch",
+		patterns: []string{
+			"Not possible to fast-forward",
+			"divergent branches",
+			"refusing to merge unrelated histories",
+		},
+	},
+	{
+		kind: ErrMergeConflict,
+		hint: "the checkout has local changes or history that conflict with the remote; commit, stash or discard them in the repository path",
+		patterns: []string{
+			"CONFLICT",
+			"Automatic merge failed",
+			"would be overwritten by merge",
+		},
+	},
+	{
+		kind: ErrNetwork,
+		hint: "check the git server is reachable from this machine and the network or proxy settings",
+		patterns: []string{
+			"Could not resolve host",
+			"Could not resolve hostname",
+			"Connection timed out",
+			"Operation timed out",
+			"Connection refused",
+			"Network is unreachable",
+			"remote end hung up unexpectedly",
+		},
+	},
+}
+
+// gitError is a failed git command with a category and a hint to
+// diagnose common failures, and the output of the command.
+type gitError struct {
+	kind   error // error of the category, e.g. ErrAuth
+	hint   string
+	output string
+	err    error
+}
+
+// newGitError creates a gitError for err with the error output of
+// the command. The category is empty if the failure is not recognized.
+func newGitError(err error, output string) *gitError {
+	e := &gitError{err: err, output: tail(strings.TrimSpace(output), maxErrorOutput)}
+	for _, c := range errorCategories {
+		for _, pattern := range c.patterns {
+			if strings.Contains(output, pattern) {
+				e.kind, e.hint = c.kind, c.hint
+				return e
+			}
+		}
+	}
+	return e
+}
+
+// Error implements the error interface.
+func (e *gitError) Error() string {
+	msg := e.err.Error()
+	if e.kind != nil {
+		msg = fmt.Sprintf("%v: %v", e.kind, msg)
+	}
+	if e.output != "" {
+		msg += "\n" + e.output
+	}
+	if e.hint != "" {
+		msg += "\nHint: " + e.hint
+	}
+	return msg
+}
+
+// Is reports whether target is the error of the category of e, so
+// errors.Is(err, ErrAuth) matches failed authentication.
+func (e *gitError) Is(target error) bool {
+	return e.kind != nil && target == e.kind
+}
+
+// Unwrap returns the error of the git command.
+func (e *gitError) Unwrap() error {
+	return e.err
+}
+
+// isConflict checks if err is a git merge conflict.
+func isConflict(err error) bool {
+	return errors.Is(err, ErrMergeConflict)
+}
+
+// isNetwork checks if err is a git command that failed to reach the
+// remote, which may succeed when retried.
+func isNetwork(err error) bool {
+	return errors.Is(err, ErrNetwork)
+}
+
+// isDiverged checks if err is a pull that cannot be fast-forwarded,
+// e.g. after a force-push of the remote branch.
+func isDiverged(err error) bool {
+	return errors.Is(err, ErrDiverged)
+}
+
+// errorList is the errors of several operations, e.g. the pulls of all
+// repositories with an ID. It matches each of them with errors.Is.
+type errorList []error
+
+// Error implements the error interface.
+func (l errorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the errors of the list.
+func (l errorList) Unwrap() []error {
+	return l
+}
+
+// tail returns the last n lines of s.
+func tail(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
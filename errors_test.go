@@ -0,0 +1,76 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestGitError(t *testing.T) {
+	tests := []struct {
+		output string
+		kind   error
+	}{
+		{"Host key verification failed.\nfatal: Could not read from remote repository.", ErrHostKey},
+		{"git@github.com: Permission denied (publickey).\nfatal: Could not read from remote repository.", ErrAuth},
+		{"fatal: could not read Username for 'https://github.com': terminal prompts disabled", ErrAuth},
+		{"remote: Invalid username or password.\nfatal: Authentication failed for 'https://github.com/user/repo.git/'", ErrAuth},
+		{"remote: Repository not found.\nfatal: repository 'https://github.com/user/repo.git/' not found", ErrRepoNotFound},
+		{"fatal: Couldn't find remote ref develop", ErrBranchNotFound},
+		{"fatal: Remote branch develop not found in upstream origin", ErrBranchNotFound},
+		{"CONFLICT (content): Merge conflict in index.html\nAutomatic merge failed; fix conflicts and then commit the result.", ErrMergeConflict},
+		{"error: Your local changes to the following files would be overwritten by merge:\n\tindex.html", ErrMergeConflict},
+		{"fatal: Not possible to fast-forward, aborting.", ErrDiverged},
+		{"fatal: refusing to merge unrelated histories", ErrDiverged},
+		{"ssh: Could not resolve hostname github.com: Name or service not known", ErrNetwork},
+		{"fatal: unable to access 'https://github.com/user/repo.git/': Could not resolve host: github.com", ErrNetwork},
+		{"ssh: connect to host github.com port 22: Connection timed out", ErrNetwork},
+		{"fatal: something unexpected", nil},
+		{"", nil},
+	}
+
+	for i, test := range tests {
+		err := newGitError(errors.New("exit status 128"), test.output)
+		if err.kind != test.kind {
+			t.Errorf("Test %v: expected kind %v found %v", i, test.kind, err.kind)
+		}
+		if test.kind != nil && !errors.Is(err, test.kind) {
+			t.Errorf("Test %v: expected error to match %v", i, test.kind)
+		}
+		msg := err.Error()
+		if !strings.Contains(msg, "exit status 128") || !strings.Contains(msg, test.output) {
+			t.Errorf("Test %v: expected error and output in %q", i, msg)
+		}
+		if test.kind != nil && !strings.Contains(msg, "Hint: ") {
+			t.Errorf("Test %v: expected hint in %q", i, msg)
+		}
+	}
+
+	output := strings.Repeat("remote: line\n", 20) + "fatal: last"
+	if err := newGitError(errors.New("exit status 1"), output); strings.Count(err.output, "\n") != maxErrorOutput-1 {
+		t.Errorf("Expected output limited to %v lines, found %q", maxErrorOutput, err.output)
+	}
+}
+
+func TestErrorsIs(t *testing.T) {
+	exitErr := errors.New("exit status 128")
+	authErr := newGitError(exitErr, "fatal: Authentication failed for 'https://github.com/user/repo.git/'")
+	netErr := newGitError(exitErr, "ssh: Could not resolve hostname github.com")
+
+	err := mergeErrors(nil, fmt.Errorf("cannot access repo: %w", authErr), netErr)
+	for _, target := range []error{ErrAuth, ErrNetwork, exitErr} {
+		if !errors.Is(err, target) {
+			t.Errorf("Expected %v to match %v", err, target)
+		}
+	}
+	if errors.Is(err, ErrMergeConflict) {
+		t.Errorf("Expected %v not to match %v", err, ErrMergeConflict)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "git authentication failed") || !strings.Contains(msg, "git network failure") {
+		t.Errorf("Expected both errors in %q", msg)
+	}
+	if err := mergeErrors(nil, netErr, nil); err != netErr {
+		t.Errorf("Expected a single error to be returned as is found %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package git
+
+import (
+	"github.com/abiosoft/caddy-git/gitos"
+)
+
+// gcService runs git gc on a repository periodically in the background
+// to remove loose objects left behind by frequent pulls.
+type gcService struct {
+	repo   *Repo
+	ticker gitos.Ticker
+	halt   chan struct{}
+}
+
+// newGCService creates a gcService for repo running every repo.GCInterval.
+func newGCService(repo *Repo) *gcService {
+	return &gcService{repo: repo, halt: make(chan struct{})}
+}
+
+// start starts running git gc in the background.
+func (g *gcService) start() error {
+	g.ticker = gos.NewTicker(g.repo.GCInterval)
+	go func() {
+		for {
+			select {
+			case <-g.ticker.C():
+				if err := g.repo.gc(); err != nil {
+					g.repo.logger().Printf("git gc failed for %v: %v\n", g.repo.URL, err)
+				}
+			case <-g.halt:
+				g.ticker.Stop()
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// stop stops running git gc.
+func (g *gcService) stop() error {
+	close(g.halt)
+	return nil
+}
+
+// gc runs git gc if the repository has been cloned. The repository is
+// locked, so it never runs during a pull.
+func (r *Repo) gc() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if !r.pulled || PullsPaused() {
+		return nil
+	}
+	if err := runCmd(gitBinary, []string{"gc", "--auto", "--quiet"}, r.Path); err != nil {
+		return err
+	}
+	r.logger().Printf("git gc done for %v.\n", r.URL)
+	return nil
+}
@@ -0,0 +1,35 @@
+package git
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestGC(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.GCInterval = time.Second
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	gc := newGCService(repo)
+	check(t, gc.start())
+
+	// no gc before the repository is cloned
+	gittest.Sleep(time.Millisecond * 1500)
+	repo.Lock()
+	repo.pulled = true
+	repo.Unlock()
+	gittest.Sleep(time.Second)
+	check(t, gc.stop())
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if n := strings.Count(string(out), "git gc done"); n != 1 {
+		t.Errorf("Expected 1 git gc found %v: %v", n, string(out))
+	}
+}
@@ -11,7 +11,8 @@ import (
 type GenericHook struct{}
 
 type gPush struct {
-	Ref string `json:"ref"`
+	Ref   string `json:"ref"`
+	After string `json:"after"`
 }
 
 func (g GenericHook) DoesHandle(h http.Header) bool {
@@ -23,11 +24,19 @@ func (g GenericHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo)
 		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
 	}
 
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return http.StatusRequestTimeout, errors.New("could not read body from request")
 	}
 
+	if body, err = hookPayload(r, body); err != nil {
+		return http.StatusBadRequest, err
+	}
+
 	err = g.handlePush(body, repo)
 	if err != nil {
 		return http.StatusBadRequest, err
@@ -52,10 +61,7 @@ func (g GenericHook) handlePush(body []byte, repo *Repo) error {
 	}
 
 	branch := refSlice[2]
-	if branch == repo.Branch {
-		Logger().Print("Received pull notification for the tracking branch, updating...\n")
-		repo.Pull()
-	}
+	repo.hookPush(branch, push.After)
 
 	return nil
 }
@@ -1,11 +1,17 @@
 package git
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/abiosoft/caddy-git/gitos"
@@ -16,8 +22,21 @@ const (
 	// Number of retries if git pull fails
 	numRetries = 3
 
+	// Delay before retrying a failed startup check, doubled for each retry
+	retryBackoff = time.Second
+
+	// Delay before retrying a fetch that failed with a network error
+	fetchRetryDelay = 2 * time.Second
+
 	// variable for latest tag
 	latestTag = "{latest}"
+
+	// filter of partial clones, leaving out all blobs
+	partialFilter = "blob:none"
+
+	// placeholders substituted in the path
+	branchPlaceholder = "{branch}"
+	commitPlaceholder = "{commit}"
 )
 
 // Git represent multiple repositories.
@@ -45,9 +64,165 @@ type Repo struct {
 	lastPull   time.Time     // time of the last successful pull
 	lastCommit string        // hash for the most recent commit
 	sync.Mutex
-	latestTag string     // latest tag name
-	Hook      HookConfig // Webhook configuration
+	latestTag string      // latest tag name
+	Hook      HookConfig  // Webhook configuration
+	errLog    errorLogger // logs pull errors without repetitions
+	log       *log.Logger // logs to LogFile, Logger() if nil
+
+	ID              string         // Identifier of the repository, defaults to URL
+	Refspecs        []string       // Fetch refspecs for the remote, default if empty
+	SocketPath      string         // Unix socket to listen on for pull requests
+	Temp            bool           // Clone into a temporary directory linked at Path
+	linkPath        string         // Path linked to the temporary directory in temp mode, or the release in staging mode
+	Aliases         []string       // Links to the checkout refreshed after each pull
+	Staging         string         // Writable directory to pull into, with releases linked at Path
+	PauseFile       string         // File in Path that pauses pulling while it exists
+	creds           credentials    // Credentials for HTTPS authentication
+	passphrase      string         // Passphrase of KeyPath, never logged
+	PassphraseFile  string         // File holding the passphrase of KeyPath, read on each pull
+	QuietPeriods    []timeWindow   // Daily windows during which interval pulls are deferred
+	NightMultiplier int            // Factor the interval is stretched by in NightWindow
+	NightWindow     timeWindow     // Daily window of the night multiplier
+	Timezone        *time.Location // Timezone of QuietPeriods and NightWindow, local time if nil
+	RawURL          bool           // Pass URL to git verbatim without normalization
+	Stagger         bool           // Delay the first interval pull by a random offset
+	RefFile         string         // File containing the branch or tag to pull
+	AsyncStartup    bool           // Do not block startup on the initial pull
+	SkipIfFresh     time.Duration  // Skip the startup pull if the checkout was updated within it
+	Maintenance     bool           // Serve a maintenance page while updating
+	MaintenancePage string         // Maintenance page file
+	Fallback        bool           // Serve a fallback page while the checkout is unavailable
+	FallbackPage    string         // Fallback page file
+	busy            int32          // Set while cloning or running post pull commands
+	unavailable     int32          // Set while the checkout is empty or the last pull failed
+	CommitBack      string         // Commit message for changes made by post pull commands
+	DeployHook      *DeployHook    // Request sent after each pull that brought new changes
+	ThenOnce        []Then         // Commands to execute once per new commit
+	notifiedCommit  string         // Most recent commit ThenOnce was executed for
+	GCInterval      time.Duration  // Interval between git gc runs
+	SSHAgent        string         // SSH agent socket to authenticate with
+	Mirrors         []string       // Mirror URLs to pull from if URL fails
+	Overlays        []Overlay      // Repositories checked out on top after each pull, in order
+	NoTags          bool           // Do not fetch tags
+	Verify          bool           // Check integrity with git fsck after clone
+	Manifest        string         // Manifest of file hashes in the repository verified after each pull
+	ManifestSig     string         // Signature of Manifest in the repository
+	manifestKey     []byte         // ed25519 public key the signature of Manifest is verified with
+	FileMode        os.FileMode    // Mode set on checked out files
+	DirMode         os.FileMode    // Mode set on checked out directories
+	owner           *fileOwner     // Owner set on checked out files
+	thenUser        *fileOwner     // User and group Then commands run as
+	ServeSubdir     string         // Subdirectory of Path served as site root
+	CloneTimeout    time.Duration  // Timeout of git clone
+	PullTimeout     time.Duration  // Timeout of other remote git commands
+	WatchPath       string         // Path whose change on the remote triggers a pull
+	SkipMessage     string         // Token in the latest commit message that skips a pull
+	IgnorePaths     []string       // Patterns of changed files that do not run Then commands
+	RequireAuth     bool           // Check access to the remote at startup
+	RateLimit       int            // Bandwidth limit of git commands in KB/s
+	FetchRetries    int            // Retries of a fetch that failed with a network error within a pull
+	OnConflict      string         // Resolution of merge conflicts: abort, ours or theirs
+	AllowForce      bool           // Reset to the remote branch if it was force-pushed
+	ThenOnError     string         // Handling of failed Then commands: fail, continue or stop
+	PrePull         []Then         // Commands that must succeed for a pull to proceed, except the initial clone
+	ReposEndpoint   string         // Path to list all configured repos on
+	ShallowSince    string         // Date in YYYY-MM-DD format to clone history since
+	shallow         bool           // true if the checkout has only part of the history
+	Reference       string         // Local repository to borrow objects from when cloning
+	SubmoduleDepth  int            // Levels of submodules checked out after each pull, 0 for none
+	SubmodulePaths  []string       // Paths of the first level submodules to check out, all if empty
+	Partial         bool           // Clone without blobs, fetched when needed
+	ShutdownGrace   time.Duration  // Time to wait at shutdown for a pull in progress
+	StrictHost      bool           // Reject URLs instead of converting between ssh and https
+	HTTPHeaders     []string       // Extra "Name: value" headers of HTTPS requests to the remote
+	FailOpen        bool           // Start even if the initial pull fails
+	DryRun          bool           // Validate the configuration without cloning, pulling or serving
+	LogFile         string         // File to log to instead of the shared log
+	CheckRemote     bool           // Skip pulls if the remote branch is at the local commit
+	ServeGitDir     bool           // Serve the .git directory instead of responding with 404
+	Bundle          bool           // URL is a local bundle file, pulled when it changes
+	bundleTime      time.Time      // Modification time of the last pulled bundle
+	PauseEndpoint   string         // Path prefix of the endpoints to pause and resume pulling
+	pauseToken      string         // Token required by the pause and resume endpoints
+	CommitEndpoint  string         // Path to respond with the checked out commit of a repo on
+	commitToken     string         // Token required by the commit endpoint
+	QueueHooks      bool           // Queue webhooks received while pulling is paused
+	hookQueued      bool           // true if a webhook was queued while pulling is paused
+	thenConcurrency int            // Limit of repos executing Then commands at once, set globally
+	Priority        int            // Order of the startup pull, higher first
+	cloneJobs       int            // Limit of startup pulls at once, set per server block
+	closed          int32          // Set at shutdown to block new pulls
+	watchHash       string         // Last seen object hash of WatchPath
+	hookPending     bool           // true if a delayed webhook pull is scheduled
+	hookRef         string         // Branch of a webhook push to switch to with Hook.FollowRef
+	hookCommit      string         // Commit of a webhook push to verify with Hook.CommitRetries
+	hookPin         string         // Commit a webhook pins the next pull to, e.g. the commit a Travis build passed
+	hookPulls       sync.WaitGroup // Webhook pulls running in background
+	hookMutex       sync.Mutex     // guards hookPending, hookRef, hookCommit, hookPin, hookQueued and hookStats
+	hookStats       hookStats      // Webhook requests by result
+	lastChanged     bool           // true if the last successful pull moved HEAD
+	lastChange      time.Time      // time of the last successful pull that moved HEAD
+	served          string         // Commit served, of the release linked at linkPath in staging mode
+	state           repoState      // Snapshot of the pull state for the endpoints
+	stateMutex      sync.Mutex     // guards state
+}
+
+// PullEvent holds the details of a pull that brought in new changes.
+// It is passed to Then commands.
+type PullEvent struct {
+	OldCommit    string   // commit before the pull, empty if unknown e.g. initial clone
+	NewCommit    string   // commit after the pull
+	ChangedFiles []string // files changed between OldCommit and NewCommit
+	CommitCount  int      // number of commits pulled, -1 if unknown
+	output       io.Writer
+	user         *fileOwner
+}
+
+// stdout returns the writer of the output of Then commands, the
+// log_file of the repository if set.
+func (p *PullEvent) stdout() io.Writer {
+	if p == nil || p.output == nil {
+		return os.Stderr
+	}
+	return p.output
+}
+
+// runAs returns the user Then commands run as, nil for the user
+// running Caddy.
+func (p *PullEvent) runAs() *fileOwner {
+	if p == nil {
+		return nil
+	}
+	return p.user
+}
+
+// Env returns the environment variables passed to Then commands.
+//
+//	CADDY_GIT_OLD_COMMIT    commit before the pull, empty if unknown
+//	CADDY_GIT_NEW_COMMIT    commit after the pull
+//	CADDY_GIT_COMMIT_COUNT  number of commits pulled, unset if unknown
+func (p *PullEvent) Env() []string {
+	if p == nil {
+		return nil
+	}
+	env := []string{
+		"CADDY_GIT_OLD_COMMIT=" + p.OldCommit,
+		"CADDY_GIT_NEW_COMMIT=" + p.NewCommit,
+	}
+	if p.CommitCount >= 0 {
+		env = append(env, "CADDY_GIT_COMMIT_COUNT="+strconv.Itoa(p.CommitCount))
+	}
+	return env
+}
 
+// Input returns the standard input passed to Then commands. It is the
+// list of changed files, one path per line relative to the repository
+// root, as printed by git diff --name-only.
+func (p *PullEvent) Input() []byte {
+	if p == nil || len(p.ChangedFiles) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(p.ChangedFiles, "\n") + "\n")
 }
 
 // Pull attempts a git pull.
@@ -55,35 +230,283 @@ type Repo struct {
 func (r *Repo) Pull() error {
 	r.Lock()
 	defer r.Unlock()
+	defer r.saveState()
+
+	// no new pulls after shutdown
+	if atomic.LoadInt32(&r.closed) == 1 {
+		return nil
+	}
+
+	// no pulls while pulling is paused with PauseAll
+	if PullsPaused() {
+		r.logger().Printf("%v pull skipped, pulling is paused.\n", r.URL)
+		return nil
+	}
 
 	// prevent a pull if the last one was less than 5 seconds ago
 	if gos.TimeSince(r.lastPull) < 5*time.Second {
 		return nil
 	}
 
+	// skip the pull while the pause file exists
+	if r.paused() {
+		r.logger().Printf("%v pull skipped, %v exists.\n", r.URL, r.PauseFile)
+		return nil
+	}
+
+	// skip the pull until the pre pull commands succeed; they run in
+	// the checkout, so not before the initial clone. Prepare marks an
+	// existing checkout as pulled, so they gate its first pull too.
+	if r.pulled && len(r.PrePull) > 0 {
+		if err := r.execCommands(r.PrePull, nil, false); err != nil {
+			r.logger().Printf("%v pull skipped, pre_pull failed: %v\n", r.URL, err)
+			return nil
+		}
+	}
+
+	// switch to the ref in the ref file if changed
+	if err := r.readRefFile(); err != nil {
+		return err
+	}
+
+	// switch to the branch of a webhook push with Hook.FollowRef
+	if ref := r.takeHookRef(); ref != "" {
+		if err := r.switchRef(ref); err != nil {
+			return err
+		}
+	}
+
+	// pull from a bundle only if it changed since the last pull
+	var bundleTime time.Time
+	if r.Bundle {
+		info, err := gos.Stat(r.URL)
+		if err != nil {
+			return fmt.Errorf("cannot access bundle %v: %v", r.URL, err)
+		}
+		if r.pulled && info.ModTime().Equal(r.bundleTime) {
+			r.logger().Printf("%v unchanged, pull skipped.\n", r.URL)
+			r.lastPull = time.Now()
+			r.lastChanged = false
+			return nil
+		}
+		bundleTime = info.ModTime()
+	}
+
+	// skip the fetch if the remote branch did not move
+	if r.pulled && r.CheckRemote && !r.Bundle && r.Branch != latestTag && r.upToDate() {
+		r.logger().Printf("%v is up to date, pull skipped.\n", r.URL)
+		r.lastPull = time.Now()
+		r.lastChanged = false
+		return nil
+	}
+
 	// keep last commit hash for comparison later
 	lastCommit := r.lastCommit
+	start := time.Now()
+
+	// the site is incomplete during the initial clone
+	if !r.pulled {
+		r.setUpdating(true)
+		defer r.setUpdating(false)
+	}
+
+	// the overlays are checked out again after the pull
+	if err := r.resetOverlays(); err != nil {
+		return err
+	}
 
+	// the commit checked out before the pull, which a checkout that
+	// fails verification is reset to; r.lastCommit is not set yet on
+	// the first pull of an existing checkout, e.g. after a restart
+	var verified string
+	if r.Manifest != "" && r.pulled {
+		verified, _ = runCmdOutput(gitBinary, []string{"rev-parse", "HEAD"}, r.Path)
+	}
+
+	// errors are logged once per pull by the callers, see errLog
 	var err error
 	// Attempt to pull at most numRetries times
 	for i := 0; i < numRetries; i++ {
 		if err = r.pull(); err == nil {
 			break
 		}
-		Logger().Println(err)
 	}
 
+	// a webhook may deploy the commit its build passed instead of
+	// the latest commit of the branch
+	if err == nil {
+		if commit := r.takeHookPin(); commit != "" {
+			err = r.checkoutCommit(commit)
+		}
+	}
+
+	// the submodules are checked out at the commits of the pull
+	if err == nil {
+		err = r.updateSubmodules()
+	}
+
+	// the pulled files must match the signed manifest
+	if err == nil {
+		err = r.verifyManifest(verified)
+	}
+
+	if err != nil {
+		r.setAvailable(false)
+		// keep serving the overlays of the last pull
+		_, _, e := r.applyOverlays(false)
+		return mergeErrors(err, e)
+	}
+	overlayFiles, overlaysChanged, err := r.applyOverlays(true)
 	if err != nil {
+		r.setAvailable(false)
 		return err
 	}
+	r.setAvailable(true)
+	r.errLog.reset()
+	r.refreshAliases()
+	r.bundleTime = bundleTime
+	r.lastChanged = r.lastCommit != lastCommit || overlaysChanged
+	if r.lastChanged {
+		r.lastChange = time.Now()
+	}
 
 	// check if there are new changes,
 	// then execute post pull command
-	if r.lastCommit == lastCommit {
-		Logger().Println("No new changes.")
+	if !r.lastChanged {
+		r.logger().Println("No new changes.")
+		// e.g. the link was removed since it was published
+		if r.Staging != "" && !r.published() {
+			return r.publish()
+		}
+		return nil
+	}
+
+	files, err := r.changedFiles(lastCommit)
+	if err != nil {
+		return err
+	}
+	files = mergeFiles(files, overlayFiles)
+	count, err := r.commitCount(lastCommit)
+	if err != nil {
+		r.logger().Printf("Could not count pulled commits: %v\n", err)
+		count = -1
+	}
+
+	event := &PullEvent{
+		OldCommit:    lastCommit,
+		NewCommit:    r.lastCommit,
+		ChangedFiles: files,
+		CommitCount:  count,
+	}
+	if r.log != nil {
+		event.output = r.log.Writer()
+	}
+	event.user = r.thenUser
+	err = r.deploy(event)
+	// the release is only published once the commands succeeded
+	if err == nil && r.Staging != "" {
+		err = r.publish()
+	}
+	r.notifyDeploy(event, start, err)
+	return err
+}
+
+// deploy applies the changes of a pull with event, i.e. sets the
+// permissions, runs the post pull commands and commits back.
+func (r *Repo) deploy(event *PullEvent) error {
+	r.setUpdating(true)
+	defer r.setUpdating(false)
+
+	// new files get the default permissions of git
+	r.applyPerms()
+
+	// changes only to ignored paths do not run the commands
+	if r.onlyIgnored(event.ChangedFiles) {
+		r.logger().Printf("Only ignored paths changed in %v, commands skipped.\n", r.URL)
+		return nil
+	}
+
+	// wait for commands of other repos, see SetThenConcurrency
+	release := thenSlots.acquire()
+	err := r.execThen(event)
+	stop := err != nil && r.ThenOnError == "stop"
+
+	// run once per commit, even if the commit is pulled again
+	if r.lastCommit != r.notifiedCommit && !stop {
+		r.notifiedCommit = r.lastCommit
+		err = mergeErrors(err, r.execCommands(r.ThenOnce, event, r.ThenOnError == "stop"))
+	}
+	release()
+
+	// failed commands do not fail the pull with continue
+	if err != nil && r.ThenOnError == "continue" {
+		r.logger().Printf("Commands failed for %v, pull done: %v\n", r.URL, err)
+		err = nil
+	}
+	if err != nil || r.CommitBack == "" {
+		return err
+	}
+	return r.commitBack()
+}
+
+// shutdown blocks new pulls and waits up to r.ShutdownGrace for a pull
+// in progress to finish, so the checkout is not left half updated.
+func (r *Repo) shutdown() error {
+	atomic.StoreInt32(&r.closed, 1)
+
+	done := make(chan struct{})
+	go func() {
+		r.Lock()
+		close(done)
+		r.Unlock()
+	}()
+	select {
+	case <-done:
 		return nil
+	case <-time.After(r.ShutdownGrace):
+		return fmt.Errorf("%v pull still in progress after %v at shutdown", r.URL, r.ShutdownGrace)
 	}
-	return r.execThen()
+}
+
+// commitBack commits the changes made by the post pull commands and
+// pushes them to the branch. The most recent commit is updated to the
+// new commit, so the pull triggered by the push, e.g. by a webhook,
+// brings no new changes and does not run the commands again.
+func (r *Repo) commitBack() error {
+	status, err := runCmdOutput(gitBinary, []string{"status", "--porcelain"}, r.Path)
+	if err != nil {
+		return err
+	}
+	if status == "" {
+		r.logger().Println("No changes to commit back.")
+		return nil
+	}
+
+	if err = runCmd(gitBinary, []string{"add", "--all"}, r.Path); err != nil {
+		return err
+	}
+	if err = runCmd(gitBinary, []string{"commit", "-m", r.CommitBack}, r.Path); err != nil {
+		return err
+	}
+	if r.lastCommit, err = r.mostRecentCommit(); err != nil {
+		return err
+	}
+
+	params := []string{"push", "origin", "HEAD:" + r.Branch}
+	if err = r.gitCmd(params, r.Path); err != nil {
+		return err
+	}
+	r.logger().Printf("Committed back changes to %v at %v.\n", r.Branch, r.lastCommit)
+	return nil
+}
+
+// paused checks if pulling is paused by the presence of r.PauseFile.
+func (r *Repo) paused() bool {
+	if r.PauseFile == "" || !r.pulled {
+		return false
+	}
+	_, err := gos.Stat(filepath.Join(r.Path, r.PauseFile))
+	return err == nil
 }
 
 // pull performs git pull, or git clone if repository does not exist.
@@ -99,31 +522,354 @@ func (r *Repo) pull() error {
 		return r.checkoutLatestTag()
 	}
 
-	params := []string{"pull", "origin", r.Branch}
+	// pull only if the watched path changed on the remote
+	var watchHash string
+	if r.WatchPath != "" {
+		hash, err := r.remoteWatchHash()
+		if err != nil {
+			r.logger().Printf("Cannot check %v of %v, pulling: %v\n", r.WatchPath, r.URL, err)
+		} else if hash == r.watchHash {
+			r.logger().Printf("%v unchanged in %v, pull skipped.\n", r.WatchPath, r.URL)
+			r.lastPull = time.Now()
+			return nil
+		}
+		watchHash = hash
+	}
+
+	// leave the checkout as is if the latest commit asks to be skipped
+	if r.SkipMessage != "" {
+		skip, err := r.skipCommit()
+		if err != nil {
+			r.logger().Printf("Cannot check commit message of %v, pulling: %v\n", r.URL, err)
+		} else if skip {
+			r.logger().Printf("%v pull skipped, latest commit contains %v.\n", r.URL, r.SkipMessage)
+			r.lastPull = time.Now()
+			return nil
+		}
+	}
+
+	// fetch the configured refspecs before pulling the branch
+	if len(r.Refspecs) > 0 {
+		if err := r.fetchCmd(r.tagArgs("fetch", "origin")); err != nil {
+			return err
+		}
+	}
+
+	// a tag or commit is checked out without merging, as there
+	// is no branch to merge into
+	detached := r.detached()
+
+	// fail over to the mirrors if origin cannot be pulled
 	var err error
-	if err = r.gitCmd(params, r.Path); err == nil {
-		r.pulled = true
-		r.lastPull = time.Now()
-		Logger().Printf("%v pulled.\n", r.URL)
-		r.lastCommit, err = r.mostRecentCommit()
+	for i, remote := range r.remotes() {
+		params := r.tagArgs("pull", remote, r.Branch)
+		if r.OnConflict == "ours" || r.OnConflict == "theirs" {
+			params = r.tagArgs("pull", "-X", r.OnConflict, remote, r.Branch)
+		}
+		if r.AllowForce {
+			// a force-push fails instead of merging the old and new history
+			params = r.tagArgs("pull", "--ff-only", remote, r.Branch)
+		}
+		if detached {
+			params = r.tagArgs("fetch", remote, r.Branch)
+		}
+		err = r.fetchCmd(params)
+		if err == nil && detached {
+			err = runCmd(gitBinary, []string{"checkout", "--detach", "FETCH_HEAD"}, r.Path)
+		}
+		if isDiverged(err) {
+			// a force-push is not resolved by pulling from a mirror
+			if err = r.resolveDiverged(err); err != nil {
+				return err
+			}
+		} else if isConflict(err) {
+			// a conflict is not resolved by pulling from a mirror
+			if err = r.resolveConflict(err); err != nil {
+				return err
+			}
+		}
+		if err == nil {
+			r.pulled = true
+			r.lastPull = time.Now()
+			r.watchHash = watchHash
+			if i == 0 {
+				r.logger().Printf("%v pulled.\n", r.URL)
+			} else {
+				r.logger().Printf("%v pulled from %v %v.\n", r.URL, remote, r.Mirrors[i-1])
+			}
+			r.lastCommit, err = r.mostRecentCommit()
+			return err
+		}
+		if i < len(r.Mirrors) {
+			r.logger().Printf("Pull from %v failed, trying next mirror: %v\n", remote, err)
+		}
 	}
 	return err
 }
 
+// fetchCmd runs the git command with params that fetches from a remote
+// in the checkout, e.g. git pull. A network failure is retried
+// r.FetchRetries times, waiting fetchRetryDelay before each retry, so a
+// brief network hiccup does not fail the pull. A failed fetch leaves the
+// checkout as it was, so the whole command is run again.
+func (r *Repo) fetchCmd(params []string) error {
+	for i := 0; ; i++ {
+		err := r.gitCmd(params, r.Path)
+		if err == nil || i >= r.FetchRetries || !isNetwork(err) {
+			return err
+		}
+		r.logger().Printf("Fetch from %v failed, retry %v of %v in %v: %v\n", r.URL, i+1, r.FetchRetries, fetchRetryDelay, err)
+		gos.Sleep(fetchRetryDelay)
+	}
+}
+
+// resolveConflict handles a merge conflict of a pull with
+// r.OnConflict. The merge is aborted, leaving the checkout as it
+// was before the pull, and with theirs the checkout is then reset to the
+// fetched branch, discarding the local changes.
+func (r *Repo) resolveConflict(err error) error {
+	// there is no merge to abort if local changes prevented it
+	runCmdOutput(gitBinary, []string{"merge", "--abort"}, r.Path)
+	if r.OnConflict != "theirs" {
+		return err
+	}
+	if e := runCmd(gitBinary, []string{"reset", "--hard", "FETCH_HEAD"}, r.Path); e != nil {
+		return mergeErrors(err, e)
+	}
+	r.logger().Printf("Merge conflict in %v resolved by discarding local changes.\n", r.URL)
+	return nil
+}
+
+// resolveDiverged handles a pull that cannot be fast-forwarded, e.g.
+// after the remote branch was force-pushed. With r.AllowForce the
+// checkout is reset to the fetched branch, discarding the local commits;
+// otherwise it is left as it was and handled like a conflict.
+func (r *Repo) resolveDiverged(err error) error {
+	if !r.AllowForce {
+		r.logger().Printf("%v cannot be fast-forwarded, the branch was force-pushed or has local commits; set allow_force to reset to it.\n", r.URL)
+		return r.resolveConflict(err)
+	}
+	if e := runCmd(gitBinary, []string{"reset", "--hard", "FETCH_HEAD"}, r.Path); e != nil {
+		return mergeErrors(err, e)
+	}
+	r.logger().Printf("%v was force-pushed, reset to the remote branch discarding local commits.\n", r.URL)
+	return nil
+}
+
+// detached checks if HEAD is detached, i.e. a tag or commit rather
+// than a branch is checked out.
+func (r *Repo) detached() bool {
+	_, err := runCmdOutput(gitBinary, []string{"symbolic-ref", "-q", "HEAD"}, r.Path)
+	return err != nil
+}
+
+// skipCommit fetches the branch from origin and checks if the message of
+// its latest commit contains r.SkipMessage. The commit is not skipped if
+// it is already checked out.
+func (r *Repo) skipCommit() (bool, error) {
+	if err := r.gitCmd(r.tagArgs("fetch", "origin", r.Branch), r.Path); err != nil {
+		return false, err
+	}
+	output, err := runCmdOutput(gitBinary, []string{"log", "-1", "--format=%H%n%B", "FETCH_HEAD"}, r.Path)
+	if err != nil {
+		return false, err
+	}
+	lines := strings.SplitN(output, "\n", 2)
+	if lines[0] == r.lastCommit || len(lines) < 2 {
+		return false, nil
+	}
+	return strings.Contains(lines[1], r.SkipMessage), nil
+}
+
+// remoteWatchHash fetches the branch from origin and returns the object
+// hash of r.WatchPath in it, as listed by git ls-tree. The hash is empty
+// if the path does not exist on the branch.
+func (r *Repo) remoteWatchHash() (string, error) {
+	if err := r.gitCmd(r.tagArgs("fetch", "origin", r.Branch), r.Path); err != nil {
+		return "", err
+	}
+	output, err := runCmdOutput(gitBinary, []string{"ls-tree", "FETCH_HEAD", "--", r.WatchPath}, r.Path)
+	if err != nil {
+		return "", err
+	}
+	// entries are listed as "<mode> <type> <hash>	<path>"
+	if fields := strings.Fields(output); len(fields) >= 3 {
+		return fields[2], nil
+	}
+	return "", nil
+}
+
+// verify checks the integrity of the repository with git fsck.
+func (r *Repo) verify() error {
+	params := []string{"fsck", "--full", "--no-progress"}
+	if err := runGitCmd(os.Stderr, gitBinary, params, r.Path, nil, 0); err != nil {
+		return fmt.Errorf("integrity check of %v failed: %v", r.Path, err)
+	}
+	r.logger().Printf("Integrity check of %v passed.\n", r.URL)
+	return nil
+}
+
+// tagArgs returns the git command with args, with --no-tags added
+// after the command if r.NoTags is set.
+func (r *Repo) tagArgs(command string, args ...string) []string {
+	params := []string{command}
+	if r.NoTags {
+		params = append(params, "--no-tags")
+	}
+	return append(params, args...)
+}
+
+// remotes returns the names of the remotes to pull from in order,
+// origin followed by the mirrors.
+func (r *Repo) remotes() []string {
+	remotes := []string{"origin"}
+	for i := range r.Mirrors {
+		remotes = append(remotes, fmt.Sprintf("mirror%v", i+1))
+	}
+	return remotes
+}
+
+// setMirrors configures r.Mirrors as the remotes mirror1, mirror2...
+func (r *Repo) setMirrors() error {
+	for i, remote := range r.remotes()[1:] {
+		params := []string{"config", "remote." + remote + ".url", r.Mirrors[i]}
+		if err := runCmd(gitBinary, params, r.Path); err != nil {
+			return err
+		}
+		refspec := "+refs/heads/*:refs/remotes/" + remote + "/*"
+		params = []string{"config", "remote." + remote + ".fetch", refspec}
+		if err := runCmd(gitBinary, params, r.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setHTTPHeaders configures r.HTTPHeaders as http.extraHeader of the
+// checkout, replacing the headers configured before.
+func (r *Repo) setHTTPHeaders() error {
+	if len(r.HTTPHeaders) == 0 {
+		return nil
+	}
+	// fails if no header is configured yet
+	runCmd(gitBinary, []string{"config", "--unset-all", "http.extraHeader"}, r.Path)
+	for _, header := range r.HTTPHeaders {
+		params := []string{"config", "--add", "http.extraHeader", header}
+		if err := runCmd(gitBinary, params, r.Path); err != nil {
+			return err
+		}
+		r.logger().Printf("Set HTTP header %v for %v.\n", redactHeader(header), r.URL)
+	}
+	return nil
+}
+
+// setPartial configures origin as the promisor remote of an existing
+// checkout, so later fetches leave out blobs as with a partial clone.
+func (r *Repo) setPartial() error {
+	if !r.Partial {
+		return nil
+	}
+	configs := [][]string{
+		{"config", "remote.origin.promisor", "true"},
+		{"config", "remote.origin.partialclonefilter", partialFilter},
+	}
+	for _, params := range configs {
+		if err := runCmd(gitBinary, params, r.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setFileMode makes git ignore the executable bit of the files in the
+// checkout if r.FileMode is set, as git tracks it and the changed modes
+// would otherwise be local changes that abort pulls of those files.
+func (r *Repo) setFileMode() error {
+	if r.FileMode == 0 {
+		return nil
+	}
+	return runCmd(gitBinary, []string{"config", "core.fileMode", "false"}, r.Path)
+}
+
+// withHeaders returns params with r.HTTPHeaders passed as config to
+// git, for commands that do not run in the checkout e.g. git ls-remote.
+func (r *Repo) withHeaders(params []string) []string {
+	var args []string
+	for _, header := range r.HTTPHeaders {
+		args = append(args, "-c", "http.extraHeader="+header)
+	}
+	return append(args, params...)
+}
+
 // clone performs git clone.
 func (r *Repo) clone() error {
-	params := []string{"clone", "-b", r.Branch, r.URL, r.Path}
+	// the headers are kept in the config of the clone for later pulls
+	var headers []string
+	for _, header := range r.HTTPHeaders {
+		headers = append(headers, "--config", "http.extraHeader="+header)
+	}
+
+	// blobs are fetched from origin, the promisor remote, when needed
+	if r.Partial {
+		headers = append(headers, "--filter="+partialFilter)
+	}
+
+	// objects in the reference repository are borrowed, not downloaded
+	if r.Reference != "" {
+		r.updateReference()
+		headers = append(headers, "--reference", r.Reference)
+	}
+
+	args := append(headers, "-b", r.Branch, r.URL, r.Path)
+	if r.ShallowSince != "" {
+		args = append([]string{"--shallow-since=" + r.ShallowSince}, args...)
+	}
+	params := r.tagArgs("clone", args...)
 
 	tagMode := r.Branch == latestTag
 	if tagMode {
-		params = []string{"clone", r.URL, r.Path}
+		params = append(append([]string{"clone"}, headers...), r.URL, r.Path)
 	}
 
-	var err error
-	if err = r.gitCmd(params, ""); err == nil {
+	// fail over to the mirrors if origin cannot be cloned
+	err := r.gitCmd(params, "")
+	for i := 0; err != nil && i < len(r.Mirrors); i++ {
+		r.logger().Printf("Clone of %v failed, trying mirror %v: %v\n", r.URL, r.Mirrors[i], err)
+		params[len(params)-2] = r.Mirrors[i]
+		if err = r.gitCmd(params, ""); err == nil {
+			// origin is always the primary remote
+			params := []string{"remote", "set-url", "origin", r.URL}
+			err = runCmd(gitBinary, params, r.Path)
+		}
+	}
+
+	// a corrupt clone is not pulled into
+	if err == nil && r.Verify {
+		err = r.verify()
+	}
+
+	// the served subdirectory must be in the repository
+	if err == nil && r.ServeSubdir != "" {
+		dir := filepath.Join(r.Path, r.ServeSubdir)
+		if info, e := gos.Stat(dir); e != nil || !info.IsDir() {
+			err = fmt.Errorf("serve_subdir %v is not a directory in %v", r.ServeSubdir, r.URL)
+		}
+	}
+
+	if err == nil {
 		r.pulled = true
 		r.lastPull = time.Now()
-		Logger().Printf("%v pulled.\n", r.URL)
+		r.shallow = r.ShallowSince != ""
+		r.logger().Printf("%v pulled.\n", r.URL)
+		if err = r.setMirrors(); err != nil {
+			return err
+		}
+		if err = r.setFileMode(); err != nil {
+			return err
+		}
+		if err = r.setRefspecs(); err != nil {
+			return err
+		}
 		r.lastCommit, err = r.mostRecentCommit()
 
 		// if latest tag config is set.
@@ -139,14 +885,14 @@ func (r *Repo) clone() error {
 func (r *Repo) checkoutLatestTag() error {
 	tag, err := r.fetchLatestTag()
 	if err != nil {
-		Logger().Println("Error retrieving latest tag.")
+		r.logger().Println("Error retrieving latest tag.")
 		return err
 	}
 	if tag == "" {
-		Logger().Println("No tags found for Repo: ", r.URL)
+		r.logger().Println("No tags found for Repo: ", r.URL)
 		return fmt.Errorf("No tags found for Repo: %v.", r.URL)
 	} else if tag == r.latestTag {
-		Logger().Println("No new tags.")
+		r.logger().Println("No new tags.")
 		return nil
 	}
 
@@ -154,33 +900,137 @@ func (r *Repo) checkoutLatestTag() error {
 	if err = r.gitCmd(params, r.Path); err == nil {
 		r.latestTag = tag
 		r.lastCommit, err = r.mostRecentCommit()
-		Logger().Printf("Tag %v checkout done.\n", tag)
+		r.logger().Printf("Tag %v checkout done.\n", tag)
 	}
 	return err
 }
 
+// readRefFile updates r.Branch with the branch or tag in r.RefFile.
+// If the ref changed after the repository was cloned, the new ref is
+// fetched and checked out.
+func (r *Repo) readRefFile() error {
+	if r.RefFile == "" {
+		return nil
+	}
+
+	content, err := gos.ReadFile(r.RefFile)
+	if err != nil {
+		return fmt.Errorf("cannot read ref file %v: %v", r.RefFile, err)
+	}
+	ref := strings.TrimSpace(string(content))
+	if ref == "" || strings.HasPrefix(ref, "-") || strings.ContainsAny(ref, " \t\n") {
+		return fmt.Errorf("invalid ref '%v' in ref file %v", ref, r.RefFile)
+	}
+	return r.switchRef(ref)
+}
+
+// switchRef updates r.Branch with the branch or tag ref. If the ref
+// changed after the repository was cloned, the new ref is fetched and
+// checked out.
+func (r *Repo) switchRef(ref string) error {
+	if ref == r.Branch {
+		return nil
+	}
+
+	if r.pulled {
+		r.logger().Printf("Ref changed from %v to %v for %v.\n", r.Branch, ref, r.URL)
+		if ref != latestTag {
+			params := []string{"fetch", "origin", "--tags"}
+			if r.NoTags {
+				params = []string{"fetch", "--no-tags", "origin", ref}
+			}
+			if err := r.gitCmd(params, r.Path); err != nil {
+				return err
+			}
+			params = []string{"checkout", ref}
+			if err := r.gitCmd(params, r.Path); err != nil {
+				return err
+			}
+		}
+		// the latest tag is checked out again for the new ref
+		r.latestTag = ""
+	}
+	r.Branch = ref
+	return nil
+}
+
+// setRefspecs sets r.Refspecs as the fetch refspecs of the origin remote.
+func (r *Repo) setRefspecs() error {
+	for i, refspec := range r.Refspecs {
+		params := []string{"config", "--add", "remote.origin.fetch", refspec}
+		if i == 0 {
+			params = []string{"config", "--replace-all", "remote.origin.fetch", refspec}
+		}
+		if err := runCmd(gitBinary, params, r.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // checkoutCommit checks out the specified commitHash.
 func (r *Repo) checkoutCommit(commitHash string) error {
 	var err error
 	params := []string{"checkout", commitHash}
 	if err = r.gitCmd(params, r.Path); err == nil {
-		Logger().Printf("Commit %v checkout done.\n", commitHash)
+		r.logger().Printf("Commit %v checkout done.\n", commitHash)
+		r.lastCommit, err = r.mostRecentCommit()
 	}
 	return err
 }
 
 // gitCmd performs a git command.
 func (r *Repo) gitCmd(params []string, dir string) error {
+	return r.gitCmdTo(os.Stderr, params, dir)
+}
+
+// gitCmdOutput performs a git command and returns its output.
+func (r *Repo) gitCmdOutput(params []string, dir string) (string, error) {
+	var output bytes.Buffer
+	err := r.gitCmdTo(&output, params, dir)
+	return strings.TrimSpace(output.String()), err
+}
+
+// gitCmdTo performs a git command with its output written to stdout.
+func (r *Repo) gitCmdTo(stdout io.Writer, params []string, dir string) error {
 	// if key is specified, use ssh key
 	if r.KeyPath != "" {
-		return r.gitCmdWithKey(params, dir)
+		return r.gitCmdWithKey(stdout, params, dir)
 	}
-	return runCmd(gitBinary, params, dir)
+	// if an ssh agent is specified, use the agent
+	if r.SSHAgent != "" {
+		return r.gitCmdWithAgent(stdout, params, dir)
+	}
+	// if credentials are specified, use credential helper
+	if r.creds != nil {
+		return r.gitCmdWithCredentials(stdout, params, dir)
+	}
+	command, args := r.rateLimited(gitBinary, params)
+	return runGitCmd(stdout, command, args, dir, nil, r.timeout(params))
+}
+
+// rateLimited returns command and args run under trickle if
+// r.RateLimit is set, to limit their bandwidth.
+func (r *Repo) rateLimited(command string, args []string) (string, []string) {
+	if r.RateLimit == 0 {
+		return command, args
+	}
+	rate := strconv.Itoa(r.RateLimit)
+	return trickleBinary, append([]string{"-s", "-d", rate, "-u", rate, command}, args...)
+}
+
+// timeout returns the timeout of the git command with params,
+// r.CloneTimeout for clones and r.PullTimeout otherwise.
+func (r *Repo) timeout(params []string) time.Duration {
+	if len(params) > 0 && params[0] == "clone" {
+		return r.CloneTimeout
+	}
+	return r.PullTimeout
 }
 
 // gitCmdWithKey is used for private repositories and requires an ssh key.
 // Note: currently only limited to Linux and OSX.
-func (r *Repo) gitCmdWithKey(params []string, dir string) error {
+func (r *Repo) gitCmdWithKey(stdout io.Writer, params []string, dir string) error {
 	var gitSSH, script gitos.File
 	// ensure temporary files deleted after usage
 	defer func() {
@@ -205,16 +1055,305 @@ func (r *Repo) gitCmdWithKey(params []string, dir string) error {
 		return err
 	}
 
-	return runCmd(script.Name(), nil, dir)
+	// an encrypted key is unlocked by ssh with the askpass script, which
+	// prints the passphrase passed in the environment
+	var env []string
+	if r.passphrase != "" || r.PassphraseFile != "" {
+		passphrase, err := r.keyPassphrase()
+		if err != nil {
+			return err
+		}
+		askpass, err := writeScriptFile(askpassScript())
+		if err != nil {
+			return err
+		}
+		defer gos.Remove(askpass.Name())
+		env = []string{
+			"SSH_ASKPASS=" + askpass.Name(),
+			"SSH_ASKPASS_REQUIRE=force",
+			"DISPLAY=:0",
+			passphraseEnv + "=" + passphrase,
+		}
+	}
+
+	command, args := r.rateLimited(script.Name(), nil)
+	return runGitCmd(stdout, command, args, dir, env, r.timeout(params))
+}
+
+// keyPassphrase returns the passphrase of the private key. If
+// PassphraseFile is set, the passphrase is read from the file on each
+// call so a rotated passphrase is used without a restart.
+func (r *Repo) keyPassphrase() (string, error) {
+	if r.PassphraseFile == "" {
+		return r.passphrase, nil
+	}
+	content, err := gos.ReadFile(r.PassphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read key passphrase file %v: %v", r.PassphraseFile, err)
+	}
+	passphrase := strings.TrimRight(string(content), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("key passphrase file %v is empty", r.PassphraseFile)
+	}
+	return passphrase, nil
+}
+
+// gitCmdWithAgent is used for private repositories whose key is held
+// by the ssh agent listening on r.SSHAgent.
+func (r *Repo) gitCmdWithAgent(stdout io.Writer, params []string, dir string) error {
+	env := []string{
+		"SSH_AUTH_SOCK=" + r.SSHAgent,
+		"GIT_SSH_COMMAND=ssh -o BatchMode=yes",
+	}
+	command, args := r.rateLimited(gitBinary, params)
+	return runGitCmd(stdout, command, args, dir, env, r.timeout(params))
+}
+
+// expandPath substitutes the {branch} and {commit} placeholders in
+// r.Path with the branch and the abbreviated commit at the head of the
+// branch on the remote. The branch is detected first if not configured.
+func (r *Repo) expandPath() error {
+	hasBranch := strings.Contains(r.Path, branchPlaceholder)
+	hasCommit := strings.Contains(r.Path, commitPlaceholder)
+	if !hasBranch && !hasCommit {
+		return nil
+	}
+	if r.Branch == latestTag {
+		return fmt.Errorf("path placeholders cannot be used with %v", latestTag)
+	}
+	if r.Branch == "" {
+		r.Branch = r.defaultBranch()
+	}
+
+	path := r.Path
+	if hasBranch {
+		branch, err := pathElement(r.Branch)
+		if err != nil {
+			return err
+		}
+		path = strings.Replace(path, branchPlaceholder, branch, -1)
+	}
+	if hasCommit {
+		commit, err := r.remoteCommit()
+		if err != nil || len(commit) < 7 {
+			return fmt.Errorf("cannot resolve %v of %v for path %v: %v", commitPlaceholder, r.Branch, r.Path, err)
+		}
+		path = strings.Replace(path, commitPlaceholder, commit[:7], -1)
+	}
+	r.Path = filepath.Clean(path)
+	return nil
+}
+
+// remoteCommit returns the commit of the branch on the remote, as listed
+// by git ls-remote. It is empty if the branch is not found.
+func (r *Repo) remoteCommit() (string, error) {
+	params := []string{"ls-remote", r.URL, "refs/heads/" + r.Branch}
+	output, err := r.gitCmdOutput(r.withHeaders(params), "")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
+// upToDate checks with r.remoteCommit if the branch on the remote is at
+// the commit checked out, so the pull can be skipped without fetching.
+// If the check fails, the repository is not considered up to date.
+func (r *Repo) upToDate() bool {
+	commit, err := r.remoteCommit()
+	if err != nil {
+		r.logger().Printf("Could not check remote of %v, pulling: %v\n", r.URL, err)
+		return false
+	}
+	return commit != "" && commit == r.lastCommit
+}
+
+// pathElement converts value substituted in the path to a single path
+// element, so it cannot traverse directories. Slashes of branch names
+// like feature/name are replaced with dashes.
+func pathElement(value string) (string, error) {
+	element := strings.Replace(value, "/", "-", -1)
+	element = strings.Replace(element, string(filepath.Separator), "-", -1)
+	if element == "" || element == "." || element == ".." {
+		return "", fmt.Errorf("invalid path element %q", value)
+	}
+	return element, nil
+}
+
+// hasShallowFile checks if the checkout is shallow by the presence of
+// the .git/shallow file git keeps the shallow commits in.
+func (r *Repo) hasShallowFile() bool {
+	_, err := gos.Stat(filepath.Join(r.Path, ".git", "shallow"))
+	return err == nil
+}
+
+// fresh checks if the existing checkout was cloned or fetched within
+// r.SkipIfFresh, by the modification time of its HEAD and FETCH_HEAD,
+// which git writes at clone and at each fetch or pull. A fresh checkout
+// is taken as the last pull, so the next pull runs the commands only if
+// it brings in new commits.
+func (r *Repo) fresh() bool {
+	r.Lock()
+	defer r.Unlock()
+	defer r.saveState()
+
+	if r.SkipIfFresh <= 0 || !r.pulled || (r.Staging != "" && !r.published()) {
+		return false
+	}
+	var updated time.Time
+	for _, name := range []string{"HEAD", "FETCH_HEAD"} {
+		if info, err := gos.Stat(filepath.Join(r.Path, ".git", name)); err == nil && info.ModTime().After(updated) {
+			updated = info.ModTime()
+		}
+	}
+	if updated.IsZero() || gos.TimeSince(updated) > r.SkipIfFresh {
+		return false
+	}
+	commit, err := r.mostRecentCommit()
+	if err != nil {
+		return false
+	}
+	r.lastCommit = commit
+	r.notifiedCommit = commit
+	r.lastPull = updated
+	r.refreshAliases()
+	r.logger().Printf("%v was updated %v ago, startup pull skipped.\n", r.URL, gos.TimeSince(updated).Round(time.Second))
+	return true
+}
+
+// Shallow checks if the checkout has only part of the history, e.g. if
+// it was cloned with ShallowSince.
+func (r *Repo) Shallow() bool {
+	r.Lock()
+	defer r.Unlock()
+	return r.shallow
+}
+
+// Deepen fetches more history of a shallow checkout without cloning it
+// again: the given number of commits more, or all of it if commits is 0.
+// It waits for a pull in progress and does nothing if the checkout is
+// not shallow.
+func (r *Repo) Deepen(commits int) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if commits < 0 {
+		return fmt.Errorf("invalid number of commits %v to deepen", commits)
+	}
+	if !r.pulled || !r.shallow {
+		return nil
+	}
+	params := []string{"fetch", "--unshallow", "origin"}
+	if commits > 0 {
+		params = []string{"fetch", "--deepen=" + strconv.Itoa(commits), "origin"}
+	}
+	if err := r.gitCmd(params, r.Path); err != nil {
+		return err
+	}
+	r.shallow = commits > 0 && r.hasShallowFile()
+	r.logger().Printf("%v deepened, shallow: %v.\n", r.URL, r.shallow)
+	return nil
+}
+
+// checkAuth checks that the remote can be accessed with the configured
+// key or credentials by listing its branches with git ls-remote.
+func (r *Repo) checkAuth() error {
+	if _, err := r.lsRemote("--heads", r.URL); err != nil {
+		return fmt.Errorf("cannot access %v (id %v): %w", r.URL, r.ID, err)
+	}
+	return nil
+}
+
+// lsRemote runs git ls-remote with args for the startup checks. Like
+// pulls, it is attempted at most numRetries times, waiting retryBackoff
+// before the first retry and twice as long before each next one, so a
+// network blip does not fail the startup. Failures that a retry does not
+// fix, e.g. invalid credentials, are returned right away.
+func (r *Repo) lsRemote(args ...string) (string, error) {
+	params := r.withHeaders(append([]string{"ls-remote"}, args...))
+	delay := retryBackoff
+	for i := 0; ; i++ {
+		output, err := r.gitCmdOutput(params, "")
+		if err == nil || i == numRetries-1 || isPermanent(err) {
+			return output, err
+		}
+		r.logger().Printf("Cannot access %v, retrying in %v: %v\n", r.URL, delay, err)
+		gos.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// checkBranch checks that the branch exists on the remote by listing
+// it with git ls-remote. Latest tag mode checks that there are tags.
+func (r *Repo) checkBranch() error {
+	args := []string{"--heads", r.URL, r.Branch}
+	if r.Branch == latestTag {
+		args = []string{"--tags", r.URL}
+	}
+	output, err := r.lsRemote(args...)
+	if err != nil {
+		return fmt.Errorf("cannot access %v (id %v): %w", r.URL, r.ID, err)
+	}
+	if output == "" {
+		if r.Branch == latestTag {
+			return fmt.Errorf("%w: no tags in %v", ErrBranchNotFound, r.URL)
+		}
+		return fmt.Errorf("%w: %v is not in %v", ErrBranchNotFound, r.Branch, r.URL)
+	}
+	return nil
+}
+
+// defaultBranch detects the default branch of the remote with
+// git ls-remote. It falls back to DefaultBranch if detection fails.
+func (r *Repo) defaultBranch() string {
+	output, err := r.gitCmdOutput(r.withHeaders([]string{"ls-remote", "--symref", r.URL, "HEAD"}), "")
+	if err == nil {
+		// HEAD is listed as "ref: refs/heads/<branch>	HEAD"
+		for _, line := range strings.Split(output, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 3 && fields[0] == "ref:" && fields[2] == "HEAD" &&
+				strings.HasPrefix(fields[1], "refs/heads/") {
+				return strings.TrimPrefix(fields[1], "refs/heads/")
+			}
+		}
+	}
+	r.logger().Printf("Cannot detect default branch of %v, using %v.\n", r.URL, DefaultBranch)
+	return DefaultBranch
 }
 
 // Prepare prepares for a git pull
 // and validates the configured directory
 func (r *Repo) Prepare() error {
+	defer r.saveState()
+
+	// detect the branch if not configured
+	if r.Branch == "" {
+		r.Branch = r.defaultBranch()
+	}
+
+	// in temp mode, clone into a new temporary directory
+	if r.Temp && r.linkPath == "" {
+		if err := r.prepareTemp(); err != nil {
+			return err
+		}
+	}
+
+	// in staging mode, clone into the staging directory
+	if r.Staging != "" && r.linkPath == "" {
+		if err := r.prepareStaging(); err != nil {
+			return err
+		}
+		r.served = releaseCommit(r.linkPath)
+	}
+
 	// check if directory exists or is empty
 	// if not, create directory
 	fs, err := gos.ReadDir(r.Path)
 	if err != nil || len(fs) == 0 {
+		r.setAvailable(false)
 		return gos.MkdirAll(r.Path, os.FileMode(0755))
 	}
 
@@ -232,12 +1371,35 @@ func (r *Repo) Prepare() error {
 		var repoURL string
 		if repoURL, err = r.originURL(); err == nil {
 			// add .git suffix if missing for adequate comparison.
+			url := r.URL
 			if !strings.HasSuffix(repoURL, ".git") {
 				repoURL += ".git"
 			}
-			if repoURL == r.URL {
+			if !strings.HasSuffix(url, ".git") {
+				url += ".git"
+			}
+			if repoURL == url {
 				r.pulled = true
-				return nil
+				if r.Staging == "" {
+					r.served, _ = r.mostRecentCommit()
+				}
+				r.shallow = r.hasShallowFile()
+				if err = r.setMirrors(); err != nil {
+					return err
+				}
+				if err = r.setHTTPHeaders(); err != nil {
+					return err
+				}
+				if err = r.setPartial(); err != nil {
+					return err
+				}
+				if err = r.setFileMode(); err != nil {
+					return err
+				}
+				if err = r.checkAlternates(); err != nil {
+					return err
+				}
+				return r.setRefspecs()
 			}
 		}
 		if err != nil {
@@ -248,6 +1410,58 @@ func (r *Repo) Prepare() error {
 	return fmt.Errorf("cannot git clone into %v, directory not empty.", r.Path)
 }
 
+// prepareTemp creates a unique temporary directory to clone into and
+// replaces r.Path with a symlink to it.
+func (r *Repo) prepareTemp() error {
+	dir, err := gos.TempDir("", "caddy-git")
+	if err != nil {
+		return err
+	}
+
+	// a link left behind by a previous run that did not shut down
+	// cleanly is replaced.
+	if info, err := gos.Lstat(r.Path); err == nil {
+		if info.Mode()&os.ModeSymlink == 0 {
+			gos.Remove(dir)
+			return fmt.Errorf("cannot link temporary checkout to %v, path exists.", r.Path)
+		}
+		if err = gos.Remove(r.Path); err != nil {
+			gos.Remove(dir)
+			return err
+		}
+	}
+
+	if err = gos.MkdirAll(filepath.Dir(r.Path), os.FileMode(0755)); err == nil {
+		err = gos.Symlink(dir, r.Path)
+	}
+	if err != nil {
+		gos.Remove(dir)
+		return err
+	}
+
+	r.linkPath = r.Path
+	r.Path = dir
+	return nil
+}
+
+// Cleanup removes the temporary checkout and its link for a repository
+// in temp mode. It does nothing for other repositories.
+func (r *Repo) Cleanup() error {
+	r.Lock()
+	defer r.Unlock()
+	defer r.saveState()
+
+	if !r.Temp || r.linkPath == "" {
+		return nil
+	}
+
+	err := mergeErrors(gos.Remove(r.linkPath), gos.RemoveAll(r.Path))
+	r.Path = r.linkPath
+	r.linkPath = ""
+	r.pulled = false
+	return err
+}
+
 // getMostRecentCommit gets the hash of the most recent commit to the
 // repository. Useful for checking if changes occur.
 func (r *Repo) mostRecentCommit() (string, error) {
@@ -259,6 +1473,58 @@ func (r *Repo) mostRecentCommit() (string, error) {
 	return runCmdOutput(c, args, r.Path)
 }
 
+// changedFiles retrieves the files changed between commit from and the
+// most recent commit. If from is empty, e.g. after the initial clone,
+// all files in the repository are considered changed.
+func (r *Repo) changedFiles(from string) ([]string, error) {
+	args := []string{"diff", "--name-only", from, r.lastCommit}
+	if from == "" {
+		args = []string{"ls-files"}
+	}
+	output, err := runCmdOutput(gitBinary, args, r.Path)
+	if err != nil || output == "" {
+		return nil, err
+	}
+	return strings.Split(output, "\n"), nil
+}
+
+// onlyIgnored checks if all files match r.IgnorePaths, see matchGlob.
+func (r *Repo) onlyIgnored(files []string) bool {
+	if len(r.IgnorePaths) == 0 || len(files) == 0 {
+		return false
+	}
+	for _, file := range files {
+		if !ignoredPath(r.IgnorePaths, file) {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoredPath checks if file matches any of patterns.
+func ignoredPath(patterns []string, file string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// commitCount counts the commits between commit from and the most
+// recent commit. If from is empty, all commits are counted.
+func (r *Repo) commitCount(from string) (int, error) {
+	commits := r.lastCommit
+	if from != "" {
+		commits = from + ".." + r.lastCommit
+	}
+	output, err := runCmdOutput(gitBinary, []string{"rev-list", "--count", commits}, r.Path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(output)
+}
+
 // getLatestTag retrieves the most recent tag in the repository.
 func (r *Repo) fetchLatestTag() (string, error) {
 	// fetch updates to get latest tag
@@ -288,31 +1554,80 @@ func (r *Repo) originURL() (string, error) {
 
 // execThen executes r.Then.
 // It is trigged after successful git pull
-func (r *Repo) execThen() error {
+func (r *Repo) execThen(event *PullEvent) error {
+	return r.execCommands(r.Then, event, r.ThenOnError == "stop")
+}
+
+// execCommands executes commands from r.Path for a pull event. If stop
+// is set, the commands after a failed command are not executed.
+func (r *Repo) execCommands(commands []Then, event *PullEvent, stop bool) error {
 	var errs error
-	for _, command := range r.Then {
-		err := command.Exec(r.Path)
+	for i, command := range commands {
+		// commands of other paths than the changed files are skipped
+		if p, ok := command.(*pathThen); ok && event != nil && !p.matches(event.ChangedFiles) {
+			r.logger().Printf("Command '%v' skipped, no changed files match %v.\n", command.Command(), p.pattern)
+			continue
+		}
+		err := command.Exec(r.Path, event)
 		if err == nil {
-			Logger().Printf("Command '%v' successful.\n", command.Command())
+			r.logger().Printf("Command '%v' successful.\n", command.Command())
 		}
 		errs = mergeErrors(errs, err)
+		if err != nil && stop && i < len(commands)-1 {
+			r.logger().Printf("Command '%v' failed, %v remaining commands skipped.\n", command.Command(), len(commands)-i-1)
+			break
+		}
 	}
 	return errs
 }
 
-func mergeErrors(errs ...error) error {
-	if len(errs) == 0 {
-		return nil
+// matchGlob checks if file matches pattern. The elements of pattern
+// between slashes match as with path.Match, and ** matches any number of
+// directories, e.g. docs/** matches all files in docs. A pattern without
+// a slash matches the file name in any directory.
+func matchGlob(pattern, file string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(file))
+		return ok
 	}
-	var err error
-	for _, e := range errs {
-		if err == nil {
-			err = e
-			continue
+	return matchElements(strings.Split(pattern, "/"), strings.Split(file, "/"))
+}
+
+// matchElements checks if the path elements of file match those of
+// pattern, see matchGlob.
+func matchElements(pattern, file []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(file); i++ {
+				if matchElements(pattern[1:], file[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(file) == 0 {
+			return false
 		}
+		if ok, _ := path.Match(pattern[0], file[0]); !ok {
+			return false
+		}
+		pattern, file = pattern[1:], file[1:]
+	}
+	return len(file) == 0
+}
+
+func mergeErrors(errs ...error) error {
+	var list errorList
+	for _, e := range errs {
 		if e != nil {
-			err = errors.New(fmt.Sprintf("%v\n%v", err.Error(), e.Error()))
+			list = append(list, e)
 		}
 	}
-	return err
+	switch len(list) {
+	case 0:
+		return nil
+	case 1:
+		return list[0]
+	}
+	return list
 }
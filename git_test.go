@@ -1,8 +1,12 @@
 package git
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -174,6 +178,1061 @@ Command 'echo Hello' successful.
 
 }
 
+func TestPauseFile(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.PauseFile = DefaultPauseFile
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	// fake OS reports every file as existing
+	check(t, repo.Pull())
+	if !repo.lastPull.IsZero() {
+		t.Errorf("Expected pull to be skipped while pause file exists")
+	}
+
+	repo.PauseFile = ""
+	check(t, repo.Pull())
+	if repo.lastPull.IsZero() {
+		t.Errorf("Expected pull without pause file")
+	}
+}
+
+func TestCommitBack(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "status")
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Then = []Then{NewThen("make", "index")}
+	repo.CommitBack = DefaultCommitMessage
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	gittest.CmdOutputs["status"] = ""
+	check(t, repo.Pull())
+
+	gittest.CmdOutputs["status"] = "?? index.json"
+	gittest.CmdOutputs["--no-pager"] = "generated"
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	repo.lastCommit = ""
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if repo.lastCommit != "generated" {
+		t.Errorf("Expected last commit to be the generated commit, found %v", repo.lastCommit)
+	}
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if !strings.Contains(string(out), "No changes to commit back.") {
+		t.Errorf("Expected no commit without changes: %v", string(out))
+	}
+	if !strings.Contains(string(out), "Committed back changes to master at generated.") {
+		t.Errorf("Expected commit with changes: %v", string(out))
+	}
+}
+
+func TestBundle(t *testing.T) {
+	defer delete(gittest.ModTimes, "/srv/updates/site.bundle")
+	gittest.ModTimes["/srv/updates/site.bundle"] = time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "/srv/updates/site.bundle"})
+	repo.Bundle = true
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+
+	tests := []struct {
+		modTime time.Time
+		pull    bool
+	}{
+		{time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2016, 1, 2, 0, 0, 0, 0, time.UTC), false},
+	}
+	for i, test := range tests {
+		gittest.ModTimes["/srv/updates/site.bundle"] = test.modTime
+		gittest.ResetCommands()
+		gittest.Sleep(time.Second * 5)
+		check(t, repo.Pull())
+		pulled := strings.Contains(fmt.Sprint(gittest.Commands()), "pull origin master")
+		if pulled != test.pull {
+			t.Errorf("Test %v: expected pull %v found %q", i, test.pull, gittest.Commands())
+		}
+	}
+}
+
+func TestLastChanged(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	tests := []struct {
+		commit  string
+		changed bool
+	}{
+		{"1111111111111111111111111111111111111111", true},
+		{"1111111111111111111111111111111111111111", false},
+		{"2222222222222222222222222222222222222222", true},
+	}
+	var lastChange time.Time
+	for i, test := range tests {
+		gittest.CmdOutputs["--no-pager"] = test.commit
+		gittest.Sleep(time.Second * 5)
+		check(t, repo.Pull())
+		info := repo.info()
+		if info.Changed != test.changed {
+			t.Errorf("Test %v: expected changed %v found %v", i, test.changed, info.Changed)
+		}
+		if info.LastChange == nil || (test.changed && !info.LastChange.After(lastChange)) ||
+			(!test.changed && !info.LastChange.Equal(lastChange)) {
+			t.Errorf("Test %v: unexpected last change %v", i, info.LastChange)
+			continue
+		}
+		lastChange = *info.LastChange
+	}
+}
+
+func TestKeyPassphrase(t *testing.T) {
+	defer delete(gittest.FileContents, "/etc/keys/passphrase")
+
+	repo := &Repo{KeyPath: "~/.key", passphrase: "correct horse"}
+	if passphrase, err := repo.keyPassphrase(); err != nil || passphrase != "correct horse" {
+		t.Errorf("Expected passphrase correct horse found %q %v", passphrase, err)
+	}
+
+	repo = &Repo{KeyPath: "~/.key", PassphraseFile: "/etc/keys/passphrase"}
+	if _, err := repo.keyPassphrase(); err == nil {
+		t.Errorf("Expected error for missing passphrase file")
+	}
+	gittest.FileContents["/etc/keys/passphrase"] = " battery staple\n"
+	if passphrase, err := repo.keyPassphrase(); err != nil || passphrase != " battery staple" {
+		t.Errorf("Expected passphrase from file found %q %v", passphrase, err)
+	}
+	gittest.FileContents["/etc/keys/passphrase"] = "\n"
+	if _, err := repo.keyPassphrase(); err == nil {
+		t.Errorf("Expected error for empty passphrase file")
+	}
+
+	script := string(askpassScript())
+	if !strings.Contains(script, `"$CADDY_GIT_KEY_PASSPHRASE"`) || strings.Contains(script, "staple") {
+		t.Errorf("Expected askpass script to print the passphrase from the environment found %v", script)
+	}
+}
+
+func TestCheckRemote(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "ls-remote")
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	gittest.CmdOutputs["--no-pager"] = "1111111111111111111111111111111111111111"
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.CheckRemote = true
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	repo.lastCommit = "1111111111111111111111111111111111111111"
+
+	tests := []struct {
+		remote string
+		pull   bool
+	}{
+		{"1111111111111111111111111111111111111111\trefs/heads/master", false},
+		{"2222222222222222222222222222222222222222\trefs/heads/master", true},
+		{"", true},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["ls-remote"] = test.remote
+		gittest.ResetCommands()
+		gittest.Sleep(time.Second * 5)
+		check(t, repo.Pull())
+		commands := fmt.Sprint(gittest.Commands())
+		if !strings.Contains(commands, "ls-remote https://github.com/user/repo.git refs/heads/master") {
+			t.Errorf("Test %v: expected remote check found %v", i, commands)
+		}
+		if pulled := strings.Contains(commands, "pull origin master"); pulled != test.pull {
+			t.Errorf("Test %v: expected pull %v found %v", i, test.pull, commands)
+		}
+	}
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	headers := []string{"X-Proxy-Token: abc123"}
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://proxy.example.com/user/repo.git"})
+	repo.HTTPHeaders = headers
+	gittest.CmdOutput = repo.URL
+	gittest.ResetCommands()
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+	commands := fmt.Sprint(gittest.Commands())
+	if !strings.Contains(commands, "clone --config http.extraHeader=X-Proxy-Token: abc123 -b master") {
+		t.Errorf("Expected headers in clone found %v", commands)
+	}
+
+	repo = createRepo(&Repo{Path: "gitdir", URL: "https://proxy.example.com/user/repo.git"})
+	repo.HTTPHeaders = headers
+	gittest.ResetCommands()
+	check(t, repo.Prepare())
+	commands = fmt.Sprint(gittest.Commands())
+	if !strings.Contains(commands, "config --add http.extraHeader X-Proxy-Token: abc123") {
+		t.Errorf("Expected headers set in existing repo found %v", commands)
+	}
+
+	gittest.ResetCommands()
+	check(t, repo.checkAuth())
+	commands = fmt.Sprint(gittest.Commands())
+	if !strings.Contains(commands, "-c http.extraHeader=X-Proxy-Token: abc123 ls-remote") {
+		t.Errorf("Expected headers in ls-remote found %v", commands)
+	}
+}
+
+func TestLsRemoteRetry(t *testing.T) {
+	repo := createRepo(&Repo{URL: "https://github.com/user/repo.git"})
+	command := "ls-remote --heads https://github.com/user/repo.git"
+
+	tests := []struct {
+		output   string
+		attempts int
+	}{
+		{"fatal: unable to access 'https://github.com/user/repo.git/': Could not resolve host: github.com", numRetries},
+		{"fatal: Authentication failed for 'https://github.com/user/repo.git/'", 1},
+		{"remote: Repository not found.", 1},
+	}
+	for i, test := range tests {
+		gittest.CmdErrors[command] = errors.New("exit status 128")
+		gittest.CmdErrorOutputs[command] = test.output
+		gittest.ResetCommands()
+		if err := repo.checkAuth(); err == nil {
+			t.Errorf("Test %v: expected error", i)
+		}
+		if n := len(gittest.Commands()); n != test.attempts {
+			t.Errorf("Test %v: expected %v attempts found %v", i, test.attempts, n)
+		}
+	}
+	delete(gittest.CmdErrors, command)
+	delete(gittest.CmdErrorOutputs, command)
+	check(t, repo.checkAuth())
+}
+
+func TestFetchRetries(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.FetchRetries = 2
+	check(t, repo.Prepare())
+	check(t, repo.pull())
+	command := "pull origin master"
+
+	tests := []struct {
+		output   string
+		attempts int
+	}{
+		{"fatal: the remote end hung up unexpectedly", 3},
+		{"fatal: Authentication failed for 'https://github.com/user/repo.git/'", 1},
+	}
+	for i, test := range tests {
+		gittest.CmdErrors[command] = errors.New("exit status 128")
+		gittest.CmdErrorOutputs[command] = test.output
+		gittest.ResetCommands()
+		if err := repo.pull(); err == nil {
+			t.Errorf("Test %v: expected error", i)
+		}
+		attempts := 0
+		for _, c := range gittest.Commands() {
+			if c == command {
+				attempts++
+			}
+		}
+		if attempts != test.attempts {
+			t.Errorf("Test %v: expected %v attempts found %v", i, test.attempts, attempts)
+		}
+	}
+	delete(gittest.CmdErrors, command)
+	delete(gittest.CmdErrorOutputs, command)
+	check(t, repo.pull())
+}
+
+func TestRequireGitVersion(t *testing.T) {
+	defer func() { gittest.CmdOutputs["--version"] = "git version 2.39.2" }()
+
+	tests := []struct {
+		version   string
+		shouldErr bool
+	}{
+		{"git version 2.39.2", false},
+		{"git version 2.19.0", false},
+		{"git version 3.0.1", false},
+		{"git version 2.39.2 (Apple Git-143)", false},
+		{"git version 2.18.4", true},
+		{"git version 1.9.1", true},
+		{"git version", true},
+		{"unknown", true},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["--version"] = test.version
+		err := requireGitVersion("partial", 2, 19)
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v: expected error for %v", i, test.version)
+		}
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %v: expected no error for %v found %v", i, test.version, err)
+		}
+	}
+}
+
+func TestPartial(t *testing.T) {
+	// an existing checkout is configured for partial fetches
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Partial = true
+	gittest.CmdOutput = repo.URL
+	gittest.ResetCommands()
+	check(t, repo.Prepare())
+	commands := fmt.Sprint(gittest.Commands())
+	for _, expected := range []string{
+		"config remote.origin.promisor true",
+		"config remote.origin.partialclonefilter blob:none",
+	} {
+		if !strings.Contains(commands, expected) {
+			t.Errorf("Expected %v in commands found %v", expected, commands)
+		}
+	}
+}
+
+func TestDeepen(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.ShallowSince = "2016-01-01"
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+	if !repo.Shallow() {
+		t.Fatalf("Expected shallow clone")
+	}
+
+	tests := []struct {
+		commits   int
+		command   string
+		shallow   bool
+		shouldErr bool
+	}{
+		{50, "fetch --deepen=50 origin", true, false},
+		{-1, "", true, true},
+		{0, "fetch --unshallow origin", false, false},
+		{10, "", false, false},
+	}
+	for i, test := range tests {
+		gittest.ResetCommands()
+		err := repo.Deepen(test.commits)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+		}
+		commands := fmt.Sprint(gittest.Commands())
+		if test.command == "" && commands != "[]" {
+			t.Errorf("Test %v: expected no commands found %v", i, commands)
+		}
+		if !strings.Contains(commands, test.command) {
+			t.Errorf("Test %v: expected %q in %v", i, test.command, commands)
+		}
+		if repo.Shallow() != test.shallow {
+			t.Errorf("Test %v: expected shallow %v", i, test.shallow)
+		}
+	}
+}
+
+func TestExpandPath(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "ls-remote")
+	gittest.CmdOutputs["ls-remote"] = "3f4e5d6c7b8a9f0e\trefs/heads/feature/login"
+
+	tests := []struct {
+		path      string
+		branch    string
+		shouldErr bool
+		expected  string
+	}{
+		{"site", "feature/login", false, "site"},
+		{"previews/{branch}", "feature/login", false, "previews/feature-login"},
+		{"previews/{branch}/{commit}", "feature/login", false, "previews/feature-login/3f4e5d6"},
+		{"previews/{branch}", "..", true, ""},
+		{"previews/{branch}", latestTag, true, ""},
+	}
+	for i, test := range tests {
+		repo := &Repo{URL: "https://github.com/user/repo.git", Path: test.path, Branch: test.branch}
+		err := repo.expandPath()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %v: expected error for branch %v", i, test.branch)
+			}
+			continue
+		}
+		check(t, err)
+		if repo.Path != filepath.FromSlash(test.expected) {
+			t.Errorf("Test %v: expected path %v found %v", i, test.expected, repo.Path)
+		}
+	}
+
+	gittest.CmdOutputs["ls-remote"] = ""
+	repo := &Repo{URL: "https://github.com/user/repo.git", Path: "{commit}", Branch: "master"}
+	if err := repo.expandPath(); err == nil {
+		t.Errorf("Expected error if the commit cannot be resolved")
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "ls-remote")
+
+	repo := &Repo{URL: "https://github.com/user/repo.git"}
+	tests := []struct {
+		output   string
+		expected string
+	}{
+		{"ref: refs/heads/main\tHEAD\n3f4e5d6c\tHEAD", "main"},
+		{"ref: refs/heads/release/1.x\tHEAD\n3f4e5d6c\tHEAD", "release/1.x"},
+		{"3f4e5d6c\tHEAD", DefaultBranch},
+		{"", DefaultBranch},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["ls-remote"] = test.output
+		if branch := repo.defaultBranch(); branch != test.expected {
+			t.Errorf("Test %v: expected branch %v found %v", i, test.expected, branch)
+		}
+	}
+}
+
+func TestMirrors(t *testing.T) {
+	defer delete(gittest.CmdErrors, "pull origin master")
+	defer delete(gittest.CmdErrors, "pull mirror1 master")
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Mirrors = []string{"https://gitlab.com/user/repo.git", "https://mirror.example.com/repo.git"}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	gittest.CmdErrors["pull origin master"] = errors.New("exit status 1")
+	gittest.CmdErrors["pull mirror1 master"] = errors.New("exit status 1")
+	check(t, repo.Pull())
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if !strings.Contains(string(out), "pulled from mirror2 https://mirror.example.com/repo.git") {
+		t.Errorf("Expected pull from mirror2: %v", string(out))
+	}
+
+	gittest.CmdErrors["pull mirror2 master"] = errors.New("exit status 1")
+	defer delete(gittest.CmdErrors, "pull mirror2 master")
+	gittest.Sleep(time.Second * 5)
+	if err = repo.Pull(); err == nil {
+		t.Errorf("Expected error if all remotes fail")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	defer delete(gittest.CmdErrors, "fsck --full --no-progress")
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.Verify = true
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+
+	repo = createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.Verify = true
+	check(t, repo.Prepare())
+	gittest.CmdErrors["fsck --full --no-progress"] = errors.New("exit status 1")
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "integrity check") {
+		t.Errorf("Expected integrity check error found %v", err)
+	}
+}
+
+func TestServeSubdir(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.ServeSubdir = "public"
+	check(t, repo.Prepare())
+	if err := repo.Pull(); err == nil {
+		t.Errorf("Expected error for missing serve_subdir")
+	}
+
+	// the fake OS only has the gitdir directory
+	repo = createRepo(&Repo{Path: ".", URL: "https://github.com/user/repo.git"})
+	repo.ServeSubdir = "gitdir"
+	check(t, repo.Pull())
+}
+
+func TestWatchPath(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "ls-tree")
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.WatchPath = "manifest.json"
+	check(t, repo.Prepare())
+	check(t, repo.pull())
+
+	pulls := func() int {
+		n := 0
+		for _, command := range gittest.Commands() {
+			if command == "pull origin master" {
+				n++
+			}
+		}
+		return n
+	}
+
+	tests := []struct {
+		lsTree string
+		pulls  int
+	}{
+		{"100644 blob 1a2b3c\tmanifest.json", 1},
+		// unchanged
+		{"100644 blob 1a2b3c\tmanifest.json", 0},
+		{"100644 blob 4d5e6f\tmanifest.json", 1},
+		// removed
+		{"", 1},
+		{"", 0},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["ls-tree"] = test.lsTree
+		gittest.ResetCommands()
+		check(t, repo.pull())
+		if n := pulls(); n != test.pulls {
+			t.Errorf("Test %v: expected %v pulls found %v", i, test.pulls, n)
+		}
+	}
+}
+
+func TestSkipMessage(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "log")
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.SkipMessage = "[skip deploy]"
+	check(t, repo.Prepare())
+	check(t, repo.pull())
+
+	tests := []struct {
+		log   string
+		pulls int
+	}{
+		{"a1b2c3\nUpdate content\n", 1},
+		{"d4e5f6\nFix typo [skip deploy]\n", 0},
+		// already checked out
+		{repo.lastCommit + "\nDraft [skip deploy]\n", 1},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["log"] = test.log
+		gittest.ResetCommands()
+		check(t, repo.pull())
+		n := 0
+		for _, command := range gittest.Commands() {
+			if command == "pull origin master" {
+				n++
+			}
+		}
+		if n != test.pulls {
+			t.Errorf("Test %v: expected %v pulls found %v", i, test.pulls, n)
+		}
+	}
+}
+
+func TestOnConflict(t *testing.T) {
+	conflict := "error: Your local changes to the following files would be overwritten by merge:\n\tindex.html"
+
+	tests := []struct {
+		strategy string
+		pull     string
+		resolved bool
+	}{
+		{"", "pull origin master", false},
+		{"abort", "pull origin master", false},
+		{"ours", "pull -X ours origin master", false},
+		{"theirs", "pull -X theirs origin master", true},
+	}
+
+	for i, test := range tests {
+		repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+		repo.OnConflict = test.strategy
+		check(t, repo.Prepare())
+		check(t, repo.pull())
+
+		gittest.CmdErrors[test.pull] = errors.New("exit status 1")
+		gittest.CmdErrorOutputs[test.pull] = conflict
+		gittest.ResetCommands()
+		err := repo.pull()
+		delete(gittest.CmdErrors, test.pull)
+		delete(gittest.CmdErrorOutputs, test.pull)
+
+		commands := fmt.Sprint(gittest.Commands())
+		if !strings.Contains(commands, "merge --abort") {
+			t.Errorf("Test %v: expected merge to be aborted found %q", i, commands)
+		}
+		if resolved := err == nil; resolved != test.resolved {
+			t.Errorf("Test %v: expected resolved %v found error %v", i, test.resolved, err)
+		}
+		if reset := strings.Contains(commands, "reset --hard FETCH_HEAD"); reset != test.resolved {
+			t.Errorf("Test %v: expected reset %v found %q", i, test.resolved, commands)
+		}
+	}
+}
+
+func TestAllowForce(t *testing.T) {
+	diverged := "hint: Diverging branches can't be fast-forwarded.\nfatal: Not possible to fast-forward, aborting."
+
+	tests := []struct {
+		allowForce bool
+		pull       string
+	}{
+		{false, "pull origin master"},
+		{true, "pull --ff-only origin master"},
+	}
+
+	for i, test := range tests {
+		repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+		repo.AllowForce = test.allowForce
+		check(t, repo.Prepare())
+		check(t, repo.pull())
+
+		gittest.CmdErrors[test.pull] = errors.New("exit status 128")
+		gittest.CmdErrorOutputs[test.pull] = diverged
+		gittest.ResetCommands()
+		err := repo.pull()
+		delete(gittest.CmdErrors, test.pull)
+		delete(gittest.CmdErrorOutputs, test.pull)
+
+		commands := fmt.Sprint(gittest.Commands())
+		if !strings.Contains(commands, test.pull) {
+			t.Errorf("Test %v: expected %q found %q", i, test.pull, commands)
+		}
+		if resolved := err == nil; resolved != test.allowForce {
+			t.Errorf("Test %v: expected resolved %v found error %v", i, test.allowForce, err)
+		}
+		if !test.allowForce && !errors.Is(err, ErrDiverged) {
+			t.Errorf("Test %v: expected %v found %v", i, ErrDiverged, err)
+		}
+		if reset := strings.Contains(commands, "reset --hard FETCH_HEAD"); reset != test.allowForce {
+			t.Errorf("Test %v: expected reset %v found %q", i, test.allowForce, commands)
+		}
+	}
+}
+
+func TestDetachedHead(t *testing.T) {
+	defer delete(gittest.CmdErrors, "symbolic-ref -q HEAD")
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git", Branch: "v1.0.0"})
+	check(t, repo.Prepare())
+	check(t, repo.pull())
+
+	gittest.CmdErrors["symbolic-ref -q HEAD"] = errors.New("exit status 1")
+	gittest.ResetCommands()
+	check(t, repo.pull())
+
+	commands := fmt.Sprint(gittest.Commands())
+	if !strings.Contains(commands, "fetch origin v1.0.0 checkout --detach FETCH_HEAD") {
+		t.Errorf("Expected fetch and checkout of the tag found %q", commands)
+	}
+	if strings.Contains(commands, "pull") {
+		t.Errorf("Expected no pull for a detached HEAD found %q", commands)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.ShutdownGrace = time.Millisecond * 10
+	check(t, repo.Prepare())
+
+	// a pull in progress
+	repo.Lock()
+	if err := repo.shutdown(); err == nil {
+		t.Errorf("Expected error for pull still in progress")
+	}
+	repo.Unlock()
+	check(t, repo.shutdown())
+
+	gittest.ResetCommands()
+	check(t, repo.Pull())
+	if commands := gittest.Commands(); len(commands) != 0 {
+		t.Errorf("Expected no pull after shutdown found %q", commands)
+	}
+}
+
+func TestGitCommands(t *testing.T) {
+	tests := []struct {
+		repo     *Repo
+		expected []string
+	}{
+		{&Repo{Branch: "dev"}, []string{
+			"clone -b dev https://github.com/user/repo.git newdir",
+			"pull origin dev",
+		}},
+		{&Repo{Branch: "dev", NoTags: true}, []string{
+			"clone --no-tags -b dev https://github.com/user/repo.git newdir",
+			"pull --no-tags origin dev",
+		}},
+		{&Repo{Branch: "dev", Refspecs: []string{"refs/tags/v1"}}, []string{
+			"clone -b dev https://github.com/user/repo.git newdir",
+			"config --replace-all remote.origin.fetch refs/tags/v1",
+			"fetch origin",
+			"pull origin dev",
+		}},
+		{&Repo{Branch: "dev", ShallowSince: "2025-01-01"}, []string{
+			"clone --shallow-since=2025-01-01 -b dev https://github.com/user/repo.git newdir",
+			"pull origin dev",
+		}},
+		{&Repo{Branch: "dev", Partial: true}, []string{
+			"clone --filter=blob:none -b dev https://github.com/user/repo.git newdir",
+			"pull origin dev",
+		}},
+		{&Repo{Branch: "dev", RateLimit: 100}, []string{
+			"-s -d 100 -u 100 /usr/bin/git clone -b dev https://github.com/user/repo.git newdir",
+			"-s -d 100 -u 100 /usr/bin/git pull origin dev",
+		}},
+		{&Repo{Branch: "dev", Mirrors: []string{"https://gitlab.com/user/repo.git"}}, []string{
+			"clone -b dev https://github.com/user/repo.git newdir",
+			"config remote.mirror1.url https://gitlab.com/user/repo.git",
+			"config remote.mirror1.fetch +refs/heads/*:refs/remotes/mirror1/*",
+			"pull origin dev",
+		}},
+	}
+
+	check(t, initTrickle())
+	for i, test := range tests {
+		repo := test.repo
+		repo.URL, repo.Path = "https://github.com/user/repo.git", "newdir"
+		gittest.ResetCommands()
+		check(t, repo.pull())
+		check(t, repo.pull())
+
+		// leave out commands reading the repository state
+		var commands []string
+		for _, command := range gittest.Commands() {
+			if !strings.HasPrefix(command, "--no-pager") && !strings.HasPrefix(command, "symbolic-ref") {
+				commands = append(commands, command)
+			}
+		}
+		if fmt.Sprint(commands) != fmt.Sprint(test.expected) {
+			t.Errorf("Test %v: expected commands %q found %q", i, test.expected, commands)
+		}
+	}
+}
+
+// countThen counts its executions and fails with err.
+type countThen struct {
+	count int
+	err   error
+}
+
+func (c *countThen) Command() string {
+	return "count"
+}
+
+func (c *countThen) Exec(dir string, event *PullEvent) error {
+	c.count++
+	return c.err
+}
+
+func TestThenOnError(t *testing.T) {
+	tests := []struct {
+		onError   string
+		remaining int
+		once      int
+		shouldErr bool
+	}{
+		{"", 1, 1, true},
+		{"fail", 1, 1, true},
+		{"continue", 1, 1, false},
+		{"stop", 0, 0, true},
+	}
+	for i, test := range tests {
+		failing, remaining, once := &countThen{err: errors.New("build failed")}, &countThen{}, &countThen{}
+		repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+		repo.Then = []Then{failing, remaining}
+		repo.ThenOnce = []Then{once}
+		repo.ThenOnError = test.onError
+		gittest.CmdOutput = repo.URL
+		check(t, repo.Prepare())
+
+		gittest.Sleep(time.Second * 5)
+		err := repo.Pull()
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+		}
+		if failing.count != 1 || remaining.count != test.remaining || once.count != test.once {
+			t.Errorf("Test %v: expected commands run 1, %v and %v times found %v, %v and %v",
+				i, test.remaining, test.once, failing.count, remaining.count, once.count)
+		}
+	}
+}
+
+func TestThenConcurrency(t *testing.T) {
+	SetThenConcurrency(1)
+	defer SetThenConcurrency(0)
+
+	release := thenSlots.acquire()
+	acquired := make(chan struct{})
+	go func() {
+		thenSlots.acquire()()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Expected commands to wait for a free slot")
+	case <-time.After(time.Millisecond * 50):
+	}
+	release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected commands to run after the slot was released")
+	}
+}
+
+func TestPrePull(t *testing.T) {
+	gate := &countThen{err: errors.New("build server down")}
+	then := &countThen{}
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.PrePull = []Then{gate}
+	repo.Then = []Then{then}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	// the initial clone is not gated
+	check(t, repo.Pull())
+	if gate.count != 0 || then.count != 1 {
+		t.Errorf("Expected clone without pre_pull, found pre_pull %v then %v", gate.count, then.count)
+	}
+
+	gittest.ResetCommands()
+	repo.lastCommit = ""
+	gittest.Sleep(time.Second * 5)
+	if err := repo.Pull(); err != nil {
+		t.Errorf("Expected skipped pull to succeed found %v", err)
+	}
+	if strings.Contains(fmt.Sprint(gittest.Commands()), "pull") || then.count != 1 {
+		t.Errorf("Expected pull to be skipped found %q", gittest.Commands())
+	}
+
+	gate.err = nil
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if gate.count != 2 || then.count != 2 {
+		t.Errorf("Expected pull after pre_pull succeeded, found pre_pull %v then %v", gate.count, then.count)
+	}
+
+	// the first pull of an existing checkout, e.g. after a restart, is gated
+	gate = &countThen{err: errors.New("build server down")}
+	existing := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	existing.PrePull = []Then{gate}
+	check(t, existing.Prepare())
+	gittest.ResetCommands()
+	check(t, existing.Pull())
+	if gate.count != 1 || strings.Contains(fmt.Sprint(gittest.Commands()), "pull") {
+		t.Errorf("Expected first pull gated by pre_pull found %v runs and %q", gate.count, gittest.Commands())
+	}
+}
+
+func TestThenOnce(t *testing.T) {
+	then, once := &countThen{}, &countThen{}
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Then = []Then{then}
+	repo.ThenOnce = []Then{once}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	// the same commit pulled again, e.g. when the last commit is unknown
+	for i := 0; i < 2; i++ {
+		repo.lastCommit = ""
+		gittest.Sleep(time.Second * 5)
+		check(t, repo.Pull())
+	}
+	if then.count != 2 || once.count != 1 {
+		t.Errorf("Expected then to run 2 times and then_once once, found %v and %v", then.count, once.count)
+	}
+
+	gittest.CmdOutputs["--no-pager"] = "newcommit"
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if once.count != 2 {
+		t.Errorf("Expected then_once to run for a new commit, found %v", once.count)
+	}
+}
+
+func TestIgnorePaths(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "ls-files")
+
+	then := &countThen{}
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Then = []Then{then}
+	repo.IgnorePaths = []string{"CHANGELOG.md", "docs/*.txt", "assets/**"}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	tests := []struct {
+		files string
+		runs  bool
+	}{
+		{"CHANGELOG.md", false},
+		{"CHANGELOG.md\nsub/CHANGELOG.md\ndocs/notes.txt", false},
+		{"CHANGELOG.md\nindex.html", true},
+		{"docs/sub/notes.txt", true},
+		{"assets/css/site.css\nassets/logo.png", false},
+		{"assets.txt", true},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["ls-files"] = test.files
+		repo.lastCommit = ""
+		then.count = 0
+		gittest.Sleep(time.Second * 5)
+		check(t, repo.Pull())
+		if runs := then.count > 0; runs != test.runs {
+			t.Errorf("Test %v: expected commands to run %v found %v", i, test.runs, runs)
+		}
+	}
+}
+
+func TestThenIf(t *testing.T) {
+	docs, assets := &countThen{}, &countThen{}
+	commands := []Then{&pathThen{Then: docs, pattern: "docs/**"}, &pathThen{Then: assets, pattern: "assets/**/*.css"}}
+	repo := &Repo{Path: "gitdir"}
+
+	tests := []struct {
+		files  []string
+		docs   bool
+		assets bool
+	}{
+		{[]string{"docs/index.md"}, true, false},
+		{[]string{"assets/css/site.css", "README.md"}, false, true},
+		{[]string{"docs/api/v1/index.md", "assets/site.css"}, true, true},
+		{[]string{"index.html"}, false, false},
+	}
+	for i, test := range tests {
+		docs.count, assets.count = 0, 0
+		check(t, repo.execCommands(commands, &PullEvent{ChangedFiles: test.files}, false))
+		if (docs.count > 0) != test.docs || (assets.count > 0) != test.assets {
+			t.Errorf("Test %v: expected docs %v and assets %v found %v and %v", i, test.docs, test.assets, docs.count, assets.count)
+		}
+	}
+}
+
+func TestThenUser(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.Then = []Then{NewThen("make", "build"), NewLongThen("make", "watch")}
+	repo.thenUser = &fileOwner{1000, 33}
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+
+	for _, command := range []string{"build", "watch"} {
+		if user := gittest.CmdUsers[command]; user != "1000:33" {
+			t.Errorf("Expected %v to run as 1000:33 found %q", command, user)
+		}
+	}
+	for command := range gittest.CmdUsers {
+		if strings.HasPrefix(command, "clone") {
+			t.Errorf("Expected git to run as the current user found %v", command)
+		}
+		delete(gittest.CmdUsers, command)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		file    string
+		matches bool
+	}{
+		{"docs/**", "docs/index.md", true},
+		{"docs/**", "docs/api/index.md", true},
+		{"docs/**", "site/docs/index.md", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/tool/main.go", true},
+		{"src/**/test/*.js", "src/test/a.js", true},
+		{"src/**/test/*.js", "src/lib/test/a.js", true},
+		{"src/**/test/*.js", "src/lib/a.js", false},
+		{"*.md", "docs/README.md", true},
+		{"docs/*.md", "docs/api/README.md", false},
+	}
+	for i, test := range tests {
+		if matches := matchGlob(test.pattern, test.file); matches != test.matches {
+			t.Errorf("Test %v: expected %v to match %v %v", i, test.pattern, test.file, test.matches)
+		}
+	}
+}
+
+func TestRefFile(t *testing.T) {
+	gittest.FileContents["/etc/site/version"] = "v1.0.0"
+	defer delete(gittest.FileContents, "/etc/site/version")
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.RefFile = "/etc/site/version"
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	check(t, repo.Pull())
+	if repo.Branch != "v1.0.0" {
+		t.Errorf("Expected branch v1.0.0 found %v", repo.Branch)
+	}
+
+	gittest.FileContents["/etc/site/version"] = "v2.0.0\n"
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if repo.Branch != "v2.0.0" {
+		t.Errorf("Expected branch v2.0.0 found %v", repo.Branch)
+	}
+
+	gittest.FileContents["/etc/site/version"] = "--upload-pack=evil"
+	gittest.Sleep(time.Second * 5)
+	if err := repo.Pull(); err == nil {
+		t.Errorf("Expected error for invalid ref")
+	}
+}
+
+func TestTemp(t *testing.T) {
+	for i, test := range []struct {
+		path      string
+		shouldErr bool
+	}{
+		{"site", false},
+		{"link", false},
+		{"gitdir", true},
+	} {
+		repo := createRepo(&Repo{Path: test.path})
+		repo.Temp = true
+
+		err := repo.Prepare()
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %v: Error expected but not found", i)
+			}
+			continue
+		}
+		check(t, err)
+		if repo.Path != gittest.TempDirName {
+			t.Errorf("Test %v: Expected path %v found %v", i, gittest.TempDirName, repo.Path)
+		}
+
+		check(t, repo.Cleanup())
+		if repo.Path != test.path {
+			t.Errorf("Test %v: Expected path %v found %v", i, test.path, repo.Path)
+		}
+	}
+}
+
+func TestPullEvent(t *testing.T) {
+	var event *PullEvent
+	if event.Env() != nil || event.Input() != nil {
+		t.Errorf("Expected no env and input for nil event")
+	}
+
+	event = &PullEvent{
+		OldCommit:    "abc",
+		NewCommit:    "def",
+		ChangedFiles: []string{"index.html", "css/main.css"},
+		CommitCount:  2,
+	}
+	env := event.Env()
+	if len(env) != 3 || env[0] != "CADDY_GIT_OLD_COMMIT=abc" || env[1] != "CADDY_GIT_NEW_COMMIT=def" || env[2] != "CADDY_GIT_COMMIT_COUNT=2" {
+		t.Errorf("Unexpected env %v", env)
+	}
+	expected := "index.html\ncss/main.css\n"
+	if string(event.Input()) != expected {
+		t.Errorf("Expected input %q found %q", expected, string(event.Input()))
+	}
+}
+
 func createRepo(r *Repo) *Repo {
 	repo := &Repo{
 		URL:      "git@github.com/user/test",
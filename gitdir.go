@@ -0,0 +1,45 @@
+package git
+
+import (
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// GitDir is middleware that responds with 404 Not Found to requests
+// for the .git directory of any of Repos, so the history, remotes and
+// configuration of a repository cloned into the site are not served.
+type GitDir struct {
+	Root  string // site root the request paths are relative to
+	Repos []*Repo
+	Next  middleware.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (g GitDir) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	name := filepath.Join(g.Root, filepath.FromSlash(path.Clean("/"+r.URL.Path)))
+	for _, repo := range g.Repos {
+		if repo.inGitDir(name) {
+			return http.StatusNotFound, nil
+		}
+	}
+	return g.Next.ServeHTTP(w, r)
+}
+
+// inGitDir checks if the file name is the .git directory of r or inside
+// it. The name is compared case insensitively, as file systems may be.
+func (r *Repo) inGitDir(name string) bool {
+	dir := r.Path
+	if r.linkPath != "" {
+		dir = r.linkPath
+	}
+	rel, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false
+	}
+	first := strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+	return strings.EqualFold(first, ".git")
+}
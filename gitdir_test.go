@@ -0,0 +1,38 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGitDir(t *testing.T) {
+	root := &Repo{Path: "/var/www"}
+	sub := &Repo{Path: "/var/www/docs"}
+	temp := &Repo{Path: "/tmp/caddy-git123", linkPath: "/var/www/blog"}
+	g := GitDir{Root: "/var/www", Repos: []*Repo{root, sub, temp}, Next: okHandler{}}
+
+	tests := []struct {
+		path string
+		code int
+	}{
+		{"/index.html", http.StatusOK},
+		{"/.gitignore", http.StatusOK},
+		{"/docs/.github/workflow.yml", http.StatusOK},
+		{"/.git", http.StatusNotFound},
+		{"/.git/config", http.StatusNotFound},
+		{"/.GIT/HEAD", http.StatusNotFound},
+		{"/docs/.git/config", http.StatusNotFound},
+		{"/blog/.git/config", http.StatusNotFound},
+		{"/docs/../.git/config", http.StatusNotFound},
+		{"/../../.git/config", http.StatusNotFound},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		check(t, err)
+		req.URL.Path = test.path
+		if code, _ := g.ServeHTTP(httptest.NewRecorder(), req); code != test.code {
+			t.Errorf("Test %v: expected code %v for %v found %v", i, test.code, test.path, code)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package git
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type GiteeHook struct{}
+
+type giteePush struct {
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+}
+
+func (g GiteeHook) DoesHandle(h http.Header) bool {
+	return h.Get("X-Gitee-Event") != ""
+}
+
+func (g GiteeHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error) {
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
+	}
+
+	secret, err := repo.Hook.LoadSecret()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := g.handleToken(r, secret); err != nil {
+		return http.StatusBadRequest, signatureError{err}
+	}
+
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return http.StatusRequestTimeout, errors.New("could not read body from request")
+	}
+
+	if body, err = hookPayload(r, body); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	event := r.Header.Get("X-Gitee-Event")
+	if event == "" {
+		return http.StatusBadRequest, errors.New("the 'X-Gitee-Event' header is required but was missing.")
+	}
+
+	switch event {
+	case "Push Hook":
+		err := g.handlePush(body, repo)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+	// other events e.g. Tag Push Hook or Merge Request Hook are ignored.
+	default:
+		repo.countHook(&repo.hookStats.Ignored)
+		return http.StatusOK, nil
+	}
+
+	return http.StatusOK, nil
+}
+
+// handleToken verifies the password sent by Gitee in the X-Gitee-Token
+// header against the secret.
+func (g GiteeHook) handleToken(r *http.Request, secret string) error {
+	if secret == "" {
+		Logger().Print("Unable to verify request token. Secret not set in caddyfile!\n")
+		return nil
+	}
+
+	token := r.Header.Get("X-Gitee-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+		return errors.New("could not verify request token. The token is invalid!")
+	}
+	return nil
+}
+
+func (g GiteeHook) handlePush(body []byte, repo *Repo) error {
+	var push giteePush
+
+	err := json.Unmarshal(body, &push)
+	if err != nil {
+		return err
+	}
+
+	// extract the branch being pushed from the ref string
+	// and if it matches with our locally tracked one, pull.
+	if !strings.HasPrefix(push.Ref, "refs/heads/") {
+		return errors.New("the push request contained an invalid reference string.")
+	}
+
+	branch := strings.TrimPrefix(push.Ref, "refs/heads/")
+	repo.hookPush(branch, push.After)
+
+	return nil
+}
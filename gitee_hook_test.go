@@ -0,0 +1,69 @@
+package git
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGiteeDeployPush(t *testing.T) {
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/gitee_deploy", Secret: "supersecret"}}
+	giteeHook := GiteeHook{}
+
+	for i, test := range []struct {
+		body         string
+		event        string
+		token        string
+		responseBody string
+		code         int
+	}{
+		{"", "", "", "", 400},
+		{"", "Push Hook", "wrongsecret", "", 400},
+		{"", "", "supersecret", "", 400},
+		{"", "Push Hook", "supersecret", "", 400},
+		{pushGiteeBodyOther, "Push Hook", "supersecret", "", 200},
+		{pushGiteeBodyPartial, "Push Hook", "supersecret", "", 400},
+		{"", "Merge Request Hook", "supersecret", "", 200},
+	} {
+
+		req, err := http.NewRequest("POST", "/gitee_deploy", bytes.NewBuffer([]byte(test.body)))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+
+		if test.event != "" {
+			req.Header.Add("X-Gitee-Event", test.event)
+		}
+		if test.token != "" {
+			req.Header.Add("X-Gitee-Token", test.token)
+		}
+
+		rec := httptest.NewRecorder()
+
+		code, err := giteeHook.Handle(rec, req, repo)
+
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+
+		if rec.Body.String() != test.responseBody {
+			t.Errorf("Test %d: Expected response body to be '%v' but was '%v'", i, test.responseBody, rec.Body.String())
+		}
+	}
+
+}
+
+var pushGiteeBodyPartial = `
+{
+  "ref": ""
+}
+`
+
+var pushGiteeBodyOther = `
+{
+  "ref": "refs/heads/some-other-branch",
+  "password": "supersecret",
+  "hook_name": "push_hooks"
+}
+`
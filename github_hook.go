@@ -22,7 +22,8 @@ type ghRelease struct {
 }
 
 type ghPush struct {
-	Ref string `json:"ref"`
+	Ref   string `json:"ref"`
+	After string `json:"after"`
 }
 
 func (g GithubHook) DoesHandle(h http.Header) bool {
@@ -43,8 +44,21 @@ func (g GithubHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 	// read full body - required for signature
 	body, err := ioutil.ReadAll(r.Body)
 
-	err = g.handleSignature(r, body, repo.Hook.Secret)
+	secret, err := repo.Hook.LoadSecret()
 	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	err = g.handleSignature(r, body, secret)
+	if err != nil {
+		return http.StatusBadRequest, signatureError{err}
+	}
+
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
+	}
+
+	if body, err = hookPayload(r, body); err != nil {
 		return http.StatusBadRequest, err
 	}
 
@@ -114,10 +128,7 @@ func (g GithubHook) handlePush(body []byte, repo *Repo) error {
 	}
 
 	branch := refSlice[2]
-	if branch == repo.Branch {
-		Logger().Print("Received pull notification for the tracking branch, updating...\n")
-		repo.Pull()
-	}
+	repo.hookPush(branch, push.After)
 
 	return nil
 }
@@ -134,12 +145,12 @@ func (g GithubHook) handleRelease(body []byte, repo *Repo) error {
 		return errors.New("the release request contained an invalid TagName.")
 	}
 
-	Logger().Printf("Received new release '%s'. -> Updating local repository to this release.\n", release.Release.Name)
+	repo.logger().Printf("Received new release '%s'. -> Updating local repository to this release.\n", release.Release.Name)
 
 	// Update the local branch to the release tag name
 	// this will pull the release tag.
 	repo.Branch = release.Release.TagName
-	repo.Pull()
+	repo.HookPull()
 
 	return nil
 }
@@ -11,7 +11,17 @@ import (
 type GitlabHook struct{}
 
 type glPush struct {
-	Ref string `json:"ref"`
+	Ref   string `json:"ref"`
+	After string `json:"after"`
+}
+
+type glPipeline struct {
+	ObjectAttributes struct {
+		Ref    string `json:"ref"`
+		Tag    bool   `json:"tag"`
+		Sha    string `json:"sha"`
+		Status string `json:"status"`
+	} `json:"object_attributes"`
 }
 
 func (g GitlabHook) DoesHandle(h http.Header) bool {
@@ -29,11 +39,19 @@ func (g GitlabHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
 	}
 
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
+	}
+
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return http.StatusRequestTimeout, errors.New("could not read body from request")
 	}
 
+	if body, err = hookPayload(r, body); err != nil {
+		return http.StatusBadRequest, err
+	}
+
 	event := r.Header.Get("X-Gitlab-Event")
 	if event == "" {
 		return http.StatusBadRequest, errors.New("the 'X-Gitlab-Event' header is required but was missing.")
@@ -46,6 +64,12 @@ func (g GitlabHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 			return http.StatusBadRequest, err
 		}
 
+	case "Pipeline Hook":
+		err := g.handlePipeline(body, repo)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
 	// return 400 if we do not handle the event type.
 	default:
 		return http.StatusBadRequest, nil
@@ -70,10 +94,34 @@ func (g GitlabHook) handlePush(body []byte, repo *Repo) error {
 	}
 
 	branch := refSlice[2]
-	if branch == repo.Branch {
-		Logger().Print("Received pull notification for the tracking branch, updating...\n")
-		repo.Pull()
+	repo.hookPush(branch, push.After)
+
+	return nil
+}
+
+// handlePipeline pulls when a pipeline of the tracked branch succeeded,
+// so the commit is deployed only once it passed CI. Pipelines of tags
+// and pipelines that did not succeed are ignored.
+func (g GitlabHook) handlePipeline(body []byte, repo *Repo) error {
+	var pipeline glPipeline
+
+	err := json.Unmarshal(body, &pipeline)
+	if err != nil {
+		return err
+	}
+
+	attributes := pipeline.ObjectAttributes
+	if attributes.Ref == "" {
+		return errors.New("the pipeline request contained an invalid reference string.")
 	}
+	if attributes.Tag || attributes.Status != "success" {
+		repo.logger().Printf("Ignoring pipeline of %v with status %v.\n", attributes.Ref, attributes.Status)
+		repo.countHook(&repo.hookStats.Ignored)
+		return nil
+	}
+
+	// the ref of a branch pipeline is the branch name
+	repo.hookPush(attributes.Ref, attributes.Sha)
 
 	return nil
 }
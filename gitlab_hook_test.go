@@ -48,6 +48,65 @@ func TestGitlabDeployPush(t *testing.T) {
 
 }
 
+func TestGitlabDeployPipeline(t *testing.T) {
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/gitlab_deploy"}}
+	glHook := GitlabHook{}
+
+	for i, test := range []struct {
+		body string
+		code int
+	}{
+		{"", 400},
+		{pipelineGLBodyPartial, 400},
+		{pipelineGLBodyOther, 200},
+		{pipelineGLBodyFailed, 200},
+		{pipelineGLBodyTag, 200},
+	} {
+		req, err := http.NewRequest("POST", "/gitlab_deploy", bytes.NewBuffer([]byte(test.body)))
+		if err != nil {
+			t.Fatalf("Test %v: Could not create HTTP request: %v", i, err)
+		}
+		req.Header.Add("X-Gitlab-Event", "Pipeline Hook")
+
+		code, _ := glHook.Handle(httptest.NewRecorder(), req, repo)
+		if code != test.code {
+			t.Errorf("Test %d: Expected response code to be %d but was %d", i, test.code, code)
+		}
+	}
+
+	if stats := repo.hookCounts(); stats.Ignored != 3 || stats.Accepted != 0 {
+		t.Errorf("Expected 3 ignored pipelines found %+v", stats)
+	}
+}
+
+var pipelineGLBodyPartial = `
+{
+  "object_kind": "pipeline",
+  "object_attributes": {"status": "success"}
+}
+`
+
+var pipelineGLBodyOther = `
+{
+  "object_kind": "pipeline",
+  "object_attributes": {"ref": "some-other-branch", "tag": false, "status": "success"}
+}
+`
+
+var pipelineGLBodyFailed = `
+{
+  "object_kind": "pipeline",
+  "object_attributes": {"ref": "master", "tag": false, "status": "failed"}
+}
+`
+
+var pipelineGLBodyTag = `
+{
+  "object_kind": "pipeline",
+  "object_attributes": {"ref": "master", "tag": true, "status": "success"}
+}
+`
+
 var pushGLBodyPartial = `
 {
   "ref": ""
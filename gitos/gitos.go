@@ -48,6 +48,9 @@ type Cmd interface {
 	// Dir sets the working directory of the command.
 	Dir(string)
 
+	// Env sets the environment of the command.
+	Env([]string)
+
 	// Stdin sets the process's standard input.
 	Stdin(io.Reader)
 
@@ -59,6 +62,10 @@ type Cmd interface {
 
 	// Process is the underlying process, once started.
 	Process() *os.Process
+
+	// User sets the user and group ids the process runs as. It has no
+	// effect on platforms without credentials, e.g. Windows.
+	User(uid, gid int)
 }
 
 // gitCmd represents external commands executed by git.
@@ -71,6 +78,11 @@ func (g *gitCmd) Dir(dir string) {
 	g.Cmd.Dir = dir
 }
 
+// Env sets the environment of the command.
+func (g *gitCmd) Env(env []string) {
+	g.Cmd.Env = env
+}
+
 // Stdin sets the process's standard input.
 func (g *gitCmd) Stdin(stdin io.Reader) {
 	g.Cmd.Stdin = stdin
@@ -107,9 +119,36 @@ type OS interface {
 	// Stat returns a FileInfo describing the named file.
 	Stat(string) (os.FileInfo, error)
 
+	// Lstat returns a FileInfo describing the named file. If the file is a
+	// symbolic link, the returned FileInfo describes the symbolic link.
+	Lstat(string) (os.FileInfo, error)
+
 	// Remove removes the named file or directory.
 	Remove(string) error
 
+	// RemoveAll removes path and any children it contains.
+	RemoveAll(string) error
+
+	// Symlink creates newname as a symbolic link to oldname.
+	Symlink(string, string) error
+
+	// Readlink returns the destination of the named symbolic link.
+	Readlink(string) (string, error)
+
+	// Rename renames (moves) oldpath to newpath, replacing newpath if it
+	// exists.
+	Rename(string, string) error
+
+	// Chmod changes the mode of the named file.
+	Chmod(string, os.FileMode) error
+
+	// Lchown changes the numeric uid and gid of the named file. If the
+	// file is a symbolic link, it changes the uid and gid of the link.
+	Lchown(string, int, int) error
+
+	// ReadFile reads the file named by filename and returns the contents.
+	ReadFile(string) ([]byte, error)
+
 	// ReadDir reads the directory named by dirname and returns a list of
 	// directory entries.
 	ReadDir(string) ([]os.FileInfo, error)
@@ -123,6 +162,14 @@ type OS interface {
 	// returns the resulting File.
 	TempFile(string, string) (File, error)
 
+	// OpenFile opens the named file with specified flag and permission
+	// bits, creating it if flag includes os.O_CREATE.
+	OpenFile(string, int, os.FileMode) (File, error)
+
+	// TempDir creates a new temporary directory in the directory dir with a
+	// name beginning with prefix and returns the path of the new directory.
+	TempDir(string, string) (string, error)
+
 	// Sleep pauses the current goroutine for at least the duration d. A
 	// negative or zero duration causes Sleep to return immediately.
 	Sleep(time.Duration)
@@ -169,11 +216,46 @@ func (g GitOS) Stat(name string) (os.FileInfo, error) {
 	return os.Stat(name)
 }
 
+// Lstat calls os.Lstat.
+func (g GitOS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
 // Remove calls os.Remove.
 func (g GitOS) Remove(name string) error {
 	return os.Remove(name)
 }
 
+// RemoveAll calls os.RemoveAll.
+func (g GitOS) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+// Symlink calls os.Symlink.
+func (g GitOS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+// Readlink calls os.Readlink.
+func (g GitOS) Readlink(name string) (string, error) {
+	return os.Readlink(name)
+}
+
+// Rename calls os.Rename.
+func (g GitOS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Chmod calls os.Chmod.
+func (g GitOS) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(name, mode)
+}
+
+// Lchown calls os.Lchown.
+func (g GitOS) Lchown(name string, uid, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
+
 // LookPath calls exec.LookPath.
 func (g GitOS) LookPath(file string) (string, error) {
 	return exec.LookPath(file)
@@ -184,6 +266,21 @@ func (g GitOS) TempFile(dir, prefix string) (File, error) {
 	return ioutil.TempFile(dir, prefix)
 }
 
+// OpenFile calls os.OpenFile.
+func (g GitOS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+// TempDir calls ioutil.TempDir.
+func (g GitOS) TempDir(dir, prefix string) (string, error) {
+	return ioutil.TempDir(dir, prefix)
+}
+
+// ReadFile calls ioutil.ReadFile.
+func (g GitOS) ReadFile(filename string) ([]byte, error) {
+	return ioutil.ReadFile(filename)
+}
+
 // ReadDir calls ioutil.ReadDir.
 func (g GitOS) ReadDir(dirname string) ([]os.FileInfo, error) {
 	return ioutil.ReadDir(dirname)
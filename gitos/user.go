@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package gitos
+
+import "syscall"
+
+// User sets the user and group ids the process runs as.
+func (g *gitCmd) User(uid, gid int) {
+	g.Cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+	}
+}
@@ -0,0 +1,7 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package gitos
+
+// User is not supported on this platform and does nothing.
+func (g *gitCmd) User(uid, gid int) {}
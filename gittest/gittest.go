@@ -3,9 +3,13 @@
 package gittest
 
 import (
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,9 +22,77 @@ var FakeOS = fakeOS{}
 // CmdOutput is the output of any call to the mocked gitos.Cmd's Output().
 var CmdOutput = "success"
 
+// CmdOutputs overrides CmdOutput for commands by their first argument,
+// e.g. the git subcommand.
+var CmdOutputs = map[string]string{
+	"rev-list":  "1",
+	"--version": "git version 2.39.2",
+}
+
+// CmdErrors are the errors returned by the mocked gitos.Cmd's Wait() and
+// Output() for commands by their arguments joined by spaces, e.g. "pull origin master".
+var CmdErrors = map[string]error{}
+
+// CmdErrorOutputs are written to the stderr of the mocked gitos.Cmd with
+// the errors of CmdErrors, by the same keys.
+var CmdErrorOutputs = map[string]string{}
+
+// Chmods records the modes set by mocked gitos.OS's Chmod() by filename.
+var Chmods = map[string]os.FileMode{}
+
+// Lchowns records the owners set by mocked gitos.OS's Lchown() by
+// filename, as "uid:gid".
+var Lchowns = map[string]string{}
+
+// Symlinks records the links created by mocked gitos.OS's Symlink() and
+// moved by Rename(), by link name. Readlink() and Lstat() return them,
+// and Remove() removes them.
+var Symlinks = map[string]string{}
+
+// Renames records the files renamed by mocked gitos.OS's Rename(), by
+// new name.
+var Renames = map[string]string{}
+
+// CmdUsers records the users set by mocked gitos.Cmd's User() by the
+// command arguments, as "uid:gid".
+var CmdUsers = map[string]string{}
+
+// commands records the commands created by mocked gitos.OS's Command().
+var commands = struct {
+	list []string
+	sync.Mutex
+}{}
+
+// Commands returns the commands created by the mocked gitos.OS since
+// the last call to ResetCommands, each as its arguments joined by
+// spaces, e.g. "pull origin master".
+func Commands() []string {
+	commands.Lock()
+	defer commands.Unlock()
+	return append([]string(nil), commands.list...)
+}
+
+// ResetCommands clears the recorded commands.
+func ResetCommands() {
+	commands.Lock()
+	defer commands.Unlock()
+	commands.list = nil
+}
+
+// FileContents is the content of files returned by mocked gitos.OS's
+// ReadFile() by filename.
+var FileContents = map[string]string{}
+
+// ModTimes is the modification time of files returned by mocked
+// gitos.OS's Stat() by filename.
+var ModTimes = map[string]time.Time{}
+
 // TempFileName is the name of any file returned by mocked gitos.OS's TempFile().
 var TempFileName = "tempfile"
 
+// TempDirName is the name of any directory returned by mocked gitos.OS's TempDir().
+var TempDirName = "tempdir"
+
 // TimeSpeed is how faster the mocked gitos.Ticker and gitos.Sleep should run.
 var TimeSpeed = 5
 
@@ -31,6 +103,13 @@ var dirs = map[string][]os.FileInfo{
 	},
 }
 
+// files mocks the mode of fake files by filename.
+var files = map[string]os.FileMode{
+	"openkey": 0644,
+	"keydir":  os.ModeDir | 0700,
+	"link":    os.ModeSymlink | 0777,
+}
+
 // Open creates a new mock gitos.File.
 func Open(name string) gitos.File {
 	return &fakeFile{name: name}
@@ -91,7 +170,11 @@ func (f *fakeFile) Write(b []byte) (int, error) {
 }
 
 // fakeCmd is a mock gitos.Cmd.
-type fakeCmd struct{}
+type fakeCmd struct {
+	args   []string
+	stdout io.Writer
+	stderr io.Writer
+}
 
 func (f fakeCmd) Run() error {
 	return nil
@@ -101,29 +184,62 @@ func (f fakeCmd) Start() error {
 	return nil
 }
 
-func (f fakeCmd) Wait() error {
+func (f *fakeCmd) Wait() error {
+	if err, ok := CmdErrors[strings.Join(f.args, " ")]; ok {
+		if output, ok := CmdErrorOutputs[strings.Join(f.args, " ")]; ok && f.stderr != nil {
+			f.stderr.Write([]byte(output))
+		}
+		return err
+	}
+	// only commands with an overridden output write to stdout
+	if f.stdout != nil && len(f.args) > 0 {
+		if output, ok := CmdOutputs[f.args[0]]; ok {
+			f.stdout.Write([]byte(output))
+		}
+	}
 	return nil
 }
 
 func (f fakeCmd) Output() ([]byte, error) {
+	if err, ok := CmdErrors[strings.Join(f.args, " ")]; ok {
+		return nil, err
+	}
+	if len(f.args) > 0 {
+		if output, ok := CmdOutputs[f.args[0]]; ok {
+			return []byte(output), nil
+		}
+	}
 	return []byte(CmdOutput), nil
 }
 
 func (f fakeCmd) Dir(dir string) {}
 
+func (f fakeCmd) Env(env []string) {}
+
 func (f fakeCmd) Stdin(stdin io.Reader) {}
 
-func (f fakeCmd) Stdout(stdout io.Writer) {}
+func (f *fakeCmd) Stdout(stdout io.Writer) {
+	f.stdout = stdout
+}
 
-func (f fakeCmd) Stderr(stderr io.Writer) {}
+func (f *fakeCmd) Stderr(stderr io.Writer) {
+	f.stderr = stderr
+}
 
 func (f fakeCmd) Process() *os.Process { return nil }
 
+func (f fakeCmd) User(uid, gid int) {
+	commands.Lock()
+	CmdUsers[strings.Join(f.args, " ")] = fmt.Sprintf("%v:%v", uid, gid)
+	commands.Unlock()
+}
+
 // fakeInfo is a mock os.FileInfo.
 type fakeInfo struct {
-	name string
-	dir  bool
-	mode os.FileMode
+	name    string
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
 }
 
 func (f fakeInfo) Name() string {
@@ -139,6 +255,9 @@ func (f fakeInfo) Mode() os.FileMode {
 }
 
 func (f fakeInfo) ModTime() time.Time {
+	if !f.modTime.IsZero() {
+		return f.modTime
+	}
 	return time.Now().Truncate(time.Hour)
 }
 
@@ -171,10 +290,65 @@ func (f fakeOS) MkdirAll(path string, perm os.FileMode) error {
 }
 
 func (f fakeOS) Stat(name string) (os.FileInfo, error) {
-	return fakeInfo{name: name}, nil
+	if mode, ok := files[name]; ok {
+		return fakeInfo{name: name, dir: mode.IsDir(), mode: mode}, nil
+	}
+	if _, ok := dirs[name]; ok {
+		return fakeInfo{name: name, dir: true, mode: os.ModeDir}, nil
+	}
+	return fakeInfo{name: name, modTime: ModTimes[name]}, nil
+}
+
+func (f fakeOS) Lstat(name string) (os.FileInfo, error) {
+	if mode, ok := files[name]; ok {
+		return fakeInfo{name: name, dir: mode.IsDir(), mode: mode}, nil
+	}
+	if _, ok := dirs[name]; ok {
+		return fakeInfo{name: name, dir: true, mode: os.ModeDir}, nil
+	}
+	if _, ok := Symlinks[name]; ok {
+		return fakeInfo{name: name, mode: os.ModeSymlink | 0777}, nil
+	}
+	return nil, os.ErrNotExist
 }
 
 func (f fakeOS) Remove(name string) error {
+	delete(Symlinks, name)
+	return nil
+}
+
+func (f fakeOS) RemoveAll(path string) error {
+	return nil
+}
+
+func (f fakeOS) Symlink(oldname, newname string) error {
+	Symlinks[newname] = oldname
+	return nil
+}
+
+func (f fakeOS) Readlink(name string) (string, error) {
+	if target, ok := Symlinks[name]; ok {
+		return target, nil
+	}
+	return "", os.ErrNotExist
+}
+
+func (f fakeOS) Rename(oldpath, newpath string) error {
+	Renames[newpath] = oldpath
+	if target, ok := Symlinks[oldpath]; ok {
+		delete(Symlinks, oldpath)
+		Symlinks[newpath] = target
+	}
+	return nil
+}
+
+func (f fakeOS) Chmod(name string, mode os.FileMode) error {
+	Chmods[name] = mode
+	return nil
+}
+
+func (f fakeOS) Lchown(name string, uid, gid int) error {
+	Lchowns[name] = fmt.Sprintf("%v:%v", uid, gid)
 	return nil
 }
 
@@ -186,15 +360,40 @@ func (f fakeOS) TempFile(dir, prefix string) (gitos.File, error) {
 	return &fakeFile{name: TempFileName, info: fakeInfo{name: TempFileName}}, nil
 }
 
+func (f fakeOS) OpenFile(name string, flag int, perm os.FileMode) (gitos.File, error) {
+	return Open(name), nil
+}
+
+func (f fakeOS) TempDir(dir, prefix string) (string, error) {
+	return TempDirName, nil
+}
+
+func (f fakeOS) ReadFile(filename string) ([]byte, error) {
+	if content, ok := FileContents[filename]; ok {
+		return []byte(content), nil
+	}
+	return nil, os.ErrNotExist
+}
+
 func (f fakeOS) ReadDir(dirname string) ([]os.FileInfo, error) {
 	if f, ok := dirs[dirname]; ok {
 		return f, nil
 	}
-	return nil, nil
+	var files []os.FileInfo
+	for name := range FileContents {
+		if filepath.Dir(name) == dirname {
+			files = append(files, fakeInfo{name: filepath.Base(name)})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+	return files, nil
 }
 
 func (f fakeOS) Command(name string, args ...string) gitos.Cmd {
-	return fakeCmd{}
+	commands.Lock()
+	commands.list = append(commands.list, strings.Join(args, " "))
+	commands.Unlock()
+	return &fakeCmd{args: args}
 }
 
 func (f fakeOS) Sleep(d time.Duration) {
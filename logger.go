@@ -3,7 +3,11 @@ package git
 import (
 	"log"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+
+	"github.com/abiosoft/caddy-git/gitos"
 )
 
 // logger is used to log errors
@@ -36,3 +40,154 @@ func Logger() *log.Logger {
 func SetLogger(l *log.Logger) {
 	logger.setLogger(l)
 }
+
+// logger returns the logger of r, the log_file of r if set and
+// Logger() otherwise.
+func (r *Repo) logger() *log.Logger {
+	if r.log != nil {
+		return r.log
+	}
+	return Logger()
+}
+
+// logFiles holds the open log files by path.
+var logFiles = &logFileSet{files: make(map[string]*logFile)}
+
+// logFile is a log file that can be reopened, e.g. after it is rotated.
+type logFile struct {
+	path string
+	f    gitos.File
+	sync.Mutex
+}
+
+// Write implements the io.Writer interface.
+func (l *logFile) Write(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.f.Write(p)
+}
+
+// reopen closes and opens the file at l.path again, so logs are
+// written to a new file after the previous one was moved away.
+func (l *logFile) reopen() error {
+	f, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	old := l.f
+	l.f = f
+	l.Unlock()
+	return old.Close()
+}
+
+// openLogFile opens the file at path for appending, creating it if
+// it does not exist.
+func openLogFile(path string) (gitos.File, error) {
+	return gos.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.FileMode(0644))
+}
+
+// logFileSet stores all logFiles. They are reopened on SIGHUP.
+type logFileSet struct {
+	files  map[string]*logFile
+	signal sync.Once
+	sync.Mutex
+}
+
+// open returns the log file at path, opened once for all repositories
+// logging to it.
+func (s *logFileSet) open(path string) (*logFile, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if l, ok := s.files[path]; ok {
+		return l, nil
+	}
+	f, err := openLogFile(path)
+	if err != nil {
+		return nil, err
+	}
+	l := &logFile{path: path, f: f}
+	s.files[path] = l
+
+	s.signal.Do(func() {
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		go func() {
+			for range hangup {
+				s.reopen()
+			}
+		}()
+	})
+	return l, nil
+}
+
+// reopen reopens all log files. Failures are logged to Logger() and
+// the file is kept open.
+func (s *logFileSet) reopen() {
+	s.Lock()
+	defer s.Unlock()
+
+	for path, l := range s.files {
+		if err := l.reopen(); err != nil {
+			Logger().Printf("Could not reopen log file %v: %v\n", path, err)
+		}
+	}
+}
+
+// errorLogger logs errors while suppressing consecutive identical ones.
+// The first occurrence of an error is logged and repetitions are
+// summarized at exponentially reduced frequency i.e. after 2, 4, 8...
+// occurrences.
+type errorLogger struct {
+	last  string
+	count int
+	l     *log.Logger // Logger() if nil
+	sync.Mutex
+}
+
+// logger returns the logger errors are logged to.
+func (e *errorLogger) logger() *log.Logger {
+	if e.l != nil {
+		return e.l
+	}
+	return Logger()
+}
+
+// log logs err unless it is a repetition of the previous error.
+func (e *errorLogger) log(err error) {
+	e.Lock()
+	defer e.Unlock()
+
+	msg := err.Error()
+	if msg == e.last {
+		e.count++
+		if e.count&(e.count-1) == 0 {
+			e.logger().Printf("%v (same error repeated %v times)\n", msg, e.count)
+		}
+		return
+	}
+	e.summarize()
+	e.last = msg
+	e.count = 1
+	e.logger().Println(err)
+}
+
+// reset clears the previous error. It should be called after a
+// successful operation.
+func (e *errorLogger) reset() {
+	e.Lock()
+	defer e.Unlock()
+
+	e.summarize()
+	e.last = ""
+	e.count = 0
+}
+
+// summarize logs the number of repetitions of the previous error if
+// not already logged. Caller must hold the lock.
+func (e *errorLogger) summarize() {
+	if e.count > 1 && e.count&(e.count-1) != 0 {
+		e.logger().Printf("%v (same error repeated %v times)\n", e.last, e.count)
+	}
+}
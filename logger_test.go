@@ -0,0 +1,96 @@
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/abiosoft/caddy-git/gitos"
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestErrorLogger(t *testing.T) {
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	var e errorLogger
+	for i := 0; i < 5; i++ {
+		e.log(errors.New("pull failed"))
+	}
+	e.log(errors.New("other error"))
+	e.log(errors.New("other error"))
+	e.reset()
+	e.log(errors.New("other error"))
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+
+	expected := `pull failed
+pull failed (same error repeated 2 times)
+pull failed (same error repeated 4 times)
+pull failed (same error repeated 5 times)
+other error
+other error (same error repeated 2 times)
+other error
+`
+	if string(out) != expected {
+		t.Errorf("Expected %v found %v", expected, string(out))
+	}
+}
+
+func TestPullErrorLoggedOnce(t *testing.T) {
+	command := "submodule update --init"
+	gittest.CmdErrors[command] = errors.New("exit status 128")
+	defer delete(gittest.CmdErrors, command)
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.ID = "submodules"
+	repo.SubmoduleDepth = 1
+	check(t, repo.Prepare())
+	registry.add(repo)
+	defer registry.remove(repo)
+	logFile := gittest.Open("file")
+	repo.log = log.New(logFile, "", 0)
+	repo.errLog.l = repo.log
+
+	// the error is left to the caller to log
+	if err := PullRepo(repo.ID); err == nil {
+		t.Fatalf("Expected pull error")
+	}
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if n := strings.Count(string(out), "cannot update submodules"); n != 1 {
+		t.Errorf("Expected the error logged once found %v times in %q", n, out)
+	}
+}
+
+func TestLogFile(t *testing.T) {
+	f, err := logFiles.open("site.log")
+	check(t, err)
+	if other, err := logFiles.open("site.log"); err != nil || other != f {
+		t.Errorf("Expected the log file to be opened once found %v %v", other, err)
+	}
+
+	repo := &Repo{log: log.New(f, "", 0)}
+	repo.logger().Println("before rotation")
+	rotated := f.f
+	logFiles.reopen()
+	repo.logger().Println("after rotation")
+
+	tests := []struct {
+		file     gitos.File
+		expected string
+	}{
+		{rotated, "before rotation\n"},
+		{f.f, "after rotation\n"},
+	}
+	for i, test := range tests {
+		out, err := ioutil.ReadAll(test.file)
+		check(t, err)
+		if string(out) != test.expected {
+			t.Errorf("Test %v: expected %q found %q", i, test.expected, string(out))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package git
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// maintenanceRetry is the Retry-After value in seconds sent with the
+// maintenance page.
+const maintenanceRetry = 5
+
+// Maintenance is middleware that responds with a maintenance page
+// while any of Repos is being cloned or running its post pull commands.
+type Maintenance struct {
+	Repos []*Repo
+	Next  middleware.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (m Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	for _, repo := range m.Repos {
+		if repo.updating() {
+			return serveUnavailable(w, repo.MaintenancePage)
+		}
+	}
+	return m.Next.ServeHTTP(w, r)
+}
+
+// Fallback is middleware that responds with a fallback page while
+// any of Repos has an empty checkout or failed its last pull, instead
+// of serving missing or stale content.
+type Fallback struct {
+	Repos []*Repo
+	Next  middleware.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (f Fallback) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	for _, repo := range f.Repos {
+		if !repo.available() {
+			return serveUnavailable(w, repo.FallbackPage)
+		}
+	}
+	return f.Next.ServeHTTP(w, r)
+}
+
+// serveUnavailable writes page with the 503 status. If page is empty or
+// it cannot be read, the 503 status is left to Caddy.
+func serveUnavailable(w http.ResponseWriter, file string) (int, error) {
+	w.Header().Set("Retry-After", strconv.Itoa(maintenanceRetry))
+	if file == "" {
+		return http.StatusServiceUnavailable, nil
+	}
+	page, err := gos.ReadFile(file)
+	if err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write(page)
+	return 0, nil
+}
+
+// setUpdating marks r as being updated or not.
+func (r *Repo) setUpdating(updating bool) {
+	var v int32
+	if updating {
+		v = 1
+	}
+	atomic.StoreInt32(&r.busy, v)
+}
+
+// updating checks if r is being cloned or running its post pull commands.
+func (r *Repo) updating() bool {
+	return atomic.LoadInt32(&r.busy) == 1
+}
+
+// setAvailable marks the checkout of r as available or not.
+func (r *Repo) setAvailable(available bool) {
+	var v int32 = 1
+	if available {
+		v = 0
+	}
+	atomic.StoreInt32(&r.unavailable, v)
+}
+
+// available checks if the checkout of r has content and its last pull
+// succeeded.
+func (r *Repo) available() bool {
+	return atomic.LoadInt32(&r.unavailable) == 0
+}
@@ -0,0 +1,106 @@
+package git
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+type okHandler struct{}
+
+func (okHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	return http.StatusOK, nil
+}
+
+func TestMaintenance(t *testing.T) {
+	gittest.FileContents["/etc/site/maintenance.html"] = "<p>Be right back</p>"
+	defer delete(gittest.FileContents, "/etc/site/maintenance.html")
+
+	repo := &Repo{Maintenance: true}
+	noPage := &Repo{Maintenance: true}
+	missing := &Repo{Maintenance: true, MaintenancePage: "missing.html"}
+
+	tests := []struct {
+		repo   *Repo
+		page   string
+		code   int
+		body   string
+		hasErr bool
+	}{
+		{repo, "/etc/site/maintenance.html", 0, "<p>Be right back</p>", false},
+		{noPage, "", http.StatusServiceUnavailable, "", false},
+		{missing, "missing.html", http.StatusServiceUnavailable, "", true},
+	}
+
+	for i, test := range tests {
+		test.repo.MaintenancePage = test.page
+		m := Maintenance{Repos: []*Repo{test.repo}, Next: okHandler{}}
+		req, err := http.NewRequest("GET", "/index.html", nil)
+		check(t, err)
+
+		rec := httptest.NewRecorder()
+		code, _ := m.ServeHTTP(rec, req)
+		if code != http.StatusOK {
+			t.Errorf("Test %v: expected request to be served while not updating, found %v", i, code)
+		}
+
+		test.repo.setUpdating(true)
+		rec = httptest.NewRecorder()
+		code, err = m.ServeHTTP(rec, req)
+		test.repo.setUpdating(false)
+		if code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+		if test.hasErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.hasErr, err)
+		}
+		if rec.Body.String() != test.body {
+			t.Errorf("Test %v: expected body %q found %q", i, test.body, rec.Body.String())
+		}
+		if rec.Header().Get("Retry-After") == "" {
+			t.Errorf("Test %v: expected Retry-After header", i)
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	gittest.FileContents["/etc/site/unavailable.html"] = "<p>Content unavailable</p>"
+	defer delete(gittest.FileContents, "/etc/site/unavailable.html")
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.Fallback, repo.FallbackPage = true, "/etc/site/unavailable.html"
+	f := Fallback{Repos: []*Repo{repo}, Next: okHandler{}}
+	serve := func() (int, string) {
+		req, err := http.NewRequest("GET", "/index.html", nil)
+		check(t, err)
+		rec := httptest.NewRecorder()
+		code, err := f.ServeHTTP(rec, req)
+		check(t, err)
+		return code, rec.Body.String()
+	}
+
+	// empty checkout
+	check(t, repo.Prepare())
+	if code, body := serve(); code != 0 || body != "<p>Content unavailable</p>" {
+		t.Errorf("Expected fallback page for empty checkout found %v %q", code, body)
+	}
+
+	check(t, repo.Pull())
+	if code, _ := serve(); code != http.StatusOK {
+		t.Errorf("Expected request to be served after pull found %v", code)
+	}
+
+	gittest.CmdErrors["pull origin master"] = errors.New("exit status 128")
+	defer delete(gittest.CmdErrors, "pull origin master")
+	gittest.Sleep(time.Second * 5)
+	if err := repo.Pull(); err == nil {
+		t.Fatalf("Expected pull to fail")
+	}
+	if code, _ := serve(); code != 0 {
+		t.Errorf("Expected fallback page after failed pull found %v", code)
+	}
+}
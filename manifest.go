@@ -0,0 +1,118 @@
+package git
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// setManifest sets the manifest and signature, paths in the
+// repository, verified with the public key in keyFile after each pull.
+func (r *Repo) setManifest(manifest, sig, keyFile string) error {
+	var err error
+	if r.Manifest, err = cleanSubdir("verify_manifest", manifest); err != nil {
+		return err
+	}
+	if r.ManifestSig, err = cleanSubdir("verify_manifest", sig); err != nil {
+		return err
+	}
+	r.manifestKey, err = readManifestKey(keyFile)
+	return err
+}
+
+// readManifestKey reads the ed25519 public key the manifest signature
+// is verified with, base64 encoded in file.
+func readManifestKey(file string) (ed25519.PublicKey, error) {
+	content, err := gos.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read manifest key %v: %v", file, err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("manifest key %v is not a base64 encoded ed25519 public key", file)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// decodeSignature decodes an ed25519 signature, either raw or base64
+// encoded.
+func decodeSignature(content []byte) ([]byte, error) {
+	if len(content) == ed25519.SignatureSize {
+		return content, nil
+	}
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(content)))
+}
+
+// verifyManifest checks the signature of r.Manifest and that the files
+// of the checkout match the SHA-256 hashes listed in it. If they do not,
+// the checkout is reset to lastCommit, the commit checked out before
+// the pull, so the files that failed verification are not served. This also
+// restores files changed in the checkout since the previous pull.
+func (r *Repo) verifyManifest(lastCommit string) error {
+	if r.Manifest == "" {
+		return nil
+	}
+	err := r.checkManifest()
+	if err == nil {
+		return nil
+	}
+	err = fmt.Errorf("%v of %v failed verification: %v", r.Manifest, r.URL, err)
+	if lastCommit == "" {
+		return err
+	}
+	if e := runCmd(gitBinary, []string{"reset", "--hard", lastCommit}, r.Path); e != nil {
+		return mergeErrors(err, e)
+	}
+	r.lastCommit = lastCommit
+	r.logger().Printf("%v reset to %v after failed verification.\n", r.URL, lastCommit)
+	return err
+}
+
+// checkManifest verifies the signature of r.Manifest and the hashes of
+// the files it lists. The manifest has the format of sha256sum, one
+// "<hash>  <path>" line per file with the path relative to the
+// repository root.
+func (r *Repo) checkManifest() error {
+	manifest, err := gos.ReadFile(filepath.Join(r.Path, r.Manifest))
+	if err != nil {
+		return err
+	}
+	content, err := gos.ReadFile(filepath.Join(r.Path, r.ManifestSig))
+	if err != nil {
+		return err
+	}
+	sig, err := decodeSignature(content)
+	if err != nil || !ed25519.Verify(r.manifestKey, manifest, sig) {
+		return fmt.Errorf("invalid signature %v", r.ManifestSig)
+	}
+
+	for i, line := range strings.Split(string(manifest), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[1]) < 2 {
+			return fmt.Errorf("invalid line %v", i+1)
+		}
+		// sha256sum marks files hashed in binary mode with *
+		hash, file := fields[0], strings.TrimRight(fields[1][1:], "\r")
+		if file == "" || path.IsAbs(file) || path.Clean(file) != file || file == ".." || strings.HasPrefix(file, "../") {
+			return fmt.Errorf("invalid path %v on line %v", file, i+1)
+		}
+		data, err := gos.ReadFile(filepath.Join(r.Path, filepath.FromSlash(file)))
+		if err != nil {
+			return fmt.Errorf("%v is missing: %v", file, err)
+		}
+		sum := sha256.Sum256(data)
+		if !strings.EqualFold(hash, hex.EncodeToString(sum[:])) {
+			return fmt.Errorf("hash of %v does not match", file)
+		}
+	}
+	return nil
+}
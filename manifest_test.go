@@ -0,0 +1,118 @@
+package git
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestVerifyManifest(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	check(t, err)
+	files := map[string]string{
+		"/etc/caddy/manifest.pub": base64.StdEncoding.EncodeToString(public),
+		"gitdir/index.html":       "<html></html>",
+		"gitdir/css/site.css":     "body {}",
+	}
+	manifest := ""
+	for _, file := range []string{"index.html", "css/site.css"} {
+		sum := sha256.Sum256([]byte(files["gitdir/"+file]))
+		manifest += fmt.Sprintf("%v  %v\n", hex.EncodeToString(sum[:]), file)
+	}
+	files["gitdir/MANIFEST"] = manifest
+	files["gitdir/MANIFEST.sig"] = base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(manifest)))
+	for name, content := range files {
+		gittest.FileContents[name] = content
+		defer delete(gittest.FileContents, name)
+	}
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	defer delete(gittest.CmdOutputs, "rev-parse")
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	check(t, repo.setManifest("MANIFEST", "MANIFEST.sig", "/etc/caddy/manifest.pub"))
+	gittest.CmdOutput = repo.URL
+	gittest.CmdOutputs["--no-pager"] = "a1b2c3"
+	check(t, repo.Prepare())
+	check(t, repo.Pull())
+
+	// a tampered file reverts the pull
+	gittest.FileContents["gitdir/index.html"] = "<html>tampered</html>"
+	gittest.CmdOutputs["rev-parse"] = "a1b2c3"
+	gittest.CmdOutputs["--no-pager"] = "d4e5f6"
+	gittest.ResetCommands()
+	gittest.Sleep(time.Second * 5)
+	if err := repo.Pull(); err == nil || !strings.Contains(err.Error(), "index.html") {
+		t.Errorf("Expected verification error for index.html found %v", err)
+	}
+	if repo.lastCommit != "a1b2c3" {
+		t.Errorf("Expected checkout reset to a1b2c3 found %v", repo.lastCommit)
+	}
+	if commands := fmt.Sprint(gittest.Commands()); !strings.Contains(commands, "reset --hard a1b2c3") {
+		t.Errorf("Expected reset in commands found %v", commands)
+	}
+	if repo.available() {
+		t.Errorf("Expected checkout to be unavailable after failed verification")
+	}
+
+	// the first pull after a restart is reverted to the commit checked out
+	restarted := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	check(t, restarted.setManifest("MANIFEST", "MANIFEST.sig", "/etc/caddy/manifest.pub"))
+	check(t, restarted.Prepare())
+	gittest.ResetCommands()
+	if err := restarted.Pull(); err == nil {
+		t.Errorf("Expected verification error after restart")
+	}
+	if commands := fmt.Sprint(gittest.Commands()); !strings.Contains(commands, "reset --hard a1b2c3") {
+		t.Errorf("Expected reset after restart in commands found %v", commands)
+	}
+
+	tests := []struct {
+		manifest  string
+		sig       []byte
+		shouldErr bool
+	}{
+		{manifest, nil, false},
+		{manifest, make([]byte, ed25519.SignatureSize), true},
+		{"", nil, false},
+		{"0000  ../secret\n", nil, true},
+		{"0000  /etc/passwd\n", nil, true},
+		{"invalid\n", nil, true},
+		{"0000  missing.html\n", nil, true},
+	}
+	gittest.FileContents["gitdir/index.html"] = files["gitdir/index.html"]
+	for i, test := range tests {
+		sig := test.sig
+		if sig == nil {
+			sig = ed25519.Sign(private, []byte(test.manifest))
+		}
+		gittest.FileContents["gitdir/MANIFEST"] = test.manifest
+		gittest.FileContents["gitdir/MANIFEST.sig"] = string(sig)
+		err := repo.checkManifest()
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+		}
+	}
+}
+
+func TestReadManifestKey(t *testing.T) {
+	defer delete(gittest.FileContents, "manifest.pub")
+
+	if _, err := readManifestKey("manifest.pub"); err == nil {
+		t.Errorf("Expected error for missing key")
+	}
+	gittest.FileContents["manifest.pub"] = base64.StdEncoding.EncodeToString([]byte("short"))
+	if _, err := readManifestKey("manifest.pub"); err == nil {
+		t.Errorf("Expected error for invalid key")
+	}
+	gittest.FileContents["manifest.pub"] = base64.StdEncoding.EncodeToString(make([]byte, ed25519.PublicKeySize)) + "\n"
+	if _, err := readManifestKey("manifest.pub"); err != nil {
+		t.Errorf("Expected key to be read found %v", err)
+	}
+}
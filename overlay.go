@@ -0,0 +1,112 @@
+package git
+
+import (
+	"strings"
+)
+
+// Overlay is a repository whose files are checked out on top of the
+// files of a repository after each pull, replacing the files with the
+// same path. It is fetched into the repository with the same key or
+// credentials.
+type Overlay struct {
+	URL    string // Repository URL
+	Branch string // Branch to check out, the branch of the repository if empty
+	commit string // commit checked out by the last pull
+}
+
+// branch returns the branch of o checked out on top of r.
+func (o *Overlay) branch(r *Repo) string {
+	if o.Branch != "" {
+		return o.Branch
+	}
+	return r.Branch
+}
+
+// resetOverlays removes the files of the overlays from the checkout so
+// it can be pulled. The files of the repository are restored, and
+// untracked files, including files only in the overlays, are removed;
+// ignored files are kept.
+func (r *Repo) resetOverlays() error {
+	if len(r.Overlays) == 0 || !r.pulled {
+		return nil
+	}
+	if err := runCmd(gitBinary, []string{"reset", "-q", "--hard"}, r.Path); err != nil {
+		return err
+	}
+	return runCmd(gitBinary, []string{"clean", "-q", "-f", "-d"}, r.Path)
+}
+
+// applyOverlays checks out the files of the overlays on top of the
+// checkout, in order, so later overlays take precedence. If fetch is set
+// the overlays are fetched first, otherwise the commits of the last pull
+// are checked out again, e.g. after a failed pull. It returns the files
+// changed by the overlays since the last pull and if any overlay changed.
+func (r *Repo) applyOverlays(fetch bool) ([]string, bool, error) {
+	if len(r.Overlays) == 0 {
+		return nil, false, nil
+	}
+
+	var files []string
+	changed := false
+	for i := range r.Overlays {
+		o := &r.Overlays[i]
+		commit := o.commit
+		if fetch {
+			if err := r.gitCmd([]string{"fetch", o.URL, o.branch(r)}, r.Path); err != nil {
+				return nil, false, err
+			}
+			var err error
+			if commit, err = runCmdOutput(gitBinary, []string{"rev-parse", "FETCH_HEAD"}, r.Path); err != nil {
+				return nil, false, err
+			}
+		}
+		if commit == "" {
+			continue
+		}
+		if err := runCmd(gitBinary, []string{"checkout", commit, "--", "."}, r.Path); err != nil {
+			return nil, false, err
+		}
+		if commit != o.commit {
+			f, err := r.overlayFiles(o.commit, commit)
+			if err != nil {
+				return nil, false, err
+			}
+			files = append(files, f...)
+			o.commit = commit
+			changed = true
+		}
+	}
+
+	// the overlays are not staged, so they do not get in the way of git
+	return files, changed, runCmd(gitBinary, []string{"reset", "-q"}, r.Path)
+}
+
+// mergeFiles returns the files of base followed by the files of overlay
+// that are not in base.
+func mergeFiles(base, overlay []string) []string {
+	seen := make(map[string]bool)
+	for _, file := range base {
+		seen[file] = true
+	}
+	for _, file := range overlay {
+		if !seen[file] {
+			seen[file] = true
+			base = append(base, file)
+		}
+	}
+	return base
+}
+
+// overlayFiles returns the files changed between the commits from and
+// to of an overlay, or all its files if from is empty.
+func (r *Repo) overlayFiles(from, to string) ([]string, error) {
+	args := []string{"diff", "--name-only", from, to}
+	if from == "" {
+		args = []string{"ls-tree", "-r", "--name-only", to}
+	}
+	output, err := runCmdOutput(gitBinary, args, r.Path)
+	if err != nil || output == "" {
+		return nil, err
+	}
+	return strings.Split(output, "\n"), nil
+}
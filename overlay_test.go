@@ -0,0 +1,76 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestOverlays(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	defer delete(gittest.CmdOutputs, "rev-parse")
+	defer delete(gittest.CmdErrors, "pull origin master")
+
+	then := &countThen{}
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Then = []Then{then}
+	repo.Overlays = []Overlay{{URL: "https://github.com/user/overlay.git", Branch: "live"}}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	tests := []struct {
+		base     string
+		overlay  string
+		pullErr  bool
+		commands []string
+		runs     bool
+	}{
+		{"base1", "overlay1", false, []string{"reset -q --hard", "clean -q -f -d", "pull origin master",
+			"fetch https://github.com/user/overlay.git live", "checkout overlay1 -- .", "reset -q"}, true},
+		{"base1", "overlay1", false, []string{"checkout overlay1 -- ."}, false},
+		{"base1", "overlay2", false, []string{"checkout overlay2 -- ."}, true},
+		{"base2", "overlay2", false, []string{"pull origin master", "checkout overlay2 -- ."}, true},
+		{"base2", "overlay3", true, []string{"reset -q --hard", "checkout overlay2 -- ."}, false},
+	}
+	for i, test := range tests {
+		gittest.CmdOutputs["--no-pager"] = test.base
+		gittest.CmdOutputs["rev-parse"] = test.overlay
+		if test.pullErr {
+			gittest.CmdErrors["pull origin master"] = errors.New("exit status 1")
+		}
+		then.count = 0
+		gittest.ResetCommands()
+		gittest.Sleep(time.Second * 5)
+		err := repo.Pull()
+		if test.pullErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.pullErr, err)
+		}
+		commands := strings.Join(gittest.Commands(), "\n")
+		last := 0
+		for _, command := range test.commands {
+			j := strings.Index(commands[last:], command)
+			if j < 0 {
+				t.Errorf("Test %v: expected %q in order in %q", i, command, commands)
+				break
+			}
+			last += j + len(command)
+		}
+		if test.pullErr && strings.Contains(commands, "fetch https://github.com/user/overlay.git") {
+			t.Errorf("Test %v: expected overlay not to be fetched after a failed pull", i)
+		}
+		if runs := then.count > 0; runs != test.runs {
+			t.Errorf("Test %v: expected commands to run %v found %v", i, test.runs, runs)
+		}
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	files := mergeFiles([]string{"index.html", "about.html"}, []string{"about.html", "logo.png"})
+	if fmt.Sprint(files) != "[index.html about.html logo.png]" {
+		t.Errorf("Expected files of base followed by overlay found %v", files)
+	}
+}
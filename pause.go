@@ -0,0 +1,111 @@
+package git
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// DefaultPauseEndpoint is the path prefix of the pause and resume
+// endpoints if pause_endpoint is set without a path.
+const DefaultPauseEndpoint = "/git"
+
+// pulling is paused while pausedAll is 1.
+var pausedAll int32
+
+// PauseAll pauses all pulls of all repositories, e.g. during an incident,
+// until ResumeAll is called. Pulls in progress are not interrupted.
+func PauseAll() {
+	if atomic.SwapInt32(&pausedAll, 1) == 0 {
+		Logger().Println("Pulling paused for all repositories.")
+	}
+}
+
+// ResumeAll resumes pulling after PauseAll. Repositories that received
+// webhooks while paused and queue them are pulled right away.
+func ResumeAll() {
+	if atomic.SwapInt32(&pausedAll, 0) == 0 {
+		return
+	}
+	Logger().Println("Pulling resumed for all repositories.")
+	for _, id := range RepoIDs() {
+		for _, repo := range registry.lookup(id) {
+			if repo.takeQueuedHook() {
+				go repo.HookPull()
+			}
+		}
+	}
+}
+
+// PullsPaused checks if pulling is paused with PauseAll.
+func PullsPaused() bool {
+	return atomic.LoadInt32(&pausedAll) == 1
+}
+
+// hookPaused checks if a webhook pull of r must wait until pulling is
+// resumed. The webhook is dropped, or queued if r.QueueHooks is set.
+func (r *Repo) hookPaused() bool {
+	if !PullsPaused() {
+		return false
+	}
+	if !r.QueueHooks {
+		r.logger().Printf("Pulling is paused, dropping webhook for %v.\n", r.URL)
+		return true
+	}
+	r.logger().Printf("Pulling is paused, webhook for %v queued until resumed.\n", r.URL)
+	r.hookMutex.Lock()
+	r.hookQueued = true
+	r.hookMutex.Unlock()
+	return true
+}
+
+// takeQueuedHook returns and clears whether r has a queued webhook.
+func (r *Repo) takeQueuedHook() bool {
+	r.hookMutex.Lock()
+	defer r.hookMutex.Unlock()
+	queued := r.hookQueued
+	r.hookQueued = false
+	return queued
+}
+
+// PauseEndpoint is middleware that pauses and resumes pulling of all
+// repositories on POST requests to Path + "/pause" and Path + "/resume".
+// Requests must send Token in the Authorization header as a bearer token.
+type PauseEndpoint struct {
+	Path  string
+	Token string
+	Next  middleware.Handler
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (e PauseEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	var action func()
+	switch r.URL.Path {
+	case strings.TrimSuffix(e.Path, "/") + "/pause":
+		action = PauseAll
+	case strings.TrimSuffix(e.Path, "/") + "/resume":
+		action = ResumeAll
+	default:
+		return e.Next.ServeHTTP(w, r)
+	}
+	if r.Method != "POST" {
+		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if e.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(e.Token)) != 1 {
+		return http.StatusUnauthorized, errors.New("invalid pause endpoint token")
+	}
+
+	action()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if PullsPaused() {
+		w.Write([]byte("paused\n"))
+	} else {
+		w.Write([]byte("resumed\n"))
+	}
+	return 0, nil
+}
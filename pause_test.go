@@ -0,0 +1,86 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestPauseEndpoint(t *testing.T) {
+	defer ResumeAll()
+	endpoint := PauseEndpoint{Path: DefaultPauseEndpoint, Token: "supersecret", Next: okHandler{}}
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+		paused bool
+	}{
+		{"POST", "/git/repos", "", http.StatusOK, false},
+		{"GET", "/git/pause", "supersecret", http.StatusMethodNotAllowed, false},
+		{"POST", "/git/pause", "", http.StatusUnauthorized, false},
+		{"POST", "/git/pause", "wrongsecret", http.StatusUnauthorized, false},
+		{"POST", "/git/pause", "supersecret", 0, true},
+		{"POST", "/git/pause", "supersecret", 0, true},
+		{"POST", "/git/resume", "wrongsecret", http.StatusUnauthorized, true},
+		{"POST", "/git/resume", "supersecret", 0, false},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		check(t, err)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		if code, _ := endpoint.ServeHTTP(httptest.NewRecorder(), req); code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+		if PullsPaused() != test.paused {
+			t.Errorf("Test %v: expected paused %v", i, test.paused)
+		}
+	}
+}
+
+func TestPauseAll(t *testing.T) {
+	defer ResumeAll()
+
+	dropped := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	queued := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/other.git"})
+	queued.QueueHooks = true
+	for _, repo := range []*Repo{dropped, queued} {
+		gittest.CmdOutput = repo.URL
+		check(t, repo.Prepare())
+		registry.add(repo)
+		defer registry.remove(repo)
+	}
+
+	PauseAll()
+	gittest.ResetCommands()
+	gittest.Sleep(time.Second * 5)
+	check(t, dropped.Pull())
+	check(t, dropped.HookPull())
+	check(t, queued.HookPull())
+	if commands := gittest.Commands(); len(commands) > 0 {
+		t.Errorf("Expected no git commands while paused found %q", commands)
+	}
+
+	// only the queued webhook is pulled after resuming
+	ResumeAll()
+	pulled := func(repo *Repo) bool {
+		repo.Lock()
+		defer repo.Unlock()
+		return !repo.lastPull.IsZero()
+	}
+	for i := 0; i < 50 && !pulled(queued); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !pulled(queued) {
+		t.Errorf("Expected queued webhook to be pulled after resume")
+	}
+	if pulled(dropped) {
+		t.Errorf("Expected dropped webhook not to be pulled")
+	}
+}
@@ -0,0 +1,138 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// fileOwner is the owner set on the files of a checkout.
+// A gid of -1 leaves the group unchanged.
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// parseOwner parses an owner in the format user[:group], where user and
+// group are names or numeric ids.
+func parseOwner(s string) (*fileOwner, error) {
+	parts := strings.SplitN(s, ":", 2)
+	owner := &fileOwner{gid: -1}
+
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil {
+		u, err := user.Lookup(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid owner %v: %v", s, err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return nil, fmt.Errorf("invalid owner %v: uid %v is not numeric", s, u.Uid)
+		}
+	}
+	owner.uid = uid
+
+	if len(parts) == 2 && parts[1] != "" {
+		gid, err := strconv.Atoi(parts[1])
+		if err != nil {
+			g, err := user.LookupGroup(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid owner %v: %v", s, err)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return nil, fmt.Errorf("invalid owner %v: gid %v is not numeric", s, g.Gid)
+			}
+		}
+		owner.gid = gid
+	}
+	return owner, nil
+}
+
+// parseUser parses a user in the format user[:group] like parseOwner.
+// The group is the primary group of the user if omitted, and the user
+// must exist in that case.
+func parseUser(s string) (*fileOwner, error) {
+	owner, err := parseOwner(s)
+	if err != nil || owner.gid != -1 {
+		return owner, err
+	}
+	u, err := user.LookupId(strconv.Itoa(owner.uid))
+	if err != nil {
+		return nil, fmt.Errorf("invalid user %v: %v", s, err)
+	}
+	if owner.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, fmt.Errorf("invalid user %v: gid %v is not numeric", s, u.Gid)
+	}
+	return owner, nil
+}
+
+// parseMode parses an octal file mode, e.g. 644.
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode == 0 || mode > 0777 {
+		return 0, fmt.Errorf("invalid mode %v", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// applyPerms sets r.FileMode, r.DirMode and r.owner on the files and
+// directories of the checkout, except the .git directory. Failures, e.g.
+// changing the owner without running as root, are logged and do not
+// fail the pull.
+func (r *Repo) applyPerms() {
+	if r.FileMode == 0 && r.DirMode == 0 && r.owner == nil {
+		return
+	}
+
+	var failed int
+	var firstErr error
+	r.walkPerms(r.Path, func(err error) {
+		if failed == 0 {
+			firstErr = err
+		}
+		failed++
+	})
+	if failed > 0 {
+		r.logger().Printf("Could not set permissions of %v files in %v: %v\n", failed, r.Path, firstErr)
+	}
+}
+
+// walkPerms sets the permissions of the contents of dir recursively,
+// calling fail for each failure.
+func (r *Repo) walkPerms(dir string, fail func(error)) {
+	files, err := gos.ReadDir(dir)
+	if err != nil {
+		fail(err)
+		return
+	}
+	for _, file := range files {
+		name := filepath.Join(dir, file.Name())
+		if dir == r.Path && file.Name() == ".git" {
+			continue
+		}
+
+		if r.owner != nil {
+			if err := gos.Lchown(name, r.owner.uid, r.owner.gid); err != nil {
+				fail(err)
+			}
+		}
+
+		switch {
+		case file.Mode()&os.ModeSymlink != 0:
+			// the mode of links is not used
+		case file.IsDir():
+			if r.DirMode != 0 {
+				if err := gos.Chmod(name, r.DirMode); err != nil {
+					fail(err)
+				}
+			}
+			r.walkPerms(name, fail)
+		case r.FileMode != 0:
+			if err := gos.Chmod(name, r.FileMode); err != nil {
+				fail(err)
+			}
+		}
+	}
+}
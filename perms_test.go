@@ -0,0 +1,123 @@
+package git
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestParsePerms(t *testing.T) {
+	modes := []struct {
+		input     string
+		shouldErr bool
+		mode      os.FileMode
+	}{
+		{"644", false, 0644},
+		{"0755", false, 0755},
+		{"888", true, 0},
+		{"1777", true, 0},
+		{"0", true, 0},
+	}
+	for i, test := range modes {
+		mode, err := parseMode(test.input)
+		if test.shouldErr != (err != nil) || mode != test.mode {
+			t.Errorf("Test %v: expected mode %v and error %v, found %v and %v", i, test.mode, test.shouldErr, mode, err)
+		}
+	}
+
+	owners := []struct {
+		input     string
+		shouldErr bool
+		owner     fileOwner
+	}{
+		{"1000", false, fileOwner{1000, -1}},
+		{"1000:33", false, fileOwner{1000, 33}},
+		{"0:", false, fileOwner{0, -1}},
+		{"root", false, fileOwner{0, -1}},
+		{"no-such-user-caddy-git", true, fileOwner{}},
+		{"1000:no-such-group-caddy-git", true, fileOwner{}},
+	}
+	for i, test := range owners {
+		owner, err := parseOwner(test.input)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+			continue
+		}
+		if owner != nil && *owner != test.owner {
+			t.Errorf("Test %v: expected owner %v found %v", i, test.owner, *owner)
+		}
+	}
+
+	users := []struct {
+		input     string
+		shouldErr bool
+		owner     fileOwner
+	}{
+		{"root", false, fileOwner{0, 0}},
+		{"0", false, fileOwner{0, 0}},
+		{"1000:33", false, fileOwner{1000, 33}},
+		{"no-such-user-caddy-git", true, fileOwner{}},
+	}
+	for i, test := range users {
+		owner, err := parseUser(test.input)
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+			continue
+		}
+		if owner != nil && *owner != test.owner {
+			t.Errorf("Test %v: expected owner %v found %v", i, test.owner, *owner)
+		}
+	}
+}
+
+func TestApplyPerms(t *testing.T) {
+	gittest.FileContents["site/index.html"] = "<html></html>"
+	defer delete(gittest.FileContents, "site/index.html")
+
+	repo := &Repo{Path: "site", FileMode: 0644, owner: &fileOwner{1000, 33}}
+	repo.applyPerms()
+
+	if mode := gittest.Chmods["site/index.html"]; mode != 0644 {
+		t.Errorf("Expected mode 0644 found %v", mode)
+	}
+	if owner := gittest.Lchowns["site/index.html"]; owner != "1000:33" {
+		t.Errorf("Expected owner 1000:33 found %v", owner)
+	}
+}
+
+func TestPullFileMode(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	defer func(output string) { gittest.CmdOutput = output }(gittest.CmdOutput)
+
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.FileMode = 0755
+	check(t, repo.Prepare())
+	gittest.ResetCommands()
+	gittest.CmdOutputs["--no-pager"] = "a1b2c3"
+	check(t, repo.Pull())
+	if commands := fmt.Sprint(gittest.Commands()); !strings.Contains(commands, "config core.fileMode false") {
+		t.Fatalf("Expected git to ignore file modes found %v", commands)
+	}
+
+	// the mode set on a pull is not a local change to the next pull of
+	// an upstream change to the file
+	index := "newdir/index.html"
+	gittest.FileContents[index] = "<html></html>"
+	defer delete(gittest.FileContents, index)
+	gittest.CmdOutputs["--no-pager"] = "b2c3d4"
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if mode := gittest.Chmods[index]; mode != 0755 {
+		t.Errorf("Expected mode 0755 found %v", mode)
+	}
+	gittest.CmdOutputs["--no-pager"] = "c3d4e5"
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if repo.lastCommit != "c3d4e5" {
+		t.Errorf("Expected upstream change to be pulled found %v", repo.lastCommit)
+	}
+}
@@ -0,0 +1,67 @@
+package git
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// references serializes the updates of reference repositories, which
+// may be shared by several repos, by path.
+var references = &referenceLocks{locks: make(map[string]*sync.Mutex)}
+
+// referenceLocks holds a lock per reference repository.
+type referenceLocks struct {
+	locks map[string]*sync.Mutex
+	sync.Mutex
+}
+
+// lock returns the lock of the reference repository at path.
+func (l *referenceLocks) lock(path string) *sync.Mutex {
+	l.Lock()
+	defer l.Unlock()
+	if l.locks[path] == nil {
+		l.locks[path] = &sync.Mutex{}
+	}
+	return l.locks[path]
+}
+
+// updateReference fetches the remotes of the reference repository
+// r.Reference before a clone borrows its objects, so objects pushed
+// since it was last updated do not have to be downloaded. Refs are not
+// pruned, so the objects borrowed by existing clones stay reachable. A
+// failure is logged; the clone still borrows the objects the reference
+// already has.
+func (r *Repo) updateReference() {
+	lock := references.lock(r.Reference)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := r.gitCmd([]string{"fetch", "--all", "--quiet"}, r.Reference); err != nil {
+		r.logger().Printf("Cannot update reference %v of %v: %v\n", r.Reference, r.URL, err)
+	}
+}
+
+// checkAlternates checks that the object directories the checkout
+// borrows objects from, e.g. of a reference repository, still exist, as
+// the checkout is unusable without them.
+func (r *Repo) checkAlternates() error {
+	content, err := gos.ReadFile(filepath.Join(r.Path, ".git", "objects", "info", "alternates"))
+	if err != nil {
+		return nil
+	}
+	for _, dir := range strings.Split(string(content), "\n") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" || strings.HasPrefix(dir, "#") {
+			continue
+		}
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(r.Path, ".git", "objects", dir)
+		}
+		if _, err := gos.Lstat(dir); err != nil {
+			return fmt.Errorf("%v borrows objects from %v, which is missing: restore the reference repository, or remove %v and clone again", r.Path, dir, r.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package git
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestReference(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.Reference = "/var/cache/git/upstream.git"
+	check(t, repo.Prepare())
+	gittest.ResetCommands()
+	check(t, repo.Pull())
+
+	commands := gittest.Commands()
+	if len(commands) < 2 || commands[0] != "fetch --all --quiet" {
+		t.Fatalf("Expected reference fetch before clone found %q", commands)
+	}
+	if expected := "clone --reference /var/cache/git/upstream.git -b master"; !strings.HasPrefix(commands[1], expected) {
+		t.Errorf("Expected %v found %v", expected, commands[1])
+	}
+}
+
+func TestCheckAlternates(t *testing.T) {
+	alternates := "gitdir/.git/objects/info/alternates"
+	defer delete(gittest.FileContents, alternates)
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	gittest.CmdOutput = repo.URL
+	check(t, repo.checkAlternates())
+
+	tests := []struct {
+		content   string
+		shouldErr bool
+	}{
+		{"", false},
+		{"# comment\n", false},
+		{"objects\n", true},
+		{"/var/cache/git/upstream.git/objects\n", true},
+	}
+	for i, test := range tests {
+		gittest.FileContents[alternates] = test.content
+		err := repo.checkAlternates()
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+		}
+	}
+
+	// a checkout with missing alternates is not pulled into
+	gittest.FileContents[alternates] = "/var/cache/git/upstream.git/objects\n"
+	if err := repo.Prepare(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Expected missing alternates error found %v", err)
+	}
+}
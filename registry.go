@@ -0,0 +1,121 @@
+package git
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// registry holds all configured repositories by ID.
+var registry = &repoRegistry{repos: make(map[string][]*Repo)}
+
+// repoRegistry stores repositories by ID. Multiple repositories may
+// share an ID, e.g. the same repository in multiple server blocks.
+type repoRegistry struct {
+	repos map[string][]*Repo
+	sync.RWMutex
+}
+
+// add registers repo by its ID.
+func (g *repoRegistry) add(repo *Repo) {
+	g.Lock()
+	defer g.Unlock()
+
+	for _, r := range g.repos[repo.ID] {
+		if r == repo {
+			return
+		}
+	}
+	g.repos[repo.ID] = append(g.repos[repo.ID], repo)
+}
+
+// remove unregisters repo.
+func (g *repoRegistry) remove(repo *Repo) {
+	g.Lock()
+	defer g.Unlock()
+
+	repos := g.repos[repo.ID][:0]
+	for _, r := range g.repos[repo.ID] {
+		if r != repo {
+			repos = append(repos, r)
+		}
+	}
+	if len(repos) == 0 {
+		delete(g.repos, repo.ID)
+		return
+	}
+	g.repos[repo.ID] = repos
+}
+
+// lookup returns the repositories registered with id.
+func (g *repoRegistry) lookup(id string) []*Repo {
+	g.RLock()
+	defer g.RUnlock()
+
+	return append([]*Repo(nil), g.repos[id]...)
+}
+
+// RepoIDs returns the IDs of all configured repositories, sorted.
+func RepoIDs() []string {
+	registry.RLock()
+	defer registry.RUnlock()
+
+	ids := make([]string, 0, len(registry.repos))
+	for id := range registry.repos {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// DeepenRepo fetches more history of the shallow checkouts of the
+// repositories configured with id, see Repo.Deepen.
+func DeepenRepo(id string, commits int) error {
+	repos := registry.lookup(id)
+	if len(repos) == 0 {
+		return fmt.Errorf("unknown repo %v", id)
+	}
+
+	var errs error
+	for _, repo := range repos {
+		errs = mergeErrors(errs, repo.Deepen(commits))
+	}
+	return errs
+}
+
+// ReloadCredentials reloads the credentials of all configured
+// repositories, see Repo.ReloadCredentials.
+func ReloadCredentials() error {
+	registry.RLock()
+	var repos []*Repo
+	for _, r := range registry.repos {
+		repos = append(repos, r...)
+	}
+	registry.RUnlock()
+
+	var errs error
+	for _, repo := range repos {
+		errs = mergeErrors(errs, repo.ReloadCredentials())
+	}
+	return errs
+}
+
+// PullRepo pulls the repositories configured with id, as set by the id
+// directive or the repository URL by default. It is safe to call from
+// multiple goroutines; pulls of the same repository are serialized.
+func PullRepo(id string) error {
+	repos := registry.lookup(id)
+	if len(repos) == 0 {
+		return fmt.Errorf("unknown repo %v", id)
+	}
+
+	var errs error
+	for _, repo := range repos {
+		err := repo.Pull()
+		if err != nil {
+			repo.errLog.log(err)
+		}
+		errs = mergeErrors(errs, err)
+	}
+	return errs
+}
@@ -0,0 +1,42 @@
+package git
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestPullRepo(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.ID = "site"
+	other := createRepo(&Repo{Path: "otherdir", URL: "https://github.com/user/repo.git"})
+	other.ID = "site"
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	registry.add(repo)
+	registry.add(other)
+	registry.add(repo)
+	defer registry.remove(other)
+
+	if ids := fmt.Sprint(RepoIDs()); ids != "[site]" {
+		t.Errorf("Expected ids [site] found %v", ids)
+	}
+
+	gittest.Sleep(time.Second * 5)
+	check(t, PullRepo("site"))
+	if repo.lastPull.IsZero() || other.lastPull.IsZero() {
+		t.Errorf("Expected all repos with id site to be pulled")
+	}
+
+	if err := PullRepo("unknown"); err == nil {
+		t.Errorf("Expected error for unknown repo")
+	}
+
+	registry.remove(repo)
+	if n := len(registry.lookup("site")); n != 1 {
+		t.Errorf("Expected 1 repo after remove found %v", n)
+	}
+}
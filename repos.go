@@ -0,0 +1,164 @@
+package git
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy/middleware"
+)
+
+// DefaultReposEndpoint is the path of the repos endpoint if
+// repos_endpoint is set without a path.
+const DefaultReposEndpoint = "/git/repos"
+
+// ReposEndpoint is middleware that lists all configured repositories
+// as JSON at Path, with the state of their most recent pull. Only
+// settings that are not sensitive are listed; keys, secrets and
+// credentials are never included.
+type ReposEndpoint struct {
+	Path string
+	Next middleware.Handler
+}
+
+// repoInfo is the JSON representation of a repository in the list.
+type repoInfo struct {
+	ID       string `json:"id"`
+	URL      string `json:"url"`
+	Branch   string `json:"branch"`
+	Path     string `json:"path"`
+	Interval int    `json:"interval"` // seconds
+	Hook     string `json:"hook,omitempty"`
+	Healthy  bool   `json:"healthy"` // false if the checkout is empty or the last pull failed
+
+	// most recent pull, omitted until the first successful pull
+	Commit     string     `json:"commit,omitempty"`
+	LastPull   *time.Time `json:"last_pull,omitempty"`
+	Changed    bool       `json:"changed"` // true if the last pull moved HEAD
+	LastChange *time.Time `json:"last_change,omitempty"`
+
+	// webhook requests by result, if a webhook is configured
+	Webhooks *hookStats `json:"webhooks,omitempty"`
+}
+
+// ServeHTTP implements the middlware.Handler interface.
+func (e ReposEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.URL.Path != e.Path {
+		return e.Next.ServeHTTP(w, r)
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method.")
+	}
+
+	repos := []repoInfo{}
+	for _, id := range RepoIDs() {
+		for _, repo := range registry.lookup(id) {
+			repos = append(repos, repo.info())
+		}
+	}
+	body, err := json.Marshal(repos)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(body)
+	return 0, nil
+}
+
+// repoState is a snapshot of the state of a repo listed by the repos
+// and commit endpoints, so they do not wait for a pull in progress.
+type repoState struct {
+	branch     string
+	path       string
+	pulled     bool
+	commit     string
+	served     string
+	lastPull   time.Time
+	changed    bool
+	lastChange time.Time
+}
+
+// saveState snapshots the state of r for the endpoints. It is called
+// with r locked whenever a pull may have changed it.
+func (r *Repo) saveState() {
+	path := r.Path
+	if r.linkPath != "" {
+		path = r.linkPath
+	}
+	// the checkout is served as pulled, except in staging mode, where
+	// only a published release is; see publish
+	if r.Staging == "" && r.lastCommit != "" {
+		r.served = r.lastCommit
+	}
+	r.stateMutex.Lock()
+	defer r.stateMutex.Unlock()
+	r.state = repoState{
+		branch:     r.Branch,
+		path:       path,
+		pulled:     r.pulled,
+		commit:     r.lastCommit,
+		served:     r.served,
+		lastPull:   r.lastPull,
+		changed:    r.lastChanged,
+		lastChange: r.lastChange,
+	}
+}
+
+// info returns the settings of r listed by the repos endpoint, with
+// the state as of the end of its most recent pull.
+func (r *Repo) info() repoInfo {
+	r.stateMutex.Lock()
+	state := r.state
+	r.stateMutex.Unlock()
+
+	info := repoInfo{
+		ID:       redactURL(r.ID),
+		URL:      redactURL(r.URL),
+		Branch:   state.branch,
+		Path:     state.path,
+		Interval: int(r.Interval.Seconds()),
+		Hook:     r.Hook.Url,
+		Healthy:  r.available(),
+	}
+	if state.pulled {
+		info.Commit = state.commit
+		info.LastPull = &state.lastPull
+		info.Changed = state.changed
+	}
+	if !state.lastChange.IsZero() {
+		info.LastChange = &state.lastChange
+	}
+	if r.Hook.Url != "" {
+		stats := r.hookCounts()
+		info.Webhooks = &stats
+	}
+	return info
+}
+
+// redactHeader removes the value of a "Name: value" header whose name
+// suggests a credential, e.g. Authorization or X-Proxy-Token.
+func redactHeader(header string) string {
+	name := strings.SplitN(header, ":", 2)[0]
+	lower := strings.ToLower(name)
+	for _, s := range []string{"auth", "token", "key", "secret", "password", "cookie"} {
+		if strings.Contains(lower, s) {
+			return name + ": [redacted]"
+		}
+	}
+	return header
+}
+
+// redactURL removes the user info, e.g. a token, from an HTTP(S) rawURL.
+// The user of SSH URLs, e.g. git@, is not a credential and is kept.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
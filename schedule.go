@@ -0,0 +1,96 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily window of time between start and end, given as
+// offsets from midnight. A window ending before it starts wraps around
+// midnight e.g. 22:00-06:00.
+type timeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// parseTimeWindow parses a window in the format HH:MM-HH:MM.
+func parseTimeWindow(s string) (timeWindow, error) {
+	var w timeWindow
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return w, fmt.Errorf("invalid time window %v, expected HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = parseClock(parts[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parseClock(parts[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("invalid time window %v, start and end are equal", s)
+	}
+	return w, nil
+}
+
+// parseClock parses a time of day in the format HH:MM as offset
+// from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %v, expected HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// remaining returns the time remaining in the window at t,
+// or zero if t is outside the window.
+func (w timeWindow) remaining(t time.Time) time.Duration {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+
+	switch {
+	case w.start < w.end && now >= w.start && now < w.end:
+		return w.end - now
+	case w.start > w.end && now >= w.start:
+		return 24*time.Hour - now + w.end
+	case w.start > w.end && now < w.end:
+		return w.end - now
+	}
+	return 0
+}
+
+// quietRemaining returns the time remaining in the current quiet
+// period of r, or zero if not in a quiet period.
+func (r *Repo) quietRemaining() time.Duration {
+	now := time.Now().In(r.location())
+	var remaining time.Duration
+	for _, w := range r.QuietPeriods {
+		if d := w.remaining(now); d > remaining {
+			remaining = d
+		}
+	}
+	return remaining
+}
+
+// DefaultNightWindow is the window of night_multiplier if it is set
+// without a window.
+const DefaultNightWindow = "22:00-06:00"
+
+// intervalMultiplier returns the factor the interval of r is stretched
+// by at t, r.NightMultiplier in r.NightWindow and 1 otherwise.
+func (r *Repo) intervalMultiplier(t time.Time) int {
+	if r.NightMultiplier <= 1 || r.NightWindow.remaining(t.In(r.location())) == 0 {
+		return 1
+	}
+	return r.NightMultiplier
+}
+
+// location returns the timezone of r, local time if not set.
+func (r *Repo) location() *time.Location {
+	if r.Timezone != nil {
+		return r.Timezone
+	}
+	return time.Local
+}
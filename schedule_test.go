@@ -0,0 +1,69 @@
+package git
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	tests := []struct {
+		window    string
+		shouldErr bool
+		at        string
+		remaining time.Duration
+	}{
+		{"09:00-17:00", false, "08:59", 0},
+		{"09:00-17:00", false, "09:00", 8 * time.Hour},
+		{"09:00-17:00", false, "16:30", 30 * time.Minute},
+		{"09:00-17:00", false, "17:00", 0},
+		{"22:00-06:00", false, "23:00", 7 * time.Hour},
+		{"22:00-06:00", false, "05:00", time.Hour},
+		{"22:00-06:00", false, "12:00", 0},
+		{"09:00", true, "", 0},
+		{"09:00-25:00", true, "", 0},
+		{"09:00-09:00", true, "", 0},
+	}
+
+	for i, test := range tests {
+		w, err := parseTimeWindow(test.window)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %v: Error expected but not found", i)
+			}
+			continue
+		}
+		check(t, err)
+
+		at, _ := time.Parse("15:04", test.at)
+		if remaining := w.remaining(at); remaining != test.remaining {
+			t.Errorf("Test %v: Expected %v found %v", i, test.remaining, remaining)
+		}
+	}
+}
+
+func TestIntervalMultiplier(t *testing.T) {
+	night, err := parseTimeWindow(DefaultNightWindow)
+	check(t, err)
+	madrid, err := time.LoadLocation("Europe/Madrid")
+	check(t, err)
+
+	tests := []struct {
+		multiplier int
+		timezone   *time.Location
+		at         time.Time
+		expected   int
+	}{
+		{4, time.UTC, time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC), 4},
+		{4, time.UTC, time.Date(2020, 1, 1, 5, 59, 0, 0, time.UTC), 4},
+		{4, time.UTC, time.Date(2020, 1, 1, 6, 0, 0, 0, time.UTC), 1},
+		{4, time.UTC, time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 1},
+		{4, madrid, time.Date(2020, 1, 1, 21, 30, 0, 0, time.UTC), 4},
+		{0, time.UTC, time.Date(2020, 1, 1, 23, 0, 0, 0, time.UTC), 1},
+	}
+	for i, test := range tests {
+		repo := &Repo{NightMultiplier: test.multiplier, NightWindow: night, Timezone: test.timezone}
+		if m := repo.intervalMultiplier(test.at); m != test.expected {
+			t.Errorf("Test %v: expected %v found %v", i, test.expected, m)
+		}
+	}
+}
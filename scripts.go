@@ -16,6 +16,10 @@ var (
 	// shell holds the shell to be used. Either sh or bash.
 	shell string
 
+	// trickleBinary holds the absolute path to trickle executable,
+	// used to limit the bandwidth of git commands.
+	trickleBinary string
+
 	// initMutex prevents parallel attempt to validate
 	// git requirements.
 	initMutex = sync.Mutex{}
@@ -52,6 +56,43 @@ func Init() error {
 	return nil
 }
 
+// requireGitVersion checks that git is at least version major.minor,
+// which is required by feature.
+func requireGitVersion(feature string, major, minor int) error {
+	output, err := runCmdOutput(gitBinary, []string{"--version"}, "")
+	if err != nil {
+		return fmt.Errorf("cannot determine git version: %v", err)
+	}
+	// e.g. git version 2.39.2 (Apple Git-143)
+	fields := strings.Fields(output)
+	if len(fields) < 3 {
+		return fmt.Errorf("cannot determine git version from %q", output)
+	}
+	var maj, min int
+	if _, err = fmt.Sscanf(fields[2], "%d.%d", &maj, &min); err != nil {
+		return fmt.Errorf("cannot determine git version from %q", output)
+	}
+	if maj < major || maj == major && min < minor {
+		return fmt.Errorf("%v requires git %v.%v or later, found %v", feature, major, minor, fields[2])
+	}
+	return nil
+}
+
+// initTrickle locates the trickle binary required by rate_limit.
+func initTrickle() error {
+	initMutex.Lock()
+	defer initMutex.Unlock()
+
+	if trickleBinary != "" {
+		return nil
+	}
+	var err error
+	if trickleBinary, err = gos.LookPath("trickle"); err != nil {
+		return fmt.Errorf("rate_limit requires trickle installed. Cannot find trickle binary in PATH")
+	}
+	return nil
+}
+
 // writeScriptFile writes content to a temporary file.
 // It changes the temporary file mode to executable and
 // closes it to prepare it for execution.
@@ -103,6 +144,18 @@ fi
 `, shell, shell, gitBinary))
 }
 
+// passphraseEnv is the environment variable passing the passphrase of
+// the private key to askpassScript.
+const passphraseEnv = "CADDY_GIT_KEY_PASSPHRASE"
+
+// askpassScript forms content of the SSH_ASKPASS script that unlocks an
+// encrypted private key. The passphrase is never written to the script.
+func askpassScript() []byte {
+	return []byte(fmt.Sprintf(`#!/bin/%v
+printf '%%s\n' "$%v"
+`, shell, passphraseEnv))
+}
+
 // bashScript forms content of bash script to clone or update a repo using ssh
 func bashScript(gitShPath string, repo *Repo, params []string) []byte {
 	return []byte(fmt.Sprintf(`#!/bin/%v
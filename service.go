@@ -1,11 +1,16 @@
 package git
 
 import (
+	"math/rand"
 	"sync"
+	"time"
 
 	"github.com/abiosoft/caddy-git/gitos"
 )
 
+// wakeCheck is the interval of the checks for a suspension of the machine.
+const wakeCheck = time.Minute
+
 var (
 	// Services holds all git pulling services and provides the function to
 	// stop them.
@@ -18,25 +23,105 @@ type repoService struct {
 	repo   *Repo
 	ticker gitos.Ticker  // ticker to tick at intervals
 	halt   chan struct{} // channel to notify service to halt and stop pulling.
+	last   time.Time     // time of the last interval pull
+	wall   time.Time     // wall clock time of the last suspension check
+	hooks  bool          // pulled on webhooks, only after a suspension
 }
 
 // Start starts a new background service to pull periodically.
+// If repo.Stagger is set, the first tick is delayed by a random offset
+// within the interval to spread pulls of multiple repositories over time.
 func Start(repo *Repo) {
+	start(repo, false)
+}
+
+// StartWakeCheck starts a background service for a repository pulled on
+// webhooks, which pulls once after the machine resumed from a
+// suspension, as the webhooks sent while it was asleep were missed.
+func StartWakeCheck(repo *Repo) {
+	start(repo, true)
+}
+
+// start starts the background service of repo, see Start and
+// StartWakeCheck.
+func start(repo *Repo, hooks bool) {
 	service := &repoService{
 		repo,
-		gos.NewTicker(repo.Interval),
+		nil,
 		make(chan struct{}),
+		time.Time{},
+		time.Time{},
+		hooks,
+	}
+	if !hooks && (!repo.Stagger || repo.Interval <= 0) {
+		service.ticker = gos.NewTicker(repo.Interval)
 	}
 	go func(s *repoService) {
+		if s.ticker == nil && !s.hooks {
+			offset := time.Duration(rand.Int63n(int64(repo.Interval)))
+			select {
+			case <-time.After(offset):
+				s.ticker = gos.NewTicker(repo.Interval)
+				s.last = time.Now()
+				if err := repo.Pull(); err != nil {
+					repo.errLog.log(err)
+				}
+			case <-s.halt:
+				return
+			}
+		}
+
+		// pull deferred to the end of a quiet period
+		var deferred <-chan time.Time
+		pull := func() {
+			if remaining := repo.quietRemaining(); remaining > 0 {
+				if deferred == nil {
+					repo.logger().Printf("%v pull deferred for %v, in quiet period.\n", repo.URL, remaining)
+					deferred = time.After(remaining)
+				}
+				return
+			}
+			s.last = time.Now()
+			if err := repo.Pull(); err != nil {
+				repo.errLog.log(err)
+			}
+		}
+
+		// checks for a suspension of the machine, see slept
+		wake := gos.NewTicker(wakeCheck)
+		s.wall = time.Now().Round(0)
+
+		// no interval ticks for webhook repositories
+		var tick <-chan time.Time
+		if s.ticker != nil {
+			tick = s.ticker.C()
+		}
+
 		for {
 			select {
-			case <-s.ticker.C():
-				err := repo.Pull()
-				if err != nil {
-					Logger().Println(err)
+			case <-tick:
+				if s.due() {
+					pull()
+				}
+			case <-wake.C():
+				// a pull was missed if the machine slept longer than the
+				// interval, or at all for webhooks
+				interval := time.Duration(repo.intervalMultiplier(time.Now())) * repo.Interval
+				if asleep := s.slept(time.Now()); asleep > 0 && (s.hooks || asleep >= interval) {
+					repo.logger().Printf("%v resumed after %v asleep, catch-up pull.\n", repo.URL, asleep.Round(time.Second))
+					pull()
+				}
+			case <-deferred:
+				deferred = nil
+				s.last = time.Now()
+				if err := repo.Pull(); err != nil {
+					repo.errLog.log(err)
 				}
 			case <-s.halt:
-				s.ticker.Stop()
+				if s.ticker != nil {
+					s.ticker.Stop()
+				}
+				wake.Stop()
 				return
 			}
 		}
@@ -46,6 +131,33 @@ func Start(repo *Repo) {
 	Services.add(service)
 }
 
+// slept returns how long the machine was suspended since the last check
+// at s.wall, or zero. Timers do not advance while suspended, so ticks
+// are missed on laptops and edge devices that sleep; the wall clock
+// does advance, and a check that is later by the wall clock than
+// wakeCheck, with some slack, was delayed by a suspension.
+func (s *repoService) slept(now time.Time) time.Duration {
+	now = now.Round(0)
+	gap := now.Sub(s.wall)
+	s.wall = now
+	if gap < 2*wakeCheck {
+		return 0
+	}
+	return gap - wakeCheck
+}
+
+// due checks if the interval pull is due at a tick. While the interval
+// is stretched with a night multiplier, ticks are skipped until the
+// stretched interval has passed since the last interval pull.
+func (s *repoService) due() bool {
+	m := s.repo.intervalMultiplier(time.Now())
+	if m <= 1 || s.last.IsZero() {
+		return true
+	}
+	// ticks may arrive slightly early
+	return gos.TimeSince(s.last) >= time.Duration(m)*s.repo.Interval-s.repo.Interval/2
+}
+
 // services stores all repoServices
 type services struct {
 	services []*repoService
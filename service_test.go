@@ -58,6 +58,14 @@ func TestServices(t *testing.T) {
 		t.Errorf("Expected %v service(s), found %v", 4, len(Services.services))
 	}
 
+	// staggered service can be stopped before its first tick
+	repo = &Repo{URL: "staggered", Interval: time.Hour, Stagger: true}
+	Start(repo)
+	Services.Stop(repo.URL, 1)
+	if len(Services.services) != 4 {
+		t.Errorf("Expected %v service(s), found %v", 4, len(Services.services))
+	}
+
 	for _, repo := range repos {
 		Services.Stop(repo.URL, -1)
 	}
@@ -65,3 +73,69 @@ func TestServices(t *testing.T) {
 		t.Errorf("Expected %v service(s), found %v", 0, len(Services.services))
 	}
 }
+
+func TestServiceDue(t *testing.T) {
+	repo := &Repo{URL: "git@github.com", Interval: time.Minute, NightMultiplier: 4, NightWindow: timeWindow{0, 24 * time.Hour}}
+	s := &repoService{repo: repo}
+
+	tests := []struct {
+		since    time.Duration
+		expected bool
+	}{
+		{0, true},
+		{time.Minute, false},
+		{3 * time.Minute, false},
+		{4 * time.Minute, true},
+	}
+	for i, test := range tests {
+		s.last = time.Time{}
+		if test.since > 0 {
+			s.last = time.Now().Add(-test.since / time.Duration(gittest.TimeSpeed))
+		}
+		if due := s.due(); due != test.expected {
+			t.Errorf("Test %v: expected due %v found %v", i, test.expected, due)
+		}
+	}
+
+	// every tick is due outside the night window
+	repo.NightWindow = timeWindow{}
+	s.last = time.Now()
+	if !s.due() {
+		t.Errorf("Expected tick to be due outside the night window")
+	}
+}
+
+func TestServiceSlept(t *testing.T) {
+	s := &repoService{repo: &Repo{URL: "git@github.com", Interval: time.Minute}}
+	now := time.Now()
+
+	tests := []struct {
+		gap    time.Duration
+		asleep time.Duration
+	}{
+		{wakeCheck, 0},
+		{wakeCheck + 10*time.Second, 0},
+		{time.Hour, time.Hour - wakeCheck},
+	}
+	for i, test := range tests {
+		s.wall = now.Add(-test.gap).Round(0)
+		if asleep := s.slept(now); asleep != test.asleep {
+			t.Errorf("Test %v: expected %v asleep found %v", i, test.asleep, asleep)
+		}
+		if !s.wall.Equal(now) {
+			t.Errorf("Test %v: expected check at %v found %v", i, now, s.wall)
+		}
+	}
+}
+
+func TestStartWakeCheck(t *testing.T) {
+	repo := &Repo{URL: "hooked", Interval: time.Hour, Hook: HookConfig{Url: "/hook"}}
+	StartWakeCheck(repo)
+	if len(Services.services) != 1 || Services.services[0].ticker != nil {
+		t.Errorf("Expected 1 service without interval ticker, found %v", Services.services)
+	}
+	Services.Stop(repo.URL, 1)
+	if len(Services.services) != 0 {
+		t.Errorf("Expected %v service(s), found %v", 0, len(Services.services))
+	}
+}
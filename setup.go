@@ -2,11 +2,17 @@ package git
 
 import (
 	"fmt"
+	"log"
+	"net"
 	"net/url"
+	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mholt/caddy/caddy/setup"
@@ -17,8 +23,46 @@ const (
 	// DefaultInterval is the minimum interval to delay before
 	// requesting another git pull
 	DefaultInterval time.Duration = time.Hour * 1
+
+	// DefaultCommitMessage is the commit message used by
+	// commit_back if no message is set.
+	DefaultCommitMessage = "Update generated files"
+
+	// DefaultBranch is the branch pulled if no branch is configured
+	// and the default branch of the remote cannot be detected.
+	DefaultBranch = "master"
+
+	// DefaultPauseFile is the name of the file that pauses pulling
+	// if pause_file is set without a name.
+	DefaultPauseFile = ".git-pull-disabled"
+
+	// DefaultCommitRetries is the number of pulls retried until HEAD has
+	// the commit of a webhook if hook_verify_commit is set without retries.
+	DefaultCommitRetries = 3
+
+	// DefaultCloneJobs is the number of repositories of a server block
+	// pulled at once at startup if clone_jobs is not set.
+	DefaultCloneJobs = 1
+
+	// DefaultShutdownGrace is the time to wait at shutdown for a
+	// pull in progress to finish.
+	DefaultShutdownGrace = time.Second * 10
+
+	// shallowSinceFormat is the date format of shallow_since.
+	shallowSinceFormat = "2006-01-02"
 )
 
+// dryRun is set to validate the configuration without pulling.
+var dryRun bool
+
+// SetDryRun enables or disables the dry run mode. In dry run mode the
+// configuration is validated, including that the branch exists on the
+// remote, but nothing is cloned, pulled or served. It must be set before
+// the configuration is parsed.
+func SetDryRun(enabled bool) {
+	dryRun = enabled
+}
+
 // Git configures a new Git service routine.
 func Setup(c *setup.Controller) (middleware.Middleware, error) {
 	git, err := parse(c)
@@ -26,66 +70,304 @@ func Setup(c *setup.Controller) (middleware.Middleware, error) {
 		return nil, err
 	}
 
+	// the configuration is valid, nothing else to do
+	if dryRun {
+		for i := range git {
+			Logger().Printf("%v configuration is valid, dry run.\n", git.Repo(i).URL)
+		}
+		return nil, nil
+	}
+
 	// repos configured with webhooks
 	var hookRepos []*Repo
 
+	// repos serving a maintenance page while updating
+	var maintenanceRepos []*Repo
+
+	// repos serving a fallback page while unavailable
+	var fallbackRepos []*Repo
+
+	// repos whose .git directory is not served
+	var gitDirRepos []*Repo
+
+	// path to list all configured repos on
+	var reposEndpoint string
+
+	// path prefix and token of the pause and resume endpoints
+	var pauseEndpoint, pauseToken string
+
+	// path and token of the commit endpoint
+	var commitEndpoint, commitToken string
+
 	// functions to execute at startup
 	var startupFuncs []func() error
 
+	// repos pulled at startup, in order of priority
+	var startupRepos []*Repo
+	cloneJobs := DefaultCloneJobs
+
+	// functions to execute at shutdown
+	shutdownFuncs := []func() error{sockets.close}
+
 	// loop through all repos and and start monitoring
 	for i := range git {
 		repo := git.Repo(i)
 
-		// If a HookUrl is set, we switch to event based pulling.
-		// Install the url handler
-		if repo.Hook.Url != "" {
+		// A repo in dry run mode is only validated.
+		if repo.DryRun {
+			Logger().Printf("%v configuration is valid, dry run.\n", repo.URL)
+			continue
+		}
 
-			hookRepos = append(hookRepos, repo)
+		// Serve the subdirectory of the repo as site root, through
+		// the link in temp and staging mode so only releases are served.
+		if repo.ServeSubdir != "" {
+			root := repo.Path
+			if repo.linkPath != "" {
+				root = repo.linkPath
+			}
+			c.Root = filepath.Join(root, repo.ServeSubdir)
+			Logger().Printf("Serving %v from %v.\n", c.Root, repo.URL)
+		}
 
-			startupFuncs = append(startupFuncs, func() error {
-				return repo.Pull()
-			})
+		if repo.Maintenance {
+			maintenanceRepos = append(maintenanceRepos, repo)
+		}
 
-		} else {
-			startupFuncs = append(startupFuncs, func() error {
+		if repo.Fallback {
+			fallbackRepos = append(fallbackRepos, repo)
+		}
 
-				// Start service routine in background
-				Start(repo)
+		if !repo.ServeGitDir {
+			gitDirRepos = append(gitDirRepos, repo)
+		}
+
+		if repo.ReposEndpoint != "" {
+			reposEndpoint = repo.ReposEndpoint
+		}
+
+		if repo.PauseEndpoint != "" {
+			pauseEndpoint, pauseToken = repo.PauseEndpoint, repo.pauseToken
+		}
+
+		if repo.CommitEndpoint != "" {
+			commitEndpoint, commitToken = repo.CommitEndpoint, repo.commitToken
+		}
+
+		// The limit applies to all repos in all server blocks.
+		if repo.thenConcurrency > 0 {
+			SetThenConcurrency(repo.thenConcurrency)
+		}
+
+		// The limit applies to all repos in the server block.
+		if repo.cloneJobs > 0 {
+			cloneJobs = repo.cloneJobs
+		}
+
+		// Register the repo for PullRepo until shutdown.
+		registry.add(repo)
+		shutdownFuncs = append(shutdownFuncs, func() error {
+			registry.remove(repo)
+			return nil
+		})
+
+		// Let a pull in progress finish at shutdown.
+		shutdownFuncs = append(shutdownFuncs, repo.shutdown)
 
-				// Do a pull right away to return error
-				return repo.Pull()
+		// Remove the links created by alias.
+		if len(repo.Aliases) > 0 {
+			shutdownFuncs = append(shutdownFuncs, repo.removeAliases)
+		}
+
+		// In temp mode, remove the temporary checkout at shutdown.
+		if repo.Temp {
+			shutdownFuncs = append(shutdownFuncs, repo.Cleanup)
+		}
+
+		// If a GCInterval is set, run git gc in background.
+		if repo.GCInterval > 0 {
+			gc := newGCService(repo)
+			startupFuncs = append(startupFuncs, gc.start)
+			shutdownFuncs = append(shutdownFuncs, gc.stop)
+		}
+
+		// If a SocketPath is set, listen for pull requests on it.
+		if repo.SocketPath != "" {
+			startupFuncs = append(startupFuncs, func() error {
+				return sockets.listen(repo.SocketPath, repo)
 			})
 		}
+
+		// If a HookUrl is set, we switch to event based pulling.
+		// Install the url handler
+		if repo.Hook.Url != "" {
+			hookRepos = append(hookRepos, repo)
+		}
+		startupRepos = append(startupRepos, repo)
 	}
 
+	// pull after the other startup functions of the repos
+	startupFuncs = append(startupFuncs, func() error {
+		return startupPulls(startupRepos, cloneJobs)
+	})
+
 	// ensure the functions are executed once per server block
 	// for cases like server1.com, server2.com { ... }
 	c.OncePerServerBlock(func() error {
-		c.Startup = append(c.Startup, startupFuncs...)
+		// nothing to start if all repos are in dry run mode
+		if len(startupRepos) == 0 {
+			return nil
+		}
+		c.Startup = append(c.Startup, func() error {
+			for _, startup := range startupFuncs {
+				if err := startup(); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		c.Shutdown = append(c.Shutdown, shutdownFuncs...)
 		return nil
 	})
 
-	// if there are repo(s) with webhook
-	// return handler
-	if len(hookRepos) > 0 {
-		webhook := &WebHook{Repos: hookRepos}
+	// if there are repo(s) with webhook, maintenance or fallback page,
+	// hidden .git directory, repos, pause or commit endpoint return handler
+	if len(hookRepos) > 0 || len(maintenanceRepos) > 0 || len(fallbackRepos) > 0 || len(gitDirRepos) > 0 || reposEndpoint != "" || pauseEndpoint != "" || commitEndpoint != "" {
+		root := c.Root
 		return func(next middleware.Handler) middleware.Handler {
-			webhook.Next = next
-			return webhook
+			if len(fallbackRepos) > 0 {
+				next = &Fallback{Repos: fallbackRepos, Next: next}
+			}
+			if len(maintenanceRepos) > 0 {
+				next = &Maintenance{Repos: maintenanceRepos, Next: next}
+			}
+			if len(gitDirRepos) > 0 {
+				next = &GitDir{Root: root, Repos: gitDirRepos, Next: next}
+			}
+			if pauseEndpoint != "" {
+				next = &PauseEndpoint{Path: pauseEndpoint, Token: pauseToken, Next: next}
+			}
+			if commitEndpoint != "" {
+				next = &CommitEndpoint{Path: commitEndpoint, Token: commitToken, Next: next}
+			}
+			if reposEndpoint != "" {
+				next = &ReposEndpoint{Path: reposEndpoint, Next: next}
+			}
+			if len(hookRepos) == 0 {
+				return next
+			}
+			return &WebHook{Repos: hookRepos, Next: next}
 		}, err
 	}
 
 	return nil, err
 }
 
+// startupPull does the initial pull of repo. It blocks until the pull
+// completes, so the site is not served before the repository is cloned,
+// unless repo.AsyncStartup is set. If repo.FailOpen is set, a failed pull
+// is logged and retried by the interval or webhook instead of failing
+// startup.
+func startupPull(repo *Repo) error {
+	if repo.fresh() {
+		return nil
+	}
+	if !repo.AsyncStartup {
+		err := repo.Pull()
+		if err != nil && repo.FailOpen {
+			repo.errLog.log(err)
+			return nil
+		}
+		return err
+	}
+	go func() {
+		if err := repo.Pull(); err != nil {
+			repo.errLog.log(err)
+		}
+	}()
+	return nil
+}
+
+// byPriority sorts repos by Priority, highest first.
+type byPriority []*Repo
+
+func (r byPriority) Len() int           { return len(r) }
+func (r byPriority) Less(i, j int) bool { return r[i].Priority > r[j].Priority }
+func (r byPriority) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// startupPulls does the initial pulls of repos in order of priority.
+// Repos of the same priority are pulled at most jobs at once, and repos
+// of a lower priority only once all of them are pulled. Repos without
+// a webhook start pulling at their interval as well.
+func startupPulls(repos []*Repo, jobs int) error {
+	sorted := make(byPriority, len(repos))
+	copy(sorted, repos)
+	sort.Stable(sorted)
+
+	for start := 0; start < len(sorted); {
+		end := start + 1
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			end++
+		}
+		if err := startupTier(sorted[start:end], jobs); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// startupTier does the initial pulls of repos, at most jobs at once.
+// No more pulls are started once one fails.
+func startupTier(repos []*Repo, jobs int) error {
+	slots := &semaphore{slots: make(chan struct{}, jobs)}
+	var errs error
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, repo := range repos {
+		release := slots.acquire()
+		mutex.Lock()
+		failed := errs != nil
+		mutex.Unlock()
+		if failed {
+			release()
+			break
+		}
+
+		wg.Add(1)
+		go func(repo *Repo) {
+			defer wg.Done()
+			defer release()
+
+			// Start service routine in background; webhook
+			// repositories only catch up after a suspension
+			if repo.Hook.Url == "" {
+				Start(repo)
+			} else {
+				StartWakeCheck(repo)
+			}
+			// Do a pull right away to return error
+			err := startupPull(repo)
+			mutex.Lock()
+			errs = mergeErrors(errs, err)
+			mutex.Unlock()
+		}(repo)
+	}
+	wg.Wait()
+	return errs
+}
+
 func parse(c *setup.Controller) (Git, error) {
 	var git Git
 
 	for c.Next() {
-		repo := &Repo{Branch: "master", Interval: DefaultInterval, Path: c.Root}
+		repo := &Repo{Interval: DefaultInterval, Path: c.Root, ShutdownGrace: DefaultShutdownGrace}
 
 		args := c.RemainingArgs()
 
+		// directory of repo configuration files
+		var includeDir string
+
 		switch len(args) {
 		case 2:
 			repo.Path = filepath.Clean(c.Root + string(filepath.Separator) + args[1])
@@ -101,6 +383,11 @@ func parse(c *setup.Controller) (Git, error) {
 					return nil, c.ArgErr()
 				}
 				repo.URL = c.Val()
+			case "id":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.ID = c.Val()
 			case "path":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -116,6 +403,16 @@ func parse(c *setup.Controller) (Git, error) {
 					return nil, c.ArgErr()
 				}
 				repo.KeyPath = c.Val()
+			case "key_passphrase":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.passphrase = c.Val()
+			case "key_passphrase_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.PassphraseFile = c.Val()
 			case "interval":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -124,6 +421,46 @@ func parse(c *setup.Controller) (Git, error) {
 				if t > 0 {
 					repo.Interval = time.Duration(t) * time.Second
 				}
+			case "ssh_agent":
+				repo.SSHAgent = os.Getenv("SSH_AUTH_SOCK")
+				if c.NextArg() {
+					repo.SSHAgent = c.Val()
+				}
+				if repo.SSHAgent == "" {
+					return nil, c.Err("ssh_agent requires SSH_AUTH_SOCK to be set or a socket")
+				}
+			case "clone_timeout", "pull_timeout":
+				directive := c.Val()
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t <= 0 {
+					return nil, c.Errf("invalid %v %v", directive, c.Val())
+				}
+				if directive == "clone_timeout" {
+					repo.CloneTimeout = time.Duration(t) * time.Second
+				} else {
+					repo.PullTimeout = time.Duration(t) * time.Second
+				}
+			case "gc_interval":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t <= 0 {
+					return nil, c.Errf("invalid gc interval %v", c.Val())
+				}
+				repo.GCInterval = time.Duration(t) * time.Second
+			case "shutdown_grace":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t < 0 {
+					return nil, c.Errf("invalid shutdown grace %v", c.Val())
+				}
+				repo.ShutdownGrace = time.Duration(t) * time.Second
 			case "hook":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -134,6 +471,37 @@ func parse(c *setup.Controller) (Git, error) {
 				if c.NextArg() {
 					repo.Hook.Secret = c.Val()
 				}
+			case "trust_payload":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				trust, err := strconv.ParseBool(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid trust_payload %v", c.Val())
+				}
+				repo.Hook.IgnorePayload = !trust
+			case "hook_follow_ref":
+				repo.Hook.FollowRef = true
+			case "hook_verify_commit":
+				repo.Hook.CommitRetries = DefaultCommitRetries
+				if c.NextArg() {
+					retries, err := strconv.Atoi(c.Val())
+					if err != nil || retries <= 0 {
+						return nil, c.Errf("invalid hook_verify_commit retries %v", c.Val())
+					}
+					repo.Hook.CommitRetries = retries
+				}
+			case "hook_secret_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Hook.SecretFile = c.Val()
+			case "hook_client_cert":
+				certs, err := parseClientCerts(c.RemainingArgs())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.Hook.ClientCerts = certs
 			case "hook_type":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
@@ -143,104 +511,1092 @@ func parse(c *setup.Controller) (Git, error) {
 					return nil, c.Errf("invalid hook type %v", t)
 				}
 				repo.Hook.Type = t
-			case "then":
+			case "hook_max_size":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				command := c.Val()
+				size, err := strconv.ParseInt(c.Val(), 10, 64)
+				if err != nil || size <= 0 {
+					return nil, c.Errf("invalid hook max size %v", c.Val())
+				}
+				repo.Hook.MaxSize = size
+			case "hook_delay":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t < 0 {
+					return nil, c.Errf("invalid hook delay %v", c.Val())
+				}
+				repo.Hook.Delay = time.Duration(t) * time.Second
+				if c.NextArg() {
+					retries, err := strconv.Atoi(c.Val())
+					if err != nil || retries < 0 {
+						return nil, c.Errf("invalid hook retries %v", c.Val())
+					}
+					repo.Hook.Retries = retries
+				}
+			case "refspec":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !validRefspec(c.Val()) {
+					return nil, c.Errf("invalid refspec %v", c.Val())
+				}
+				repo.Refspecs = append(repo.Refspecs, c.Val())
+			case "serve_subdir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				dir, err := cleanSubdir("serve_subdir", c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.ServeSubdir = dir
+			case "watch_path":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				path, err := cleanSubdir("watch_path", c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.WatchPath = filepath.ToSlash(path)
+			case "skip_message":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.SkipMessage = c.Val()
+			case "chmod":
 				args := c.RemainingArgs()
-				repo.Then = append(repo.Then, NewThen(command, args...))
-			case "then_long":
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				mode, err := parseMode(args[0])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.FileMode = mode
+				if len(args) == 2 {
+					if mode, err = parseMode(args[1]); err != nil {
+						return nil, c.Err(err.Error())
+					}
+					repo.DirMode = mode
+				}
+			case "then_user":
 				if !c.NextArg() {
 					return nil, c.ArgErr()
 				}
-				command := c.Val()
+				user, err := parseUser(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.thenUser = user
+			case "chown":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				owner, err := parseOwner(c.Val())
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.owner = owner
+			case "verify_manifest":
 				args := c.RemainingArgs()
-				repo.Then = append(repo.Then, NewLongThen(command, args...))
-			default:
-				return nil, c.ArgErr()
-			}
-		}
-
-		// if repo is not specified, return error
-		if repo.URL == "" {
-			return nil, c.ArgErr()
-		}
-
-		// if private key is not specified, convert repository URL to https
-		// to avoid ssh authentication
-		// else validate git URL
-		// Note: private key support not yet available on Windows
-		var err error
-		if repo.KeyPath == "" {
-			repo.URL, repo.Host, err = sanitizeHTTP(repo.URL)
-		} else {
-			repo.URL, repo.Host, err = sanitizeGit(repo.URL)
-			// TODO add Windows support for private repos
-			if runtime.GOOS == "windows" {
-				return nil, fmt.Errorf("private repository not yet supported on Windows")
-			}
-		}
-
-		if err != nil {
-			return nil, err
-		}
-
-		// validate git requirements
-		if err = Init(); err != nil {
-			return nil, err
-		}
-
-		// prepare repo for use
-		if err = repo.Prepare(); err != nil {
-			return nil, err
-		}
-
-		git = append(git, repo)
-
-	}
-
-	return git, nil
-}
-
-// sanitizeHTTP cleans up repository URL and converts to https format
-// if currently in ssh format.
-// Returns sanitized url, hostName (e.g. github.com, bitbucket.com)
-// and possible error
-func sanitizeHTTP(repoURL string) (string, string, error) {
-	url, err := url.Parse(repoURL)
-	if err != nil {
-		return "", "", err
-	}
-
-	if url.Host == "" && strings.HasPrefix(url.Path, "git@") {
-		url.Path = url.Path[len("git@"):]
-		i := strings.Index(url.Path, ":")
-		if i < 0 {
-			return "", "", fmt.Errorf("invalid git url %s", repoURL)
-		}
-		url.Host = url.Path[:i]
-		url.Path = "/" + url.Path[i+1:]
-	}
-
-	if url.User != nil {
-		repoURL = "https://" + url.User.Username() + "@" + url.Host + url.Path
-	} else {
-		// Bitbucket require the user to be set into the HTTP URL
-		if url.Host == "bitbucket.org" {
-			segments := strings.Split(url.Path, "/")
-			repoURL = "https://" + segments[1] + "@" + url.Host + url.Path
-		} else {
-			repoURL = "https://" + url.Host + url.Path
-		}
-	}
-
-	// add .git suffix if missing
-	if !strings.HasSuffix(repoURL, ".git") {
-		repoURL += ".git"
-	}
-
-	return repoURL, url.Host, nil
+				if len(args) != 3 {
+					return nil, c.ArgErr()
+				}
+				if err := repo.setManifest(args[0], args[1], args[2]); err != nil {
+					return nil, c.Err(err.Error())
+				}
+			case "verify":
+				repo.Verify = true
+			case "conflict_strategy":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !validConflictStrategy(c.Val()) {
+					return nil, c.Errf("invalid conflict strategy %v", c.Val())
+				}
+				repo.OnConflict = c.Val()
+			case "allow_force":
+				repo.AllowForce = true
+			case "then_on_error":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if !validThenOnError(c.Val()) {
+					return nil, c.Errf("invalid then_on_error %v, must be fail, continue or stop", c.Val())
+				}
+				repo.ThenOnError = c.Val()
+			case "shallow_since":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				if _, err := time.Parse(shallowSinceFormat, c.Val()); err != nil {
+					return nil, c.Errf("invalid shallow_since date %v, must be YYYY-MM-DD", c.Val())
+				}
+				repo.ShallowSince = c.Val()
+			case "partial":
+				repo.Partial = true
+			case "reference":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Reference = filepath.Clean(c.Val())
+			case "submodule_depth":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				depth, err := strconv.Atoi(c.Val())
+				if err != nil || depth <= 0 {
+					return nil, c.Errf("invalid submodule depth %v", c.Val())
+				}
+				repo.SubmoduleDepth = depth
+			case "submodule_paths":
+				paths := c.RemainingArgs()
+				if len(paths) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, p := range paths {
+					repo.SubmodulePaths = append(repo.SubmodulePaths, filepath.Clean(p))
+				}
+			case "rate_limit":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				rate, err := strconv.Atoi(c.Val())
+				if err != nil || rate <= 0 {
+					return nil, c.Errf("invalid rate limit %v", c.Val())
+				}
+				repo.RateLimit = rate
+			case "fetch_retries":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				retries, err := strconv.Atoi(c.Val())
+				if err != nil || retries < 0 {
+					return nil, c.Errf("invalid fetch retries %v", c.Val())
+				}
+				repo.FetchRetries = retries
+			case "priority":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid priority %v", c.Val())
+				}
+				repo.Priority = n
+			case "clone_jobs":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n <= 0 {
+					return nil, c.Errf("invalid clone jobs %v", c.Val())
+				}
+				repo.cloneJobs = n
+			case "then_concurrency":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n <= 0 {
+					return nil, c.Errf("invalid then concurrency %v", c.Val())
+				}
+				repo.thenConcurrency = n
+			case "strict_host":
+				repo.StrictHost = true
+			case "require_auth_at_startup":
+				repo.RequireAuth = true
+			case "no_tags":
+				repo.NoTags = true
+			case "ignore_paths":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				if err := checkPatterns(args); err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.IgnorePaths = append(repo.IgnorePaths, args...)
+			case "mirror":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				repo.Mirrors = append(repo.Mirrors, args...)
+			case "overlay":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				overlay := Overlay{URL: args[0]}
+				if len(args) == 2 {
+					overlay.Branch = args[1]
+				}
+				repo.Overlays = append(repo.Overlays, overlay)
+			case "socket":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.SocketPath = c.Val()
+			case "ref_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.RefFile = c.Val()
+			case "commit_back":
+				repo.CommitBack = DefaultCommitMessage
+				if args := c.RemainingArgs(); len(args) > 0 {
+					repo.CommitBack = strings.Join(args, " ")
+				}
+			case "maintenance":
+				repo.Maintenance = true
+				if c.NextArg() {
+					repo.MaintenancePage = c.Val()
+				}
+			case "fallback":
+				repo.Fallback = true
+				if c.NextArg() {
+					repo.FallbackPage = c.Val()
+				}
+			case "repos_endpoint":
+				repo.ReposEndpoint = DefaultReposEndpoint
+				if c.NextArg() {
+					repo.ReposEndpoint = path.Clean("/" + c.Val())
+				}
+			case "pause_endpoint":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				repo.pauseToken = args[0]
+				repo.PauseEndpoint = DefaultPauseEndpoint
+				if len(args) == 2 {
+					repo.PauseEndpoint = path.Clean("/" + args[1])
+				}
+			case "commit_endpoint":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				repo.commitToken = args[0]
+				repo.CommitEndpoint = DefaultCommitEndpoint
+				if len(args) == 2 {
+					repo.CommitEndpoint = path.Clean("/" + args[1])
+				}
+			case "paused_hooks":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				switch c.Val() {
+				case "drop":
+					repo.QueueHooks = false
+				case "queue":
+					repo.QueueHooks = true
+				default:
+					return nil, c.Errf("invalid paused_hooks %v, must be drop or queue", c.Val())
+				}
+			case "async_startup":
+				repo.AsyncStartup = true
+			case "skip_if_fresh":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				t, err := strconv.Atoi(c.Val())
+				if err != nil || t <= 0 {
+					return nil, c.Errf("invalid freshness window %v", c.Val())
+				}
+				repo.SkipIfFresh = time.Duration(t) * time.Second
+			case "fail_open":
+				repo.FailOpen = true
+			case "dry_run":
+				repo.DryRun = true
+			case "check_remote":
+				repo.CheckRemote = true
+			case "log_file":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.LogFile = c.Val()
+			case "serve_git_dir":
+				repo.ServeGitDir = true
+			case "on_deploy_webhook":
+				args := c.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				if repo.DeployHook == nil {
+					repo.DeployHook = &DeployHook{}
+				}
+				repo.DeployHook.URL = args[0]
+				if len(args) == 2 {
+					repo.DeployHook.Method = strings.ToUpper(args[1])
+				}
+			case "on_deploy_header":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				if repo.DeployHook == nil {
+					repo.DeployHook = &DeployHook{}
+				}
+				repo.DeployHook.Headers = append(repo.DeployHook.Headers, args[0]+": "+strings.Join(args[1:], " "))
+			case "on_deploy_body":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				if repo.DeployHook == nil {
+					repo.DeployHook = &DeployHook{}
+				}
+				repo.DeployHook.Body = strings.Join(args, " ")
+			case "http_header":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				header, err := httpHeader(args[0], strings.Join(args[1:], " "))
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.HTTPHeaders = append(repo.HTTPHeaders, header)
+			case "stagger":
+				repo.Stagger = true
+			case "raw_url":
+				repo.RawURL = true
+			case "temp":
+				repo.Temp = true
+			case "alias":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Aliases = append(repo.Aliases, filepath.Clean(c.Val()))
+			case "staging":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				repo.Staging = filepath.Clean(c.Val())
+			case "pause_file":
+				repo.PauseFile = DefaultPauseFile
+				if c.NextArg() {
+					repo.PauseFile = c.Val()
+				}
+			case "token_file":
+				t := &tokenFileCredentials{username: oauthUsername}
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 2:
+					t.username = args[1]
+					fallthrough
+				case 1:
+					t.path = args[0]
+				default:
+					return nil, c.ArgErr()
+				}
+				if repo.creds != nil {
+					return nil, c.Err(errMultipleCredentials)
+				}
+				repo.creds = t
+			case "app_password":
+				args := c.RemainingArgs()
+				if len(args) != 2 {
+					return nil, c.ArgErr()
+				}
+				if repo.creds != nil {
+					return nil, c.Err(errMultipleCredentials)
+				}
+				repo.creds = &appPasswordCredentials{username: args[0], password: args[1]}
+			case "oauth":
+				o := &oauthCredentials{}
+				args := c.RemainingArgs()
+				switch len(args) {
+				case 4:
+					o.clientSecret = args[3]
+					fallthrough
+				case 3:
+					o.clientID = args[2]
+					fallthrough
+				case 2:
+					o.tokenURL, o.refreshToken = args[0], args[1]
+				default:
+					return nil, c.ArgErr()
+				}
+				if repo.creds != nil {
+					return nil, c.Err(errMultipleCredentials)
+				}
+				repo.creds = o
+			case "quiet_period":
+				args := c.RemainingArgs()
+				if len(args) == 0 {
+					return nil, c.ArgErr()
+				}
+				for _, arg := range args {
+					w, err := parseTimeWindow(arg)
+					if err != nil {
+						return nil, c.Err(err.Error())
+					}
+					repo.QuietPeriods = append(repo.QuietPeriods, w)
+				}
+			case "night_multiplier":
+				args := c.RemainingArgs()
+				if len(args) < 1 || len(args) > 2 {
+					return nil, c.ArgErr()
+				}
+				m, err := strconv.Atoi(args[0])
+				if err != nil || m < 1 {
+					return nil, c.Errf("invalid night multiplier %v", args[0])
+				}
+				window := DefaultNightWindow
+				if len(args) == 2 {
+					window = args[1]
+				}
+				w, err := parseTimeWindow(window)
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				repo.NightMultiplier, repo.NightWindow = m, w
+			case "timezone":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				loc, err := time.LoadLocation(c.Val())
+				if err != nil {
+					return nil, c.Errf("invalid timezone %v", c.Val())
+				}
+				repo.Timezone = loc
+			case "then":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.Then = append(repo.Then, NewThen(command, args...))
+			case "then_if":
+				args := c.RemainingArgs()
+				if len(args) < 2 {
+					return nil, c.ArgErr()
+				}
+				if _, err := path.Match(args[0], ""); err != nil {
+					return nil, c.Errf("invalid then_if pattern %v", args[0])
+				}
+				repo.Then = append(repo.Then, NewThenIf(args[0], args[1], args[2:]...))
+			case "include_dir":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				includeDir = c.Val()
+			case "pre_pull":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.PrePull = append(repo.PrePull, NewThen(command, args...))
+			case "then_once":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.ThenOnce = append(repo.ThenOnce, NewThen(command, args...))
+			case "then_long":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+				command := c.Val()
+				args := c.RemainingArgs()
+				repo.Then = append(repo.Then, NewLongThen(command, args...))
+			default:
+				return nil, c.ArgErr()
+			}
+		}
+
+		// load the repos in the included directory
+		if includeDir != "" {
+			included, err := git.includeDir(c.Root, includeDir)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			git = append(git, included...)
+			if repo.URL == "" {
+				continue
+			}
+		}
+
+		// if repo is not specified, return error
+		if repo.URL == "" {
+			return nil, c.ArgErr()
+		}
+
+		if err := git.checkHook(repo); err != nil {
+			return nil, err
+		}
+
+		if err := git.setupRepo(repo); err != nil {
+			return nil, err
+		}
+
+		git = append(git, repo)
+
+	}
+
+	return git, nil
+}
+
+// checkPath ensures repo is not configured with the same path as
+// any repository in g, which would cause them to clobber each other.
+func (g Git) checkPath(repo *Repo) error {
+	for _, r := range g {
+		path := r.Path
+		if r.linkPath != "" {
+			path = r.linkPath
+		}
+		if path == repo.Path {
+			return fmt.Errorf("repos %v and %v are configured with the same path %v", r.URL, repo.URL, path)
+		}
+	}
+	return nil
+}
+
+// checkHook normalizes the webhook path of repo to have a leading and
+// no trailing slash, and ensures it is not the same as the webhook path
+// of any repository in g, as the webhook could not tell them apart.
+func (g Git) checkHook(repo *Repo) error {
+	if repo.Hook.Url == "" {
+		return nil
+	}
+	hookPath := path.Clean("/" + repo.Hook.Url)
+	if hookPath == "/" {
+		return fmt.Errorf("invalid hook path %v", repo.Hook.Url)
+	}
+	for _, r := range g {
+		if r.Hook.Url == hookPath {
+			return fmt.Errorf("repos %v and %v are configured with the same hook path %v", r.URL, repo.URL, hookPath)
+		}
+	}
+	repo.Hook.Url = hookPath
+	return nil
+}
+
+// validConflictStrategy checks if strategy is a conflict_strategy option.
+func validConflictStrategy(strategy string) bool {
+	switch strategy {
+	case "abort", "ours", "theirs":
+		return true
+	}
+	return false
+}
+
+// httpHeader returns the header name: value to set as http.extraHeader.
+// Line breaks are rejected as they would break the request.
+func httpHeader(name, value string) (string, error) {
+	if name == "" || strings.ContainsAny(name, ": \t\r\n") || strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("invalid http_header %v", name)
+	}
+	return name + ": " + value, nil
+}
+
+// validThenOnError checks if handling is a then_on_error option.
+func validThenOnError(handling string) bool {
+	switch handling {
+	case "fail", "continue", "stop":
+		return true
+	}
+	return false
+}
+
+// checkPatterns checks the syntax of the ignore_paths patterns.
+func checkPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid ignore_paths pattern %v", pattern)
+		}
+	}
+	return nil
+}
+
+// cleanSubdir cleans dir of the directive name and ensures it is
+// inside the repository path.
+func cleanSubdir(name, dir string) (string, error) {
+	clean := filepath.Clean(dir)
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." ||
+		strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid %v %v, must be inside path", name, dir)
+	}
+	return clean, nil
+}
+
+// isSubpath checks if path is dir or inside it. Relative paths are
+// relative to the working directory.
+func isSubpath(dir, path string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if path, err = filepath.Abs(path); err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// setupRepo validates the configured repo, ensures it does not clash
+// with the repositories in g and prepares it for use.
+func (g Git) setupRepo(repo *Repo) error {
+	// if private key is not specified, convert repository URL to https
+	// to avoid ssh authentication
+	// else validate git URL
+	// Note: private key support not yet available on Windows
+	var err error
+	if repo.ServeSubdir != "" {
+		for _, r := range g {
+			if r.ServeSubdir != "" {
+				return fmt.Errorf("only one repo can set serve_subdir, %v already does", r.URL)
+			}
+		}
+	}
+	if (repo.passphrase != "" || repo.PassphraseFile != "") && repo.KeyPath == "" {
+		return fmt.Errorf("key passphrase requires a private key for %v", repo.URL)
+	}
+	if repo.passphrase != "" && repo.PassphraseFile != "" {
+		return fmt.Errorf("only one of key_passphrase and key_passphrase_file can be used")
+	}
+	if repo.PassphraseFile != "" {
+		if _, err := repo.keyPassphrase(); err != nil {
+			return err
+		}
+	}
+	if repo.KeyPath != "" && repo.creds != nil {
+		return fmt.Errorf("HTTPS credentials cannot be used with a private key for %v", repo.URL)
+	}
+	if repo.SSHAgent != "" && (repo.KeyPath != "" || repo.creds != nil) {
+		return fmt.Errorf("ssh agent cannot be used with a private key or HTTPS credentials for %v", repo.URL)
+	}
+	if t, ok := repo.creds.(*tokenFileCredentials); ok {
+		if _, _, err = t.credentials(); err != nil {
+			return err
+		}
+	}
+	// a local bundle file is pulled from as is
+	if isBundle(repo.URL) {
+		if !filepath.IsAbs(repo.URL) {
+			return fmt.Errorf("bundle %v must be an absolute path", repo.URL)
+		}
+		if repo.KeyPath != "" || repo.SSHAgent != "" || repo.creds != nil || len(repo.Mirrors) > 0 || len(repo.Overlays) > 0 {
+			return fmt.Errorf("bundle %v cannot be used with a key, credentials, mirrors or overlays", repo.URL)
+		}
+		if repo.Partial {
+			return fmt.Errorf("bundle %v cannot be a partial clone", repo.URL)
+		}
+		repo.Bundle = true
+	}
+	for _, alias := range repo.Aliases {
+		if !filepath.IsAbs(alias) {
+			return fmt.Errorf("alias %v must be an absolute path", alias)
+		}
+		if isSubpath(alias, repo.Path) || isSubpath(repo.Path, alias) {
+			return fmt.Errorf("alias %v and path %v cannot contain each other", alias, repo.Path)
+		}
+	}
+	if repo.Reference != "" && !filepath.IsAbs(repo.Reference) {
+		return fmt.Errorf("reference %v must be an absolute path", repo.Reference)
+	}
+	for _, p := range repo.SubmodulePaths {
+		if filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("submodule path %v must be relative to the repository", p)
+		}
+	}
+	// submodule_paths alone checks out the first level
+	if len(repo.SubmodulePaths) > 0 && repo.SubmoduleDepth == 0 {
+		repo.SubmoduleDepth = 1
+	}
+	if runtime.GOOS == "windows" {
+		if repo.thenUser != nil {
+			return fmt.Errorf("then_user is not supported on Windows")
+		}
+		if repo.owner != nil {
+			return fmt.Errorf("chown is not supported on Windows")
+		}
+	}
+	if repo.Staging != "" {
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("staging not supported on Windows")
+		}
+		if repo.Temp {
+			return fmt.Errorf("staging cannot be used with temp for %v", repo.URL)
+		}
+		if isSubpath(repo.Staging, repo.Path) || isSubpath(repo.Path, repo.Staging) {
+			return fmt.Errorf("path %v and staging %v cannot contain each other", repo.Path, repo.Staging)
+		}
+	}
+	if repo.AllowForce && (repo.OnConflict == "ours" || repo.OnConflict == "theirs") {
+		return fmt.Errorf("allow_force cannot be used with conflict_strategy %v", repo.OnConflict)
+	}
+	if len(repo.HTTPHeaders) > 0 && (repo.KeyPath != "" || repo.SSHAgent != "" || repo.Bundle) {
+		return fmt.Errorf("http_header can only be used with HTTPS for %v", repo.URL)
+	}
+	if repo.StrictHost && !repo.RawURL && !repo.Bundle {
+		ssh := repo.KeyPath != "" || repo.SSHAgent != ""
+		for _, u := range append([]string{repo.URL}, repo.Mirrors...) {
+			if err = checkScheme(u, ssh); err != nil {
+				return err
+			}
+		}
+	}
+	if repo.Bundle {
+		repo.Host = ""
+	} else if repo.RawURL {
+		repo.Host = rawURLHost(repo.URL)
+	} else if repo.KeyPath == "" && repo.SSHAgent == "" {
+		repo.URL, repo.Host, err = sanitizeHTTP(repo.URL)
+	} else {
+		repo.URL, repo.Host, err = sanitizeGit(repo.URL)
+	}
+
+	// mirrors are normalized like the repository URL
+	for i := 0; i < len(repo.Mirrors) && err == nil && !repo.RawURL; i++ {
+		if repo.KeyPath == "" && repo.SSHAgent == "" {
+			repo.Mirrors[i], _, err = sanitizeHTTP(repo.Mirrors[i])
+		} else {
+			repo.Mirrors[i], _, err = sanitizeGit(repo.Mirrors[i])
+		}
+	}
+	// and so are overlays
+	for i := 0; i < len(repo.Overlays) && err == nil && !repo.RawURL; i++ {
+		o := &repo.Overlays[i]
+		if repo.KeyPath == "" && repo.SSHAgent == "" {
+			o.URL, _, err = sanitizeHTTP(o.URL)
+		} else {
+			o.URL, _, err = sanitizeGit(o.URL)
+		}
+	}
+
+	if repo.KeyPath != "" {
+		// TODO add Windows support for private repos
+		if runtime.GOOS == "windows" {
+			return fmt.Errorf("private repository not yet supported on Windows")
+		}
+		if err == nil {
+			err = validateKey(repo.KeyPath)
+		}
+	}
+
+	if repo.SSHAgent != "" && err == nil {
+		if _, err = gos.Stat(repo.SSHAgent); err != nil {
+			err = fmt.Errorf("cannot access ssh agent socket %v: %v", repo.SSHAgent, err)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if repo.ID == "" {
+		repo.ID = repo.URL
+	}
+
+	// read the initial ref to clone
+	if repo.RefFile != "" {
+		if _, err = gos.Stat(repo.RefFile); err != nil {
+			return fmt.Errorf("cannot access ref file %v: %v", repo.RefFile, err)
+		}
+		if err = repo.readRefFile(); err != nil {
+			return err
+		}
+	}
+
+	if repo.NoTags && repo.Branch == latestTag {
+		return fmt.Errorf("no_tags cannot be used with %v", latestTag)
+	}
+
+	if repo.ShallowSince != "" && repo.Branch == latestTag {
+		return fmt.Errorf("shallow_since cannot be used with %v", latestTag)
+	}
+
+	if repo.WatchPath != "" && repo.Branch == latestTag {
+		return fmt.Errorf("watch_path cannot be used with %v", latestTag)
+	}
+
+	if repo.SkipMessage != "" && repo.Branch == latestTag {
+		return fmt.Errorf("skip_message cannot be used with %v", latestTag)
+	}
+
+	if len(repo.Overlays) > 0 && repo.CommitBack != "" {
+		return fmt.Errorf("commit_back cannot be used with overlays")
+	}
+
+	// check_remote only sees the branch of the repo, so pushes to an
+	// overlay would never be pulled
+	if len(repo.Overlays) > 0 && repo.CheckRemote {
+		return fmt.Errorf("check_remote cannot be used with overlays")
+	}
+
+	for _, o := range repo.Overlays {
+		if o.Branch == "" && repo.Branch == latestTag {
+			return fmt.Errorf("overlay %v requires a branch with %v", o.URL, latestTag)
+		}
+	}
+
+	if repo.CommitBack != "" && repo.Branch == latestTag {
+		return fmt.Errorf("commit_back cannot push to %v", latestTag)
+	}
+
+	if repo.Hook.FollowRef && (repo.RefFile != "" || repo.Branch == latestTag || repo.Hook.IgnorePayload) {
+		return fmt.Errorf("hook_follow_ref cannot be used with ref_file, %v or trust_payload false", latestTag)
+	}
+
+	if repo.Hook.SecretFile != "" {
+		if repo.Hook.Secret != "" {
+			return fmt.Errorf("only one of hook secret and hook_secret_file can be used")
+		}
+		if _, err = repo.Hook.LoadSecret(); err != nil {
+			return err
+		}
+	}
+
+	if repo.LogFile != "" {
+		f, err := logFiles.open(repo.LogFile)
+		if err != nil {
+			return fmt.Errorf("cannot open log file %v: %v", repo.LogFile, err)
+		}
+		repo.log = log.New(f, "", log.LstdFlags)
+		repo.errLog.l = repo.log
+	}
+
+	if repo.MaintenancePage != "" {
+		if _, err = gos.Stat(repo.MaintenancePage); err != nil {
+			return fmt.Errorf("cannot access maintenance page %v: %v", repo.MaintenancePage, err)
+		}
+	}
+
+	if d := repo.DeployHook; d != nil {
+		if u, e := url.Parse(d.URL); e != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("on_deploy_webhook requires an http or https URL, found %q", d.URL)
+		}
+		if err = d.parse(); err != nil {
+			return err
+		}
+	}
+
+	if repo.FallbackPage != "" {
+		if _, err = gos.Stat(repo.FallbackPage); err != nil {
+			return fmt.Errorf("cannot access fallback page %v: %v", repo.FallbackPage, err)
+		}
+	}
+
+	// validate git requirements
+	if err = Init(); err != nil {
+		return err
+	}
+
+	if repo.RateLimit > 0 {
+		if err = initTrickle(); err != nil {
+			return err
+		}
+	}
+
+	// partial clones are supported since git 2.19
+	if repo.Partial {
+		if err = requireGitVersion("partial", 2, 19); err != nil {
+			return err
+		}
+	}
+
+	// fail before serving if the remote cannot be accessed
+	if repo.RequireAuth {
+		if err = repo.checkAuth(); err != nil {
+			return err
+		}
+	}
+
+	// the path is final once the placeholders are substituted
+	if err = repo.expandPath(); err != nil {
+		return err
+	}
+	if err = g.checkPath(repo); err != nil {
+		return err
+	}
+
+	// nothing is cloned in dry run mode
+	if dryRun || repo.DryRun {
+		if repo.Branch == "" {
+			repo.Branch = repo.defaultBranch()
+		}
+		return repo.checkBranch()
+	}
+
+	// prepare repo for use
+	return repo.Prepare()
+}
+
+// isBundle checks if url is the path of a local git bundle file rather
+// than the URL of a remote. Bundle files have the .bundle extension.
+func isBundle(url string) bool {
+	if !strings.HasSuffix(url, ".bundle") || strings.Contains(url, "://") {
+		return false
+	}
+	// scp-like URLs, e.g. git@host:repo.bundle, are remotes
+	return filepath.IsAbs(url) || !strings.Contains(url, ":")
+}
+
+// validRefspec checks if refspec is a well-formed fetch refspec
+// in the format [+]<src>[:<dst>].
+func validRefspec(refspec string) bool {
+	refspec = strings.TrimPrefix(refspec, "+")
+	if refspec == "" || strings.ContainsAny(refspec, " \t~^?[\\") || strings.Contains(refspec, "..") {
+		return false
+	}
+	sides := strings.Split(refspec, ":")
+	if len(sides) > 2 {
+		return false
+	}
+	globs := 0
+	for _, side := range sides {
+		if side == "" || strings.Count(side, "*") > 1 {
+			return false
+		}
+		globs += strings.Count(side, "*")
+	}
+	// a pattern must be used on both sides
+	if len(sides) == 2 && globs == 1 {
+		return false
+	}
+	return true
+}
+
+// validateKey checks that the private key at keyPath exists, is a regular
+// file and is not accessible by group or others, as ssh rejects such keys.
+func validateKey(keyPath string) error {
+	path := keyPath
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(os.Getenv("HOME"), path[len("~/"):])
+	}
+
+	info, err := gos.Stat(path)
+	if err != nil {
+		return fmt.Errorf("cannot access private key %v: %v", keyPath, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("private key %v is not a regular file", keyPath)
+	}
+	if perm := info.Mode().Perm(); perm&0077 != 0 {
+		return fmt.Errorf("permissions %v for private key %v are too open, ssh requires it to be accessible only by owner e.g. chmod 600 %v", perm, keyPath, keyPath)
+	}
+	return nil
+}
+
+// rawURLHost retrieves the host of a repository URL that is not
+// normalized, if possible. Returns empty string if the host
+// cannot be determined.
+func rawURLHost(repoURL string) string {
+	// remote helper URLs in the format <transport>::<address>
+	if i := strings.Index(repoURL, "::"); i >= 0 {
+		return rawURLHost(repoURL[i+len("::"):])
+	}
+
+	if url, err := url.Parse(repoURL); err == nil && url.Host != "" {
+		if host, _, err := net.SplitHostPort(url.Host); err == nil {
+			return host
+		}
+		return url.Host
+	}
+
+	// scp-like URLs in the format [user@]host:path
+	if i := strings.Index(repoURL, ":"); i > 0 && !strings.Contains(repoURL[:i], "/") {
+		host := repoURL[:i]
+		return host[strings.LastIndex(host, "@")+1:]
+	}
+	return ""
+}
+
+// checkScheme checks that repoURL is an ssh URL if ssh is set, or an
+// HTTP(S) URL otherwise, for strict_host. URLs without a scheme, e.g.
+// github.com/user/repo, are accepted either way.
+func checkScheme(repoURL string, ssh bool) error {
+	rawURL := strings.TrimSpace(repoURL)
+	isSSH := strings.HasPrefix(rawURL, "ssh://")
+	isHTTP := strings.HasPrefix(rawURL, "http://") || strings.HasPrefix(rawURL, "https://")
+	if i := strings.Index(rawURL, ":"); !strings.Contains(rawURL, "://") && i > 0 && !strings.Contains(rawURL[:i], "/") {
+		// scp-like ssh url e.g. git@github.com:user/repo
+		isSSH = true
+	}
+
+	switch {
+	case isSSH && !ssh:
+		return fmt.Errorf("ssh url %v requires key or ssh_agent with strict_host", repoURL)
+	case isHTTP && ssh:
+		return fmt.Errorf("https url %v cannot be used with key or ssh_agent with strict_host", repoURL)
+	}
+	return nil
+}
+
+// sanitizeHTTP cleans up repository URL and converts to https format
+// if currently in ssh format.
+// Returns sanitized url, hostName (e.g. github.com, bitbucket.com)
+// and possible error
+func sanitizeHTTP(repoURL string) (string, string, error) {
+	rawURL := strings.TrimSpace(repoURL)
+
+	if !strings.Contains(rawURL, "://") {
+		i := strings.Index(rawURL, ":")
+		switch {
+		case i > 0 && !strings.Contains(rawURL[:i], "/"):
+			// scp-like ssh url e.g. git@github.com:user/repo
+			rawURL = "ssh://" + rawURL[:i] + "/" + strings.TrimPrefix(rawURL[i+1:], "/")
+		case strings.HasPrefix(rawURL, "git@"):
+			return "", "", fmt.Errorf("invalid git url %s", repoURL)
+		default:
+			// url without scheme e.g. github.com/user/repo
+			rawURL = "https://" + rawURL
+		}
+	}
+
+	url, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	// keep all path segments e.g. GitLab subgroups /group/subgroup/repo
+	repoPath := strings.TrimSuffix(path.Clean("/"+url.EscapedPath()), "/")
+	if url.Host == "" || repoPath == "" {
+		return "", "", fmt.Errorf("invalid git url %s", repoURL)
+	}
+
+	host := url.Host
+	if url.Scheme != "http" && url.Scheme != "https" {
+		// the ssh user and port do not apply to https
+		if h, port, err := net.SplitHostPort(url.Host); err == nil {
+			host = h
+			// Bitbucket Server serves ssh on port 7999 and
+			// https repositories under /scm
+			if port == "7999" && !strings.HasPrefix(repoPath, "/scm/") {
+				repoPath = "/scm" + repoPath
+			}
+		}
+		url.User = nil
+	}
+
+	if url.User != nil {
+		repoURL = "https://" + url.User.Username() + "@" + host + repoPath
+	} else {
+		// Bitbucket require the user to be set into the HTTP URL
+		if host == "bitbucket.org" {
+			segments := strings.Split(repoPath, "/")
+			repoURL = "https://" + segments[1] + "@" + host + repoPath
+		} else {
+			repoURL = "https://" + host + repoPath
+		}
+	}
+
+	// add .git suffix if missing
+	if !strings.HasSuffix(repoURL, ".git") {
+		repoURL += ".git"
+	}
+
+	return repoURL, host, nil
 }
 
 // sanitizeGit cleans up repository url and converts to ssh format for private
@@ -1,8 +1,11 @@
 package git
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -17,13 +20,198 @@ func init() {
 }
 
 func TestGitSetup(t *testing.T) {
-	c := setup.NewTestController(`git git@github.com:mholt/caddy.git`)
+	c := setup.NewTestController(`git git@github.com:mholt/caddy.git {
+		serve_git_dir
+	}`)
 
 	mid, err := Setup(c)
 	check(t, err)
 	if mid != nil {
 		t.Fatal("Git middleware is a background service and expected to be nil.")
 	}
+
+	// the .git directory is hidden by default
+	c = setup.NewTestController(`git git@github.com:mholt/caddy.git`)
+	mid, err = Setup(c)
+	check(t, err)
+	if mid == nil {
+		t.Fatal("Expected middleware to hide the .git directory.")
+	}
+}
+
+func TestServeSubdirRoot(t *testing.T) {
+	c := setup.NewTestController(`git git@github.com:user/repo site {
+		serve_subdir public
+	}`)
+	c.Root = "root"
+
+	_, err := Setup(c)
+	check(t, err)
+	expected := filepath.Join("root", "site", "public")
+	if c.Root != expected {
+		t.Errorf("Expected root %v found %v", expected, c.Root)
+	}
+
+	// the published release is served in staging mode
+	defer func() {
+		gittest.Symlinks = map[string]string{}
+		gittest.Renames = map[string]string{}
+	}()
+	c = setup.NewTestController(`git git@github.com:user/repo staged {
+		serve_subdir public
+		staging /var/lib/caddy-git/staged
+	}`)
+	c.Root = "root"
+	_, err = Setup(c)
+	check(t, err)
+	expected = filepath.Join("root", "staged", "public")
+	if c.Root != expected {
+		t.Errorf("Expected root %v found %v", expected, c.Root)
+	}
+}
+
+func TestRequireAuth(t *testing.T) {
+	input := `git https://github.com/user/repo {
+		require_auth_at_startup
+	}`
+	_, err := parse(setup.NewTestController(input))
+	check(t, err)
+
+	gittest.CmdErrors["ls-remote --heads https://github.com/user/repo.git"] = errors.New("exit status 128")
+	defer delete(gittest.CmdErrors, "ls-remote --heads https://github.com/user/repo.git")
+	_, err = parse(setup.NewTestController(input))
+	if err == nil || !strings.Contains(err.Error(), "cannot access https://github.com/user/repo.git") {
+		t.Errorf("Expected access error found %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer delete(gittest.CmdOutputs, "ls-remote")
+	input := `git https://github.com/user/repo newdir {
+		branch main
+		dry_run
+	}`
+
+	gittest.CmdOutputs["ls-remote"] = "3f4e5d6c7b8a9f0e\trefs/heads/main"
+	c := setup.NewTestController(input)
+	mid, err := Setup(c)
+	check(t, err)
+	if mid != nil || len(c.Startup) != 0 {
+		t.Errorf("Expected nothing to be served or pulled in dry run mode")
+	}
+	if dryRun {
+		t.Errorf("Expected dry_run to apply to its repo only")
+	}
+
+	// the other repos are set up as usual
+	c = setup.NewTestController(input + `
+	git https://github.com/user/other otherdir`)
+	_, err = Setup(c)
+	check(t, err)
+	if len(c.Startup) != 1 {
+		t.Errorf("Expected the other repo to be pulled at startup found %v startup functions", len(c.Startup))
+	}
+
+	gittest.CmdOutputs["ls-remote"] = ""
+	_, err = Setup(setup.NewTestController(input))
+	if !errors.Is(err, ErrBranchNotFound) || !strings.Contains(err.Error(), "main is not in") {
+		t.Errorf("Expected missing branch error found %v", err)
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	defer delete(gittest.CmdErrors, "pull origin master")
+	SetLogger(gittest.NewLogger(gittest.Open("file")))
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	gittest.CmdErrors["pull origin master"] = errors.New("exit status 1")
+	if err := startupPull(repo); err == nil {
+		t.Errorf("Expected initial pull error to fail startup")
+	}
+
+	repo.FailOpen = true
+	gittest.Sleep(time.Second * 5)
+	if err := startupPull(repo); err != nil {
+		t.Errorf("Expected startup to proceed with fail_open found %v", err)
+	}
+}
+
+func TestSkipIfFresh(t *testing.T) {
+	fetchHead := "gitdir/.git/FETCH_HEAD"
+	defer delete(gittest.ModTimes, fetchHead)
+	// HEAD defaults to the start of the hour, which may be fresh
+	head := "gitdir/.git/HEAD"
+	gittest.ModTimes[head] = time.Now().Add(-24 * time.Hour)
+	defer delete(gittest.ModTimes, head)
+	defer delete(gittest.CmdOutputs, "--no-pager")
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.SkipIfFresh = time.Hour
+	gittest.CmdOutput = repo.URL
+	gittest.CmdOutputs["--no-pager"] = "a1b2c3"
+	check(t, repo.Prepare())
+
+	tests := []struct {
+		updated time.Time
+		skipped bool
+	}{
+		{time.Now().Add(-24 * time.Hour), false},
+		{time.Now().Add(-time.Hour), false},
+		{time.Now().Add(-time.Minute), true},
+	}
+	for i, test := range tests {
+		gittest.ModTimes[fetchHead] = test.updated
+		repo.lastPull = time.Time{}
+		gittest.ResetCommands()
+		check(t, startupPull(repo))
+		pulled := strings.Contains(fmt.Sprint(gittest.Commands()), "pull origin master")
+		if pulled == test.skipped {
+			t.Errorf("Test %v: expected skipped %v found commands %v", i, test.skipped, gittest.Commands())
+		}
+		if test.skipped && repo.lastCommit != "a1b2c3" {
+			t.Errorf("Test %v: expected last commit a1b2c3 found %v", i, repo.lastCommit)
+		}
+	}
+}
+
+func TestStartupPulls(t *testing.T) {
+	var repos []*Repo
+	for _, branch := range []string{"low", "main", "other", "docs"} {
+		repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git", Branch: branch})
+		repo.Hook.Url = "/deploy"
+		gittest.CmdOutput = repo.URL
+		check(t, repo.Prepare())
+		repos = append(repos, repo)
+	}
+	repos[0].Priority = -1
+	repos[1].Priority = 10
+
+	gittest.Sleep(time.Second * 5)
+	gittest.ResetCommands()
+	check(t, startupPulls(repos, 1))
+	var order []string
+	for _, command := range gittest.Commands() {
+		if strings.HasPrefix(command, "pull origin ") {
+			order = append(order, strings.TrimPrefix(command, "pull origin "))
+		}
+	}
+	if fmt.Sprint(order) != "[main other docs low]" {
+		t.Errorf("Expected pulls in order of priority found %v", order)
+	}
+
+	defer delete(gittest.CmdErrors, "pull origin main")
+	gittest.CmdErrors["pull origin main"] = errors.New("exit status 1")
+	gittest.Sleep(time.Second * 5)
+	gittest.ResetCommands()
+	if err := startupPulls(repos, 2); err == nil {
+		t.Errorf("Expected error of the failed pull")
+	}
+	if commands := fmt.Sprint(gittest.Commands()); strings.Contains(commands, "pull origin other") {
+		t.Errorf("Expected lower priority repos not to be pulled found %v", commands)
+	}
 }
 
 func TestIntervals(t *testing.T) {
@@ -80,14 +268,20 @@ No new changes.`
 			}
 		}
 
-		// stop background thread monitor
-		Services.Stop(repo.URL, 1)
+		// stop background thread monitor, and those of earlier tests
+		// with the same url, e.g. wake checks of webhook repos
+		Services.Stop(repo.URL, -1)
 
 	}
 
 }
 
 func TestGitParse(t *testing.T) {
+	gittest.FileContents["/etc/site/version"] = "v1.2.0\n"
+	defer delete(gittest.FileContents, "/etc/site/version")
+	gittest.FileContents["/run/secrets/hook"] = "supersecret\n"
+	defer delete(gittest.FileContents, "/run/secrets/hook")
+
 	tests := []struct {
 		input     string
 		shouldErr bool
@@ -118,6 +312,26 @@ func TestGitParse(t *testing.T) {
 			KeyPath: "~/.key",
 			URL:     "git@github.com:user/repo.git",
 		}},
+		{`git git@github.com:user/repo {
+			key ~/.key
+			key_passphrase "correct horse"
+		}`, false, &Repo{
+			KeyPath:    "~/.key",
+			URL:        "git@github.com:user/repo.git",
+			passphrase: "correct horse",
+		}},
+		{`git git@github.com:user/repo {
+			key_passphrase secret
+		}`, true, nil},
+		{`git git@github.com:user/repo {
+			key ~/.key
+			key_passphrase_file /etc/keys/missing
+		}`, true, nil},
+		{`git git@github.com:user/repo {
+			key ~/.key
+			key_passphrase secret
+			key_passphrase_file /etc/keys/missing
+		}`, true, nil},
 		{`git `, true, nil},
 		{`git {
 		}`, true, nil},
@@ -173,53 +387,923 @@ func TestGitParse(t *testing.T) {
 			KeyPath: "~/.key",
 			URL:     "git@bitbucket.org:user/repo.git",
 		}},
-	}
-
-	for i, test := range tests {
-		c := setup.NewTestController(test.input)
-		git, err := parse(c)
-		if !test.shouldErr && err != nil {
-			t.Errorf("Test %v should not error but found %v", i, err)
-			continue
-		}
-		if test.shouldErr && err == nil {
-			t.Errorf("Test %v should error but found nil", i)
-			continue
-		}
-		repo := git.Repo(0)
-		if !reposEqual(test.expected, repo) {
-			t.Errorf("Test %v expects %v but found %v", i, test.expected, repo)
-		}
-	}
-}
-
-func reposEqual(expected, repo *Repo) bool {
-	thenStr := func(then []Then) string {
-		var str []string
-		for _, t := range then {
-			str = append(str, t.Command())
+		{`git http://github.com/user/repo {
+			key openkey
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			refspec +refs/heads/*:refs/remotes/origin/*
+			refspec refs/tags/v1
+		}`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			Refspecs: []string{"+refs/heads/*:refs/remotes/origin/*", "refs/tags/v1"},
+		}},
+		{`git http://github.com/user/repo {
+			refspec refs/heads/*:refs/remotes/origin/master
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			refspec refs/heads/master:refs/remotes/origin/master:x
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			refspec
+		}`, true, nil},
+		{`git http://github.com/user/repo /site
+		git http://github.com/user/other /site`, true, nil},
+		{`git http://github.com/user/repo {
+			hook webhook/
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/webhook"},
+		}},
+		{`git http://github.com/user/repo {
+			hook /
+		}`, true, nil},
+		{`git http://github.com/user/repo /site {
+			hook /webhook
 		}
-		return fmt.Sprint(str)
-	}
-	if expected == nil {
-		return repo == nil
-	}
-	if expected.Branch != "" && expected.Branch != repo.Branch {
-		return false
-	}
-	if expected.Host != "" && expected.Host != repo.Host {
-		return false
-	}
-	if expected.Interval != 0 && expected.Interval != repo.Interval {
-		return false
-	}
-	if expected.KeyPath != "" && expected.KeyPath != repo.KeyPath {
-		return false
-	}
-	if expected.Path != "" && expected.Path != repo.Path {
-		return false
-	}
-	if expected.Then != nil && thenStr(expected.Then) != thenStr(repo.Then) {
+		git http://github.com/user/other /other {
+			hook webhook/
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			oauth https://example.com/token refresh-token client-id
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+		}},
+		{`git http://github.com/user/repo {
+			oauth https://example.com/token
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			key ~/.key
+			oauth https://example.com/token refresh-token
+		}`, true, nil},
+		{`git example::https://git.example.com:8443/repo {
+			raw_url
+		}`, false, &Repo{
+			URL:  "example::https://git.example.com:8443/repo",
+			Host: "git.example.com",
+		}},
+		{`git s3://bucket/repo {
+			raw_url
+		}`, false, &Repo{
+			URL:  "s3://bucket/repo",
+			Host: "bucket",
+		}},
+		{`git deploy@git.example.com:repo {
+			raw_url
+			key ~/.key
+		}`, false, &Repo{
+			URL:     "deploy@git.example.com:repo",
+			Host:    "git.example.com",
+			KeyPath: "~/.key",
+		}},
+		{`git http://github.com/user/repo {
+			hook /webhook
+			async_startup
+		}`, false, &Repo{
+			URL:          "https://github.com/user/repo.git",
+			Hook:         HookConfig{Url: "/webhook"},
+			AsyncStartup: true,
+		}},
+		{`git /srv/updates/site.bundle`, false, &Repo{
+			URL:    "/srv/updates/site.bundle",
+			Bundle: true,
+		}},
+		{`git updates/site.bundle`, true, nil},
+		{`git /srv/updates/site.bundle {
+			key ~/.key
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			fail_open
+		}`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			FailOpen: true,
+		}},
+		{`git http://github.com/user/repo {
+			log_file /var/log/caddy/site.log
+		}`, false, &Repo{
+			URL:     "https://github.com/user/repo.git",
+			LogFile: "/var/log/caddy/site.log",
+		}},
+		{`git http://github.com/user/repo {
+			log_file
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			on_deploy_webhook https://apm.example.com/markers put
+			on_deploy_header Authorization Bearer {{.ID}}
+			on_deploy_body {{json .NewCommit}}
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+			DeployHook: &DeployHook{
+				URL:     "https://apm.example.com/markers",
+				Method:  "PUT",
+				Headers: []string{"Authorization: Bearer {{.ID}}"},
+				Body:    "{{json .NewCommit}}",
+			},
+		}},
+		{`git http://github.com/user/repo {
+			on_deploy_header X-Deploy {{.ID}}
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			on_deploy_webhook /markers
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			then_user root
+		}`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			thenUser: &fileOwner{0, 0},
+		}},
+		{`git http://github.com/user/repo {
+			then_user no-such-user-caddy-git
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			fallback
+		}`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			Fallback: true,
+		}},
+		{`git http://github.com/user/repo {
+			maintenance page.html
+		}`, false, &Repo{
+			URL:             "https://github.com/user/repo.git",
+			Maintenance:     true,
+			MaintenancePage: "page.html",
+		}},
+		{`git {
+			include_dir git.d
+		}`, false, nil},
+		{`git http://github.com/user/repo {
+			mirror gitlab.com/user/repo
+			mirror https://mirror.example.com/git/repo https://backup.example.com/repo
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+			Mirrors: []string{
+				"https://gitlab.com/user/repo.git",
+				"https://mirror.example.com/git/repo.git",
+				"https://backup.example.com/repo.git",
+			},
+		}},
+		{`git http://github.com/user/repo {
+			mirror
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			serve_subdir public/
+		}`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			ServeSubdir: "public",
+		}},
+		{`git http://github.com/user/repo {
+			serve_subdir ../public
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			watch_path content/./manifest.json
+		}`, false, &Repo{
+			URL:       "https://github.com/user/repo.git",
+			WatchPath: "content/manifest.json",
+		}},
+		{`git http://github.com/user/repo {
+			watch_path /manifest.json
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			skip_message "[skip deploy]"
+		}`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			SkipMessage: "[skip deploy]",
+		}},
+		{`git http://github.com/user/repo {
+			branch {latest}
+			skip_message "[skip deploy]"
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			rate_limit 512
+		}`, false, &Repo{
+			URL:       "https://github.com/user/repo.git",
+			RateLimit: 512,
+		}},
+		{`git http://github.com/user/repo {
+			rate_limit 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			fetch_retries 2
+		}`, false, &Repo{
+			URL:          "https://github.com/user/repo.git",
+			FetchRetries: 2,
+		}},
+		{`git http://github.com/user/repo {
+			fetch_retries -1
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			reference /var/cache/git/upstream.git/
+		}`, false, &Repo{
+			URL:       "https://github.com/user/repo.git",
+			Reference: "/var/cache/git/upstream.git",
+		}},
+		{`git http://github.com/user/repo {
+			reference upstream.git
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			submodule_depth 2
+		}`, false, &Repo{
+			URL:            "https://github.com/user/repo.git",
+			SubmoduleDepth: 2,
+		}},
+		{`git http://github.com/user/repo {
+			submodule_paths themes/base/ vendor/lib
+		}`, false, &Repo{
+			URL:            "https://github.com/user/repo.git",
+			SubmoduleDepth: 1,
+			SubmodulePaths: []string{"themes/base", "vendor/lib"},
+		}},
+		{`git http://github.com/user/repo {
+			submodule_depth 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			submodule_paths ../other
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			alias /var/www/current
+			alias /var/www/site
+		}`, false, &Repo{
+			URL:     "https://github.com/user/repo.git",
+			Aliases: []string{"/var/www/current", "/var/www/site"},
+		}},
+		{`git http://github.com/user/repo {
+			alias current
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			skip_if_fresh 600
+		}`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			SkipIfFresh: 10 * time.Minute,
+		}},
+		{`git http://github.com/user/repo {
+			skip_if_fresh 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			night_multiplier 4
+		}`, false, &Repo{
+			URL:             "https://github.com/user/repo.git",
+			NightMultiplier: 4,
+		}},
+		{`git http://github.com/user/repo {
+			night_multiplier 4 01:00-05:00
+		}`, false, &Repo{
+			URL:             "https://github.com/user/repo.git",
+			NightMultiplier: 4,
+		}},
+		{`git http://github.com/user/repo {
+			night_multiplier 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			night_multiplier 4 night
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			conflict_strategy theirs
+		}`, false, &Repo{
+			URL:        "https://github.com/user/repo.git",
+			OnConflict: "theirs",
+		}},
+		{`git http://github.com/user/repo {
+			conflict_strategy rebase
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			allow_force
+		}`, false, &Repo{
+			URL:        "https://github.com/user/repo.git",
+			AllowForce: true,
+		}},
+		{`git http://github.com/user/repo {
+			allow_force
+			conflict_strategy ours
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			path /srv/site
+			staging /var/lib/caddy-git/site/
+		}`, false, &Repo{
+			URL:     "https://github.com/user/repo.git",
+			Staging: "/var/lib/caddy-git/site",
+		}},
+		{`git http://github.com/user/repo {
+			path site
+			staging .
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			path /srv/site
+			staging /var/lib/caddy-git/site
+			temp
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			staging
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			then_on_error continue
+		}`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			ThenOnError: "continue",
+		}},
+		{`git http://github.com/user/repo {
+			then_on_error ignore
+		}`, true, nil},
+		{`git https://proxy.example.com/user/repo {
+			http_header X-Proxy-Token abc123
+			http_header Authorization Bearer xyz
+		}`, false, &Repo{
+			URL:         "https://proxy.example.com/user/repo.git",
+			HTTPHeaders: []string{"X-Proxy-Token: abc123", "Authorization: Bearer xyz"},
+		}},
+		{`git https://proxy.example.com/user/repo {
+			http_header X-Proxy-Token
+		}`, true, nil},
+		{`git https://proxy.example.com/user/repo {
+			http_header X-Proxy:Token abc123
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			pre_pull
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			then_concurrency 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			priority 10
+			clone_jobs 4
+		}`, false, &Repo{
+			URL:      "https://github.com/user/repo.git",
+			Priority: 10,
+		}},
+		{`git http://github.com/user/repo {
+			priority high
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			then_if docs/** make docs
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Then: []Then{NewThenIf("docs/**", "make", "docs")},
+		}},
+		{`git http://github.com/user/repo {
+			then_if docs/**
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			overlay https://github.com/user/overlay
+			overlay github.com/user/theme main
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+			Overlays: []Overlay{
+				{URL: "https://github.com/user/overlay.git"},
+				{URL: "https://github.com/user/theme.git", Branch: "main"},
+			},
+		}},
+		{`git http://github.com/user/repo {
+			overlay
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			overlay https://github.com/user/overlay
+			commit_back
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			overlay https://github.com/user/overlay
+			check_remote
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			branch {latest}
+			overlay https://github.com/user/overlay
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			check_remote
+		}`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			CheckRemote: true,
+		}},
+		{`git http://github.com/user/repo {
+			then_if [docs make docs
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			clone_jobs 0
+		}`, true, nil},
+		{`git git@github.com:user/repo {
+			strict_host
+		}`, true, nil},
+		{`git ssh://git@github.com/user/repo {
+			strict_host
+		}`, true, nil},
+		{`git https://github.com/user/repo {
+			strict_host
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+		}},
+		{`git git@github.com:user/repo {
+			key ~/.key
+			strict_host
+		}`, false, &Repo{
+			URL: "git@github.com:user/repo.git",
+		}},
+		{`git https://github.com/user/repo {
+			key ~/.key
+			strict_host
+		}`, true, nil},
+		{`git https://github.com/user/repo {
+			mirror git@gitlab.com:user/repo
+			strict_host
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			shutdown_grace 0
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+		}},
+		{`git http://github.com/user/repo {
+			shutdown_grace -1
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			shallow_since 2025-01-31
+		}`, false, &Repo{
+			URL:          "https://github.com/user/repo.git",
+			ShallowSince: "2025-01-31",
+		}},
+		{`git http://github.com/user/repo {
+			shallow_since 1.year.ago
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			verify_manifest MANIFEST
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			verify_manifest ../MANIFEST MANIFEST.sig manifest.pub
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			partial
+		}`, false, &Repo{
+			URL:     "https://github.com/user/repo.git",
+			Partial: true,
+		}},
+		{`git /srv/updates/site.bundle {
+			partial
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			branch {latest}
+			shallow_since 2025-01-31
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			repos_endpoint
+		}`, false, &Repo{
+			URL:           "https://github.com/user/repo.git",
+			ReposEndpoint: "/git/repos",
+		}},
+		{`git http://github.com/user/repo {
+			repos_endpoint admin/repos/
+		}`, false, &Repo{
+			URL:           "https://github.com/user/repo.git",
+			ReposEndpoint: "/admin/repos",
+		}},
+		{`git http://github.com/user/repo {
+			pause_endpoint supersecret admin
+			paused_hooks queue
+		}`, false, &Repo{
+			URL:           "https://github.com/user/repo.git",
+			PauseEndpoint: "/admin",
+			pauseToken:    "supersecret",
+			QueueHooks:    true,
+		}},
+		{`git http://github.com/user/repo {
+			pause_endpoint
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			commit_endpoint supersecret
+		}`, false, &Repo{
+			URL:            "https://github.com/user/repo.git",
+			CommitEndpoint: "/git/commit",
+			commitToken:    "supersecret",
+		}},
+		{`git http://github.com/user/repo {
+			commit_endpoint supersecret cdn/commit extra
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			paused_hooks later
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_secret_file /run/secrets/hook
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/hook", SecretFile: "/run/secrets/hook"},
+		}},
+		{`git http://github.com/user/repo {
+			hook /hook supersecret
+			hook_secret_file /run/secrets/hook
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_client_cert sha256:00112233445566778899AABBCCDDEEFF00112233445566778899aabbccddeeff
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/hook", ClientCerts: &ClientCerts{Fingerprints: [][sha256.Size]byte{{
+				0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+				0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+			}}}},
+		}},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_client_cert
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_client_cert sha256:0011
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_client_cert /etc/caddy/missing-ca.pem
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook supersecret
+			trust_payload false
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/hook", Secret: "supersecret", IgnorePayload: true},
+		}},
+		{`git http://github.com/user/repo {
+			hook /hook supersecret
+			trust_payload maybe
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_follow_ref
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/hook", FollowRef: true},
+		}},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_follow_ref
+			branch {latest}
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_verify_commit
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/hook", CommitRetries: DefaultCommitRetries},
+		}},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_verify_commit 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /hook
+			hook_secret_file /run/secrets/missing
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			ignore_paths CHANGELOG.md
+			ignore_paths docs/* *.txt
+		}`, false, &Repo{
+			URL:         "https://github.com/user/repo.git",
+			IgnorePaths: []string{"CHANGELOG.md", "docs/*", "*.txt"},
+		}},
+		{`git http://github.com/user/repo {
+			ignore_paths [
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			branch {latest}
+			watch_path manifest.json
+		}`, true, nil},
+		{`git http://github.com/user/repo /a {
+			serve_subdir public
+		}
+		git http://github.com/user/other /b {
+			serve_subdir public
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			clone_timeout 600
+			pull_timeout 30
+		}`, false, &Repo{
+			URL:          "https://github.com/user/repo.git",
+			CloneTimeout: time.Minute * 10,
+			PullTimeout:  time.Second * 30,
+		}},
+		{`git http://github.com/user/repo {
+			pull_timeout 0
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			no_tags
+		}`, false, &Repo{
+			URL:    "https://github.com/user/repo.git",
+			NoTags: true,
+		}},
+		{`git http://github.com/user/repo {
+			branch {latest}
+			no_tags
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			token_file /run/secrets/missing
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			token_file /run/secrets/token x-access-token
+			oauth https://example.com/token refresh
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			app_password user
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			app_password user secret
+			token_file /run/secrets/token
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			ssh_agent /run/agent.sock
+		}`, false, &Repo{
+			URL:      "git@github.com:user/repo.git",
+			SSHAgent: "/run/agent.sock",
+		}},
+		{`git http://github.com/user/repo {
+			ssh_agent /run/agent.sock
+			key ~/.key
+		}`, true, nil},
+		{`git {
+			include_dir
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			ref_file /etc/site/version
+		}`, false, &Repo{
+			URL:    "https://github.com/user/repo.git",
+			Branch: "v1.2.0",
+		}},
+		{`git http://github.com/user/repo {
+			ref_file missing
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			hook /webhook
+			hook_delay 10 2
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Hook: HookConfig{Url: "/webhook", Delay: time.Second * 10, Retries: 2},
+		}},
+		{`git http://github.com/user/repo {
+			hook_delay soon
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			quiet_period 09:00-12:00 13:00-17:00
+			timezone UTC
+		}`, false, &Repo{
+			URL: "https://github.com/user/repo.git",
+		}},
+		{`git http://github.com/user/repo {
+			quiet_period 9-17
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			timezone Nowhere/City
+		}`, true, nil},
+		{`git http://github.com/user/repo {
+			pause_file
+		}`, false, &Repo{
+			URL:       "https://github.com/user/repo.git",
+			PauseFile: ".git-pull-disabled",
+		}},
+		{`git http://github.com/user/repo {
+			pause_file .maintenance
+		}`, false, &Repo{
+			URL:       "https://github.com/user/repo.git",
+			PauseFile: ".maintenance",
+		}},
+		{`git http://github.com/user/repo {
+			path previews/{branch}
+			branch feature/login
+		}
+		git http://github.com/user/repo {
+			path previews/{branch}
+			branch main
+		}`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Path: "previews/feature-login",
+		}},
+		{`git http://github.com/user/repo {
+			path previews/{branch}
+			branch main
+		}
+		git http://github.com/user/other {
+			path previews/main
+		}`, true, nil},
+		{`git http://github.com/user/repo /site
+		git http://github.com/user/other /other`, false, &Repo{
+			URL:  "https://github.com/user/repo.git",
+			Path: "site",
+		}},
+		{`git http://github.com/user/repo {
+			key keydir
+		}`, true, nil},
+	}
+
+	for i, test := range tests {
+		c := setup.NewTestController(test.input)
+		git, err := parse(c)
+		if !test.shouldErr && err != nil {
+			t.Errorf("Test %v should not error but found %v", i, err)
+			continue
+		}
+		if test.shouldErr && err == nil {
+			t.Errorf("Test %v should error but found nil", i)
+			continue
+		}
+		repo := git.Repo(0)
+		if !reposEqual(test.expected, repo) {
+			t.Errorf("Test %v expects %v but found %v", i, test.expected, repo)
+		}
+	}
+}
+
+func TestSanitizeHTTP(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		url       string
+		host      string
+	}{
+		{"git@github.com:user/repo", false, "https://github.com/user/repo.git", "github.com"},
+		{"github.com/user/repo", false, "https://github.com/user/repo.git", "github.com"},
+		{"http://github.com/user/repo/", false, "https://github.com/user/repo.git", "github.com"},
+		{"git@gitlab.com:group/subgroup/repo.git", false, "https://gitlab.com/group/subgroup/repo.git", "gitlab.com"},
+		{"https://gitlab.com/group/subgroup/nested/repo", false, "https://gitlab.com/group/subgroup/nested/repo.git", "gitlab.com"},
+		{"gitlab.com/group//subgroup/repo", false, "https://gitlab.com/group/subgroup/repo.git", "gitlab.com"},
+		{"ssh://git@gitlab.com/group/subgroup/repo.git", false, "https://gitlab.com/group/subgroup/repo.git", "gitlab.com"},
+		{"https://bitbucket.example.com/scm/PROJ/repo.git", false, "https://bitbucket.example.com/scm/PROJ/repo.git", "bitbucket.example.com"},
+		{"https://user@bitbucket.example.com:8443/scm/PROJ/repo.git", false, "https://user@bitbucket.example.com:8443/scm/PROJ/repo.git", "bitbucket.example.com:8443"},
+		{"ssh://git@bitbucket.example.com:7999/PROJ/repo.git", false, "https://bitbucket.example.com/scm/PROJ/repo.git", "bitbucket.example.com"},
+		{"git@bitbucket.org:user/repo.git", false, "https://user@bitbucket.org/user/repo.git", "bitbucket.org"},
+		{"git@github.com/user/repo", true, "", ""},
+		{"https://github.com", true, "", ""},
+	}
+
+	for i, test := range tests {
+		url, host, err := sanitizeHTTP(test.input)
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %v should error but found nil", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %v should not error but found %v", i, err)
+			continue
+		}
+		if url != test.url || host != test.host {
+			t.Errorf("Test %v expects %v %v but found %v %v", i, test.url, test.host, url, host)
+		}
+	}
+}
+
+func reposEqual(expected, repo *Repo) bool {
+	thenStr := func(then []Then) string {
+		var str []string
+		for _, t := range then {
+			str = append(str, t.Command())
+		}
+		return fmt.Sprint(str)
+	}
+	if expected == nil {
+		return repo == nil
+	}
+	if expected.Branch != "" && expected.Branch != repo.Branch {
+		return false
+	}
+	if expected.Host != "" && expected.Host != repo.Host {
+		return false
+	}
+	if expected.Interval != 0 && expected.Interval != repo.Interval {
+		return false
+	}
+	if expected.KeyPath != "" && expected.KeyPath != repo.KeyPath {
+		return false
+	}
+	if expected.Path != "" && expected.Path != repo.Path {
+		return false
+	}
+	if expected.Then != nil && thenStr(expected.Then) != thenStr(repo.Then) {
+		return false
+	}
+	hook := repo.Hook
+	hook.ClientCerts = expected.Hook.ClientCerts
+	if expected.Hook != (HookConfig{}) && expected.Hook != hook {
+		return false
+	}
+	if expected.Hook.ClientCerts != nil && (repo.Hook.ClientCerts == nil ||
+		fmt.Sprint(expected.Hook.ClientCerts.Fingerprints) != fmt.Sprint(repo.Hook.ClientCerts.Fingerprints)) {
+		return false
+	}
+	if expected.AsyncStartup && !repo.AsyncStartup {
+		return false
+	}
+	if expected.FailOpen && !repo.FailOpen {
+		return false
+	}
+	if expected.LogFile != repo.LogFile {
+		return false
+	}
+	if expected.Bundle && !repo.Bundle {
+		return false
+	}
+	if expected.DeployHook != nil && (repo.DeployHook == nil || expected.DeployHook.URL != repo.DeployHook.URL ||
+		expected.DeployHook.Method != repo.DeployHook.Method || expected.DeployHook.Body != repo.DeployHook.Body ||
+		fmt.Sprint(expected.DeployHook.Headers) != fmt.Sprint(repo.DeployHook.Headers)) {
+		return false
+	}
+	if expected.thenUser != nil && (repo.thenUser == nil || *expected.thenUser != *repo.thenUser) {
+		return false
+	}
+	if expected.Fallback && (!repo.Fallback || expected.FallbackPage != repo.FallbackPage) {
+		return false
+	}
+	if expected.Maintenance && (!repo.Maintenance || expected.MaintenancePage != repo.MaintenancePage) {
+		return false
+	}
+	if expected.ServeSubdir != "" && expected.ServeSubdir != repo.ServeSubdir {
+		return false
+	}
+	if expected.Partial && !repo.Partial {
+		return false
+	}
+	if expected.SkipMessage != repo.SkipMessage {
+		return false
+	}
+	if expected.WatchPath != "" && expected.WatchPath != repo.WatchPath {
+		return false
+	}
+	if expected.RateLimit != 0 && expected.RateLimit != repo.RateLimit {
+		return false
+	}
+	if expected.passphrase != "" && expected.passphrase != repo.passphrase {
+		return false
+	}
+	if expected.CheckRemote && !repo.CheckRemote {
+		return false
+	}
+	if expected.Priority != 0 && expected.Priority != repo.Priority {
+		return false
+	}
+	if expected.ThenOnError != "" && expected.ThenOnError != repo.ThenOnError {
+		return false
+	}
+	if expected.OnConflict != "" && expected.OnConflict != repo.OnConflict {
+		return false
+	}
+	if expected.AllowForce && !repo.AllowForce {
+		return false
+	}
+	if expected.Staging != "" && expected.Staging != repo.Staging {
+		return false
+	}
+	if expected.NightMultiplier != 0 && expected.NightMultiplier != repo.NightMultiplier {
+		return false
+	}
+	if expected.SkipIfFresh != 0 && expected.SkipIfFresh != repo.SkipIfFresh {
+		return false
+	}
+	if len(expected.Aliases) > 0 && fmt.Sprint(expected.Aliases) != fmt.Sprint(repo.Aliases) {
+		return false
+	}
+	if expected.Reference != "" && expected.Reference != repo.Reference {
+		return false
+	}
+	if expected.SubmoduleDepth != repo.SubmoduleDepth || fmt.Sprint(expected.SubmodulePaths) != fmt.Sprint(repo.SubmodulePaths) {
+		return false
+	}
+	if expected.FetchRetries != 0 && expected.FetchRetries != repo.FetchRetries {
+		return false
+	}
+	if expected.ShallowSince != "" && expected.ShallowSince != repo.ShallowSince {
+		return false
+	}
+	if expected.PauseEndpoint != "" && (expected.PauseEndpoint != repo.PauseEndpoint || expected.pauseToken != repo.pauseToken) {
+		return false
+	}
+	if expected.CommitEndpoint != "" && (expected.CommitEndpoint != repo.CommitEndpoint || expected.commitToken != repo.commitToken) {
+		return false
+	}
+	if expected.QueueHooks && !repo.QueueHooks {
+		return false
+	}
+	if expected.ReposEndpoint != "" && expected.ReposEndpoint != repo.ReposEndpoint {
+		return false
+	}
+	if len(expected.IgnorePaths) > 0 && fmt.Sprint(expected.IgnorePaths) != fmt.Sprint(repo.IgnorePaths) {
+		return false
+	}
+	if expected.CloneTimeout != 0 && expected.CloneTimeout != repo.CloneTimeout {
+		return false
+	}
+	if expected.PullTimeout != 0 && expected.PullTimeout != repo.PullTimeout {
+		return false
+	}
+	if expected.NoTags && !repo.NoTags {
+		return false
+	}
+	if expected.SSHAgent != "" && expected.SSHAgent != repo.SSHAgent {
+		return false
+	}
+	if expected.PauseFile != "" && expected.PauseFile != repo.PauseFile {
+		return false
+	}
+	if expected.Overlays != nil && fmt.Sprint(expected.Overlays) != fmt.Sprint(repo.Overlays) {
+		return false
+	}
+	if expected.HTTPHeaders != nil && fmt.Sprint(expected.HTTPHeaders) != fmt.Sprint(repo.HTTPHeaders) {
+		return false
+	}
+	if expected.Mirrors != nil && fmt.Sprint(expected.Mirrors) != fmt.Sprint(repo.Mirrors) {
+		return false
+	}
+	if expected.Refspecs != nil && fmt.Sprint(expected.Refspecs) != fmt.Sprint(repo.Refspecs) {
 		return false
 	}
 	if expected.URL != "" && expected.URL != repo.URL {
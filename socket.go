@@ -0,0 +1,197 @@
+package git
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sockets holds all unix socket triggers by socket path.
+var sockets = &socketTriggers{triggers: make(map[string]*socketTrigger)}
+
+// socketTrigger listens on a unix socket and pulls the repositories
+// whose ID is written to it, one ID per line.
+type socketTrigger struct {
+	listener net.Listener
+	repos    []*Repo
+	sync.RWMutex
+}
+
+// socketTriggers stores all socketTriggers.
+type socketTriggers struct {
+	triggers map[string]*socketTrigger
+	sync.Mutex
+}
+
+// listen registers repo to be pulled from the unix socket at path.
+// The socket is created if not listening already and is only accessible
+// by the owner.
+func (s *socketTriggers) listen(path string, repo *Repo) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if t, ok := s.triggers[path]; ok {
+		t.add(repo)
+		return nil
+	}
+
+	// remove stale socket from a previous run
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+
+	t := &socketTrigger{listener: l}
+	t.add(repo)
+	s.triggers[path] = t
+	go t.serve()
+	return nil
+}
+
+// listenPrivate listens on a new unix socket at path that is only
+// accessible by the owner. The socket is created in a new directory
+// only the owner can access and moved to path once its mode is set, so
+// it never exists with the permissions of the umask.
+func listenPrivate(path string) (*net.UnixListener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".caddy-git")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "socket")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// the socket is removed from path by close
+	l.SetUnlinkOnClose(false)
+	if err = os.Chmod(tmp, os.FileMode(0600)); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// close closes all listening sockets and removes them.
+func (s *socketTriggers) close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	var errs error
+	for path, t := range s.triggers {
+		errs = mergeErrors(errs, t.listener.Close())
+		os.Remove(path)
+		delete(s.triggers, path)
+	}
+	return errs
+}
+
+// add adds repo to the repositories pulled by t.
+func (t *socketTrigger) add(repo *Repo) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, r := range t.repos {
+		if r == repo {
+			return
+		}
+	}
+	t.repos = append(t.repos, repo)
+}
+
+// serve accepts connections until the listener is closed.
+func (t *socketTrigger) serve() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			return
+		}
+		go t.handle(conn)
+	}
+}
+
+// handle pulls the repositories named on each line written to conn
+// and responds with the result of the pull. A line of the form
+// "deepen id [commits]" deepens their shallow checkouts instead, and
+// "reload [id]" reloads their credentials, or those of all repositories
+// of the socket if id is omitted.
+func (t *socketTrigger) handle(conn net.Conn) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		id := strings.TrimSpace(scanner.Text())
+		if id == "" {
+			continue
+		}
+
+		action := "pull"
+		run := (*Repo).Pull
+		if fields := strings.Fields(id); len(fields) > 1 && fields[0] == "deepen" {
+			commits := 0
+			if len(fields) > 3 {
+				fmt.Fprintf(conn, "error invalid deepen request %v\n", id)
+				continue
+			}
+			if len(fields) == 3 {
+				n, err := strconv.Atoi(fields[2])
+				if err != nil || n < 0 {
+					fmt.Fprintf(conn, "error invalid number of commits %v\n", fields[2])
+					continue
+				}
+				commits = n
+			}
+			action, id = "deepen", fields[1]
+			run = func(r *Repo) error { return r.Deepen(commits) }
+		} else if len(fields) <= 2 && fields[0] == "reload" {
+			action, id = "reload", ""
+			if len(fields) == 2 {
+				id = fields[1]
+			}
+			run = (*Repo).ReloadCredentials
+		}
+
+		var repos []*Repo
+		t.RLock()
+		for _, r := range t.repos {
+			if r.ID == id || action == "reload" && id == "" {
+				repos = append(repos, r)
+			}
+		}
+		t.RUnlock()
+
+		if len(repos) == 0 {
+			fmt.Fprintf(conn, "unknown repo %v\n", id)
+			continue
+		}
+
+		var errs error
+		for _, r := range repos {
+			r.logger().Printf("Received %v request for %v on socket.\n", action, r.ID)
+			err := run(r)
+			if err != nil && action == "pull" {
+				r.errLog.log(err)
+			}
+			errs = mergeErrors(errs, err)
+		}
+		if errs != nil {
+			fmt.Fprintf(conn, "error %v\n", strings.Replace(errs.Error(), "\n", " ", -1))
+			continue
+		}
+		fmt.Fprintln(conn, "ok")
+	}
+}
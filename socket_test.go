@@ -0,0 +1,62 @@
+package git
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSocketTrigger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-git")
+	check(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "git.sock")
+	repo := createRepo(&Repo{URL: "https://github.com/user/repo.git"})
+	repo.ID = "site"
+	check(t, sockets.listen(path, repo))
+	defer sockets.close()
+
+	info, err := os.Stat(path)
+	check(t, err)
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket mode %v found %v", os.FileMode(0600), info.Mode().Perm())
+	}
+	// the directory the socket was created in is removed
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the socket in %v found %v files", dir, len(files))
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Could not connect to socket: %v", err)
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for i, test := range []struct {
+		id       string
+		response string
+	}{
+		{"site", "ok\n"},
+		{"other", "unknown repo other\n"},
+		{"deepen site", "ok\n"},
+		{"deepen site 20", "ok\n"},
+		{"deepen site many", "error invalid number of commits many\n"},
+		{"deepen other", "unknown repo other\n"},
+		{"reload", "ok\n"},
+		{"reload site", "ok\n"},
+		{"reload other", "unknown repo other\n"},
+	} {
+		_, err = conn.Write([]byte(test.id + "\n"))
+		check(t, err)
+		response, err := reader.ReadString('\n')
+		check(t, err)
+		if response != test.response {
+			t.Errorf("Test %v: Expected %q found %q", i, test.response, response)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package git
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// prepareStaging moves the checkout into r.Staging, so r.Path, which may
+// be on a read-only filesystem, is only ever a link to a release of it.
+// A link left by a previous run keeps serving its release until the
+// next pull publishes a new one.
+func (r *Repo) prepareStaging() error {
+	if info, err := gos.Lstat(r.Path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("cannot link staging releases to %v, path exists.", r.Path)
+	}
+	if err := gos.MkdirAll(r.releasesDir(), os.FileMode(0755)); err != nil {
+		return err
+	}
+	r.linkPath = r.Path
+	r.Path = filepath.Join(r.Staging, "checkout")
+	return nil
+}
+
+// releasesDir is the directory the releases of the staging checkout
+// are copied to.
+func (r *Repo) releasesDir() string {
+	return filepath.Join(r.Staging, "releases")
+}
+
+// published checks if the link of the staging mode points to a release.
+func (r *Repo) published() bool {
+	_, err := gos.Readlink(r.linkPath)
+	return err == nil
+}
+
+// publish copies the staging checkout, without .git, to a new release
+// and points the link at r.linkPath to it. The link is replaced with a
+// rename, so it always points to a complete release. The release it
+// pointed to before is kept for requests still reading from it, older
+// releases are removed.
+func (r *Repo) publish() error {
+	name := time.Now().UTC().Format("20060102T150405.000000000")
+	if r.lastCommit != "" {
+		name += "-" + r.lastCommit
+	}
+	release := filepath.Join(r.releasesDir(), name)
+	if err := copyTree(r.Path, release); err != nil {
+		gos.RemoveAll(release)
+		return fmt.Errorf("cannot copy %v to release %v: %v", r.Path, release, err)
+	}
+
+	previous, _ := gos.Readlink(r.linkPath)
+	tmp := r.linkPath + ".staging"
+	gos.Remove(tmp)
+	if err := gos.Symlink(release, tmp); err != nil {
+		gos.RemoveAll(release)
+		return err
+	}
+	if err := gos.Rename(tmp, r.linkPath); err != nil {
+		gos.Remove(tmp)
+		gos.RemoveAll(release)
+		return err
+	}
+	r.served = r.lastCommit
+	r.logger().Printf("%v published to %v.\n", r.URL, release)
+
+	// a release left by a failed copy or a crash is removed as well
+	releases, err := gos.ReadDir(r.releasesDir())
+	if err != nil {
+		return err
+	}
+	for _, f := range releases {
+		dir := filepath.Join(r.releasesDir(), f.Name())
+		if dir != release && dir != previous {
+			err = mergeErrors(err, gos.RemoveAll(dir))
+		}
+	}
+	return err
+}
+
+// releaseCommit returns the commit of the release the link at path
+// points to, from the name given by publish, or "" if there is none.
+func releaseCommit(path string) string {
+	release, err := gos.Readlink(path)
+	if err != nil {
+		return ""
+	}
+	name := filepath.Base(release)
+	if i := strings.LastIndex(name, "-"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// copyTree copies the files, directories and links in src, except .git,
+// to the new directory dst. Modes are kept; ownership is not.
+func copyTree(src, dst string) error {
+	if err := gos.MkdirAll(dst, os.FileMode(0755)); err != nil {
+		return err
+	}
+	files, err := gos.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == ".git" {
+			continue
+		}
+		from, to := filepath.Join(src, f.Name()), filepath.Join(dst, f.Name())
+		switch {
+		case f.Mode()&os.ModeSymlink != 0:
+			var target string
+			if target, err = gos.Readlink(from); err == nil {
+				err = gos.Symlink(target, to)
+			}
+		case f.IsDir():
+			if err = copyTree(from, to); err == nil {
+				err = gos.Chmod(to, f.Mode().Perm())
+			}
+		case f.Mode().IsRegular():
+			err = copyFile(from, to, f.Mode().Perm())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to the new file dst with mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := gos.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := gos.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	// the mode of OpenFile is subject to the umask
+	return gos.Chmod(dst, mode)
+}
@@ -0,0 +1,93 @@
+package git
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestStaging(t *testing.T) {
+	staging := filepath.Join("/var/lib/caddy-git", "site")
+	releases := filepath.Join(staging, "releases")
+	defer func() {
+		gittest.Symlinks = map[string]string{}
+		gittest.Renames = map[string]string{}
+	}()
+	defer delete(gittest.CmdOutputs, "--no-pager")
+
+	repo := createRepo(&Repo{Path: "/srv/site", URL: "https://github.com/user/repo.git"})
+	repo.Staging = staging
+	check(t, repo.Prepare())
+	if repo.Path != filepath.Join(staging, "checkout") || repo.linkPath != "/srv/site" {
+		t.Fatalf("Expected checkout in staging found %v linked at %v", repo.Path, repo.linkPath)
+	}
+
+	index := filepath.Join(repo.Path, "index.html")
+	gittest.FileContents[index] = "<html></html>"
+	defer delete(gittest.FileContents, index)
+	gittest.CmdOutputs["--no-pager"] = "a1b2c3d4e5f6a7b8"
+	check(t, repo.Pull())
+
+	release := gittest.Symlinks["/srv/site"]
+	if !strings.HasPrefix(release, releases+string(filepath.Separator)) || !strings.HasSuffix(release, "-a1b2c3d4e5f6a7b8") {
+		t.Fatalf("Expected link to a release of a1b2c3d4e5f6a7b8 found %q", release)
+	}
+	if tmp := gittest.Renames["/srv/site"]; tmp != "/srv/site.staging" {
+		t.Errorf("Expected link to be replaced by rename found %q", tmp)
+	}
+	if _, ok := gittest.Chmods[filepath.Join(release, "index.html")]; !ok {
+		t.Errorf("Expected index.html to be copied to %v found %v", release, gittest.Chmods)
+	}
+
+	// no new release without changes while the link exists
+	gittest.Sleep(time.Second * 5)
+	check(t, repo.Pull())
+	if gittest.Symlinks["/srv/site"] != release {
+		t.Errorf("Expected link to %v found %v", release, gittest.Symlinks["/srv/site"])
+	}
+
+	// a release is not published if the commands fail
+	repo.Then = []Then{&countThen{err: errors.New("build failed")}}
+	gittest.CmdOutputs["--no-pager"] = "b2c3d4e5f6a7b8c9"
+	gittest.Sleep(time.Second * 5)
+	if err := repo.Pull(); err == nil {
+		t.Errorf("Expected failed commands to fail the pull")
+	}
+	if gittest.Symlinks["/srv/site"] != release {
+		t.Errorf("Expected link to %v found %v", release, gittest.Symlinks["/srv/site"])
+	}
+	if commit := repo.servedCommit(); commit != "a1b2c3d4e5f6a7b8" {
+		t.Errorf("Expected the released commit to be served found %q", commit)
+	}
+
+	// after a restart, the commit of the linked release is served
+	delete(gittest.FileContents, index)
+	restarted := createRepo(&Repo{Path: "/srv/site", URL: "https://github.com/user/repo.git"})
+	restarted.Staging = staging
+	check(t, restarted.Prepare())
+	if commit := restarted.servedCommit(); commit != "a1b2c3d4e5f6a7b8" {
+		t.Errorf("Expected the released commit to be served found %q", commit)
+	}
+}
+
+func TestIsSubpath(t *testing.T) {
+	tests := []struct {
+		dir, path string
+		expected  bool
+	}{
+		{"/srv", "/srv", true},
+		{"/srv", "/srv/site", true},
+		{"/srv/site", "/srv", false},
+		{"/srv/site", "/srv/site2", false},
+		{"/srv/site", "/srv/..site", false},
+	}
+	for i, test := range tests {
+		if isSubpath(test.dir, test.path) != test.expected {
+			t.Errorf("Test %v: expected %v for %v in %v", i, test.expected, test.path, test.dir)
+		}
+	}
+}
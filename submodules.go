@@ -0,0 +1,40 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// updateSubmodules checks out the submodules of the checkout at the
+// commits recorded by the pull, r.SubmoduleDepth levels deep, so nested
+// submodules past the depth are not cloned. Only the submodules at
+// r.SubmodulePaths are checked out at the first level if set.
+func (r *Repo) updateSubmodules() error {
+	if r.SubmoduleDepth == 0 {
+		return nil
+	}
+	params := []string{"submodule", "update", "--init"}
+	if len(r.SubmodulePaths) > 0 {
+		params = append(append(params, "--"), r.SubmodulePaths...)
+	}
+	if err := r.fetchCmd(params); err != nil {
+		return fmt.Errorf("cannot update submodules of %v: %v", r.URL, err)
+	}
+
+	// the submodules of each level are updated by running the update
+	// in the submodules of the level above, nested with foreach; unlike
+	// foreach --recursive, this never goes past the depth
+	command := "git submodule update --init"
+	for level := 2; level <= r.SubmoduleDepth; level++ {
+		if err := r.fetchCmd([]string{"submodule", "foreach", "--quiet", command}); err != nil {
+			return fmt.Errorf("cannot update submodules of %v at level %v: %v", r.URL, level, err)
+		}
+		command = "git submodule foreach --quiet " + shellQuote(command)
+	}
+	return nil
+}
+
+// shellQuote quotes s as a single argument of a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
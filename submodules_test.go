@@ -0,0 +1,39 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestSubmodules(t *testing.T) {
+	repo := createRepo(&Repo{Path: "newdir", URL: "https://github.com/user/repo.git"})
+	repo.SubmoduleDepth = 3
+	repo.SubmodulePaths = []string{"themes/base"}
+	check(t, repo.Prepare())
+	gittest.ResetCommands()
+	check(t, repo.Pull())
+
+	expected := []string{
+		"submodule update --init -- themes/base",
+		"submodule foreach --quiet git submodule update --init",
+		"submodule foreach --quiet git submodule foreach --quiet 'git submodule update --init'",
+	}
+	var found []string
+	for _, command := range gittest.Commands() {
+		if strings.HasPrefix(command, "submodule") {
+			found = append(found, command)
+		}
+	}
+	if fmt.Sprint(found) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q found %q", expected, found)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if quoted := shellQuote("echo 'a b'"); quoted != `'echo '\''a b'\'''` {
+		t.Errorf("Unexpected quoting %v", quoted)
+	}
+}
@@ -20,8 +20,16 @@ func (t TravisHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 	if r.Method != "POST" {
 		return http.StatusMethodNotAllowed, errors.New("the request had an invalid method")
 	}
-	if err := t.handleSignature(r, repo.Hook.Secret); err != nil {
-		return http.StatusBadRequest, err
+	secret, err := repo.Hook.LoadSecret()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := t.handleSignature(r, secret); err != nil {
+		return http.StatusBadRequest, signatureError{err}
+	}
+
+	if repo.Hook.IgnorePayload {
+		return untrustedPull(repo)
 	}
 	if err := r.ParseForm(); err != nil {
 		return http.StatusBadRequest, err
@@ -35,18 +43,15 @@ func (t TravisHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (
 		return http.StatusBadRequest, err
 	}
 	if data.Type != "push" || data.StatusMessage != "Passed" {
-		Logger().Println("Ignoring payload with wrong status or type.")
+		repo.logger().Println("Ignoring payload with wrong status or type.")
+		repo.countHook(&repo.hookStats.Ignored)
 		return 200, nil
 	}
-	if repo.Branch != "" && data.Branch != repo.Branch {
-		Logger().Printf("Ignoring push for branch %s", data.Branch)
-		return 200, nil
-	}
-	if err := repo.Pull(); err != nil {
-		return http.StatusInternalServerError, err
-	}
-	if err := repo.checkoutCommit(data.Commit); err != nil {
-		return http.StatusInternalServerError, err
+	// the commit the build passed is deployed, not newer commits
+	if repo.acceptPush(data.Branch) {
+		repo.setHookCommit(data.Commit)
+		repo.setHookPin(data.Commit)
+		repo.HookPull()
 	}
 	return 200, nil
 }
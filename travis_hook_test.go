@@ -0,0 +1,55 @@
+package git
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestTravisHook(t *testing.T) {
+	defer func(output string) { gittest.CmdOutput = output }(gittest.CmdOutput)
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook = HookConfig{Url: "/travis_deploy", Type: "travis"}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		payload  string
+		checkout string
+	}{
+		{`{"type": "push", "status_message": "Passed", "branch": "master", "commit": "3f4e5d6c7b8a"}`, "checkout 3f4e5d6c7b8a"},
+		{`{"type": "push", "status_message": "Passed", "branch": "master", "commit": "--orphan=evil"}`, ""},
+		{`{"type": "push", "status_message": "Failed", "branch": "master", "commit": "3f4e5d6c7b8a"}`, ""},
+		{`{"type": "push", "status_message": "Passed", "branch": "other", "commit": "3f4e5d6c7b8a"}`, ""},
+	}
+	for i, test := range tests {
+		gittest.ResetCommands()
+		gittest.Sleep(time.Second * 5)
+		form := url.Values{"payload": {test.payload}}
+		req, err := http.NewRequest("POST", "/travis_deploy", strings.NewReader(form.Encode()))
+		check(t, err)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Travis-Repo-Slug", "user/repo")
+		req.Header.Set("Authorization", "signature")
+		if code, _ := hook.ServeHTTP(httptest.NewRecorder(), req); code != http.StatusOK {
+			t.Errorf("Test %v: expected code %v found %v", i, http.StatusOK, code)
+		}
+
+		// the passed commit is checked out after the pull
+		var checkout string
+		for _, command := range gittest.Commands() {
+			if strings.HasPrefix(command, "checkout ") {
+				checkout = command
+			}
+		}
+		if checkout != test.checkout {
+			t.Errorf("Test %v: expected %q found %q", i, test.checkout, checkout)
+		}
+	}
+}
@@ -1,8 +1,16 @@
 package git
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/mholt/caddy/middleware"
 )
@@ -15,36 +23,135 @@ type WebHook struct {
 
 // HookConfig is a webhook handler configuration.
 type HookConfig struct {
-	Url    string // url to listen on for webhooks
-	Secret string // secret to validate hooks
-	Type   string // type of Webhook
+	Url           string        // url to listen on for webhooks
+	Secret        string        // secret to validate hooks
+	SecretFile    string        // file to read the secret from
+	Type          string        // type of Webhook
+	Delay         time.Duration // delay before pulling after a webhook
+	Retries       int           // number of delayed pulls to retry if nothing changed
+	MaxSize       int64         // maximum payload size in bytes
+	IgnorePayload bool          // pull on any valid webhook without parsing the payload
+	FollowRef     bool          // switch to the branch pushed instead of ignoring other branches
+	CommitRetries int           // pulls to retry until HEAD has the commit pushed, 0 to not verify
+	ClientCerts   *ClientCerts  // client certificates required, nil to not require one
 }
 
-// hookHandler is interface for specific providers to implement.
-type hookHandler interface {
+// LoadSecret returns the secret to validate hooks. If SecretFile is set,
+// the secret is read from the file on each call so a rotated secret is
+// used without a restart.
+func (h HookConfig) LoadSecret() (string, error) {
+	if h.SecretFile == "" {
+		return h.Secret, nil
+	}
+	content, err := gos.ReadFile(h.SecretFile)
+	if err != nil {
+		return "", fmt.Errorf("cannot read hook secret file %v: %v", h.SecretFile, err)
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", fmt.Errorf("hook secret file %v is empty", h.SecretFile)
+	}
+	return secret, nil
+}
+
+// DefaultHookMaxSize is the maximum webhook payload size in bytes
+// if hook_max_size is not set.
+const DefaultHookMaxSize = 5 << 20
+
+// maxSize returns the maximum payload size of h.
+func (h HookConfig) maxSize() int64 {
+	if h.MaxSize > 0 {
+		return h.MaxSize
+	}
+	return DefaultHookMaxSize
+}
+
+// limitBody reads the body of r up to max bytes, and replaces the body
+// with the content read. Larger payloads are rejected with 413 to avoid
+// exhausting memory.
+func limitBody(r *http.Request, max int64) (int, error) {
+	if r.ContentLength > max {
+		return http.StatusRequestEntityTooLarge, errors.New("webhook payload too large")
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max+1))
+	r.Body.Close()
+	if err != nil {
+		return http.StatusRequestTimeout, errors.New("could not read body from request")
+	}
+	if int64(len(body)) > max {
+		return http.StatusRequestEntityTooLarge, errors.New("webhook payload too large")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return 0, nil
+}
+
+// hookPayload returns the JSON payload of a webhook request with body.
+// Payloads delivered as application/x-www-form-urlencoded, e.g. by
+// GitHub with the form content type, carry the JSON in the payload
+// field. Signatures are checked against body as delivered.
+func hookPayload(r *http.Request, body []byte) ([]byte, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		return body, nil
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid form payload: %v", err)
+	}
+	payload := form.Get("payload")
+	if payload == "" {
+		return nil, errors.New("form payload requires a payload field")
+	}
+	return []byte(payload), nil
+}
+
+// HookHandler is interface for specific providers to implement.
+// DoesHandle reports whether the request headers are from the provider.
+// Handle validates and parses the request, and calls repo.HookPull if
+// the push is for the tracked branch.
+type HookHandler interface {
 	DoesHandle(http.Header) bool
 	Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error)
 }
 
-// handlers stores all registered hookHandlers.
+// handlers stores all registered HookHandlers.
 // map key corresponds to expected config name.
 //
-// register hook handlers here.
-var handlers = map[string]hookHandler{
+// register built-in hook handlers here. Handlers
+// from other packages are added with RegisterHookHandler.
+var handlers = map[string]HookHandler{
 	"github":    GithubHook{},
 	"gitlab":    GitlabHook{},
 	"bitbucket": BitbucketHook{},
 	"generic":   GenericHook{},
 	"travis":    TravisHook{},
+	"gitee":     GiteeHook{},
+	"coding":    CodingHook{},
+}
+
+// RegisterHookHandler makes a hook handler available as hook_type name.
+// Custom handlers are not auto detected; the hook_type must be set in
+// the config. It is meant to be called from init() and panics if name
+// is empty or already registered, or if h is nil.
+func RegisterHookHandler(name string, h HookHandler) {
+	if name == "" || h == nil {
+		panic("git: RegisterHookHandler requires a name and a handler")
+	}
+	if _, ok := handlers[name]; ok {
+		panic("git: hook handler " + name + " is already registered")
+	}
+	handlers[name] = h
 }
 
 // defaultHandlers is the list of handlers to choose from
 // if handler type is not specified in config.
-var defaultHandlers = []hookHandler{
+var defaultHandlers = []HookHandler{
 	GithubHook{},
 	GitlabHook{},
 	BitbucketHook{},
 	TravisHook{},
+	GiteeHook{},
+	CodingHook{},
 }
 
 // ServeHTTP implements the middlware.Handler interface.
@@ -54,12 +161,28 @@ func (h WebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 
 		if r.URL.Path == repo.Hook.Url {
 
+			// limit the payload size before any handler reads it
+			if status, err := limitBody(r, repo.Hook.maxSize()); err != nil {
+				repo.countHook(&repo.hookStats.Rejected)
+				return status, err
+			}
+
+			// the client certificate is checked before any handler
+			if repo.Hook.ClientCerts != nil {
+				if err := repo.Hook.ClientCerts.verify(r); err != nil {
+					repo.logger().Printf("Rejected webhook for %v from %v: %v\n", repo.ID, r.RemoteAddr, err)
+					repo.countHook(&repo.hookStats.SignatureFailed)
+					return http.StatusForbidden, signatureError{err}
+				}
+			}
+
 			// if handler type is specified.
 			if handler, ok := handlers[repo.Hook.Type]; ok {
 				if !handler.DoesHandle(r.Header) {
+					repo.countHook(&repo.hookStats.Unknown)
 					return http.StatusBadRequest, errors.New(http.StatusText(http.StatusBadRequest))
 				}
-				return handler.Handle(w, r, repo)
+				return repo.handleHook(handler, w, r)
 			}
 
 			// auto detect handler
@@ -68,11 +191,305 @@ func (h WebHook) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error)
 				// we do not try other handlers. Only one handler ever
 				// handles a specific request.
 				if handler.DoesHandle(r.Header) {
-					return handler.Handle(w, r, repo)
+					return repo.handleHook(handler, w, r)
 				}
 			}
+			repo.countHook(&repo.hookStats.Unknown)
 		}
 	}
 
 	return h.Next.ServeHTTP(w, r)
 }
+
+// signatureError is returned by hook handlers if the signature, token or
+// source of a request cannot be verified.
+type signatureError struct {
+	error
+}
+
+// hookStats counts the webhook requests of a repository by result.
+// Accepted is counted by HookPull and Ignored by the handlers, the
+// others by WebHook from the response of the handler.
+type hookStats struct {
+	Accepted        int64 `json:"accepted"`         // requests that triggered a pull
+	SignatureFailed int64 `json:"signature_failed"` // requests that failed verification
+	Ignored         int64 `json:"ignored"`          // pushes of other branches or events
+	Unknown         int64 `json:"unknown"`          // requests not recognized by any handler
+	Rejected        int64 `json:"rejected"`         // other invalid requests
+}
+
+// handleHook handles the webhook request with handler and counts
+// failed requests. Verification failures are logged with the remote
+// address to help detect attacks or misconfigured senders.
+func (r *Repo) handleHook(handler HookHandler, w http.ResponseWriter, req *http.Request) (int, error) {
+	status, err := handler.Handle(w, req, r)
+	if _, ok := err.(signatureError); ok {
+		r.logger().Printf("Rejected webhook for %v from %v: %v\n", r.ID, req.RemoteAddr, err)
+		r.countHook(&r.hookStats.SignatureFailed)
+	} else if err != nil || status >= 400 {
+		r.countHook(&r.hookStats.Rejected)
+	}
+	return status, err
+}
+
+// countHook increments counter of r.hookStats.
+func (r *Repo) countHook(counter *int64) {
+	r.hookMutex.Lock()
+	*counter++
+	r.hookMutex.Unlock()
+}
+
+// hookPush pulls r after a webhook push of commit to branch. Pushes of
+// other branches are ignored, unless Hook.FollowRef is set and branch
+// is a valid branch name, in which case r switches to branch on the
+// pull. The commit may be empty if the payload does not have it.
+func (r *Repo) hookPush(branch, commit string) {
+	if r.acceptPush(branch) {
+		r.setHookCommit(commit)
+		r.HookPull()
+	}
+}
+
+// acceptPush checks if a webhook push to branch is pulled, see
+// hookPush, and sets the branch to switch to on the pull.
+func (r *Repo) acceptPush(branch string) bool {
+	if r.Hook.FollowRef && branch != r.Branch {
+		if !validBranchName(branch) {
+			r.logger().Printf("Ignoring push for invalid branch name %q.\n", branch)
+			r.countHook(&r.hookStats.Ignored)
+			return false
+		}
+		r.logger().Printf("Received push for branch %v, switching to it...\n", branch)
+		r.hookMutex.Lock()
+		r.hookRef = branch
+		r.hookMutex.Unlock()
+		return true
+	}
+	if branch == r.Branch {
+		r.logger().Print("Received pull notification for the tracking branch, updating...\n")
+		return true
+	}
+	r.ignoreHook(branch)
+	return false
+}
+
+// takeHookRef returns and clears the branch of the last webhook push
+// to switch to.
+func (r *Repo) takeHookRef() string {
+	r.hookMutex.Lock()
+	defer r.hookMutex.Unlock()
+	ref := r.hookRef
+	r.hookRef = ""
+	return ref
+}
+
+// setHookCommit sets the commit of a webhook push to verify after the
+// pull if Hook.CommitRetries is set. Commits that are not a full SHA-1
+// or SHA-256 hash are not verified.
+func (r *Repo) setHookCommit(commit string) {
+	if r.Hook.CommitRetries <= 0 || (len(commit) != 40 && len(commit) != 64) ||
+		strings.Trim(commit, "0123456789abcdef") != "" {
+		return
+	}
+	r.hookMutex.Lock()
+	r.hookCommit = commit
+	r.hookMutex.Unlock()
+}
+
+// setHookPin pins the next pull to commit, which is checked out after
+// pulling the branch. Commits that are not a hash are ignored, so a
+// payload cannot pass options or revision expressions to git.
+func (r *Repo) setHookPin(commit string) {
+	if len(commit) < 7 || len(commit) > 64 || strings.Trim(commit, "0123456789abcdef") != "" {
+		return
+	}
+	r.hookMutex.Lock()
+	r.hookPin = commit
+	r.hookMutex.Unlock()
+}
+
+// takeHookPin returns and clears the commit the next pull is pinned to.
+func (r *Repo) takeHookPin() string {
+	r.hookMutex.Lock()
+	defer r.hookMutex.Unlock()
+	commit := r.hookPin
+	r.hookPin = ""
+	return commit
+}
+
+// takeHookCommit returns and clears the commit of the last webhook push
+// to verify.
+func (r *Repo) takeHookCommit() string {
+	r.hookMutex.Lock()
+	defer r.hookMutex.Unlock()
+	commit := r.hookCommit
+	r.hookCommit = ""
+	return commit
+}
+
+// atCommit checks if HEAD of r is commit or contains it, e.g. if newer
+// commits were pushed since.
+func (r *Repo) atCommit(commit string) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.lastCommit == commit {
+		return true
+	}
+	params := []string{"merge-base", "--is-ancestor", commit, "HEAD"}
+	return runCmd(gitBinary, params, r.Path) == nil
+}
+
+// retryCommit pulls r again up to Hook.CommitRetries times, 5 seconds
+// apart, until HEAD has the commit reported by a webhook, to catch a
+// push that has not propagated to the remote yet.
+func (r *Repo) retryCommit(commit string) {
+	for i := 1; i <= r.Hook.CommitRetries; i++ {
+		r.Lock()
+		head := r.lastCommit
+		r.Unlock()
+		r.logger().Printf("%v is at %v instead of commit %v of the webhook, retrying in 5s (%v/%v).\n",
+			r.URL, head, commit, i, r.Hook.CommitRetries)
+
+		// consecutive pulls must be at least 5 seconds apart
+		gos.Sleep(5 * time.Second)
+		if err := r.Pull(); err != nil {
+			r.errLog.log(err)
+			return
+		}
+		if r.atCommit(commit) {
+			return
+		}
+	}
+	r.logger().Printf("%v does not have commit %v of the webhook after %v retries.\n", r.URL, commit, r.Hook.CommitRetries)
+}
+
+// validBranchName checks that name from a webhook payload is a branch
+// name git accepts, following the rules of git check-ref-format, and
+// cannot be mistaken for an option or a revision expression.
+func validBranchName(name string) bool {
+	if name == "" || name == "@" || strings.HasPrefix(name, "-") ||
+		strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") ||
+		strings.HasSuffix(name, ".lock") || strings.Contains(name, "..") ||
+		strings.Contains(name, "//") || strings.Contains(name, "@{") {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune(`~^:?*[\`, c) {
+			return false
+		}
+	}
+	for _, component := range strings.Split(name, "/") {
+		if strings.HasPrefix(component, ".") {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoreHook logs and counts a webhook push of a branch other than the
+// tracked one.
+func (r *Repo) ignoreHook(branch string) {
+	r.logger().Printf("Ignoring push for branch %v.\n", branch)
+	r.countHook(&r.hookStats.Ignored)
+}
+
+// hookCounts returns the webhook requests of r counted by result.
+func (r *Repo) hookCounts() hookStats {
+	r.hookMutex.Lock()
+	defer r.hookMutex.Unlock()
+	return r.hookStats
+}
+
+// untrustedPull pulls repo for a validated webhook request whose payload
+// is not trusted. The branch in the payload is not checked; the pull
+// brings whatever changed on the tracked branch.
+func untrustedPull(repo *Repo) (int, error) {
+	repo.logger().Print("Received webhook, updating without parsing the payload...\n")
+	repo.HookPull()
+	return http.StatusOK, nil
+}
+
+// HookPull pulls repo after a webhook request. If a delay is configured,
+// the pull happens in background after the delay to allow the push to
+// propagate on the remote, and is retried up to Hook.Retries times if it
+// brings no changes. Webhooks arriving during the delay are coalesced into
+// the same pull. Pull errors are logged, as most handlers respond before
+// or regardless of the pull.
+func (r *Repo) HookPull() error {
+	r.countHook(&r.hookStats.Accepted)
+	if r.hookPaused() {
+		return nil
+	}
+	if r.Hook.Delay <= 0 {
+		err := r.Pull()
+		if err != nil {
+			r.errLog.log(err)
+		}
+		if commit := r.takeHookCommit(); err == nil && commit != "" && !r.atCommit(commit) {
+			r.hookPulls.Add(1)
+			go func() {
+				defer r.hookPulls.Done()
+				r.retryCommit(commit)
+			}()
+		}
+		return err
+	}
+
+	r.hookMutex.Lock()
+	defer r.hookMutex.Unlock()
+
+	if r.hookPending {
+		r.logger().Println("Pull already scheduled, ignoring webhook.")
+		return nil
+	}
+	r.hookPending = true
+	r.hookPulls.Add(1)
+	go func() {
+		defer r.hookPulls.Done()
+		r.delayedPull()
+	}()
+	return nil
+}
+
+// delayedPull performs the pull scheduled by HookPull.
+func (r *Repo) delayedPull() {
+	delay := r.Hook.Delay
+	for i := 0; i <= r.Hook.Retries; i++ {
+		gos.Sleep(delay)
+
+		// later webhooks schedule another pull once this one starts
+		r.hookMutex.Lock()
+		r.hookPending = false
+		r.hookMutex.Unlock()
+
+		r.Lock()
+		lastCommit := r.lastCommit
+		r.Unlock()
+
+		if err := r.Pull(); err != nil {
+			r.errLog.log(err)
+			return
+		}
+
+		// the pushed commit is verified instead of checking for changes
+		if commit := r.takeHookCommit(); commit != "" {
+			if !r.atCommit(commit) {
+				r.retryCommit(commit)
+			}
+			return
+		}
+
+		r.Lock()
+		changed := r.lastCommit != lastCommit
+		r.Unlock()
+		if changed || i == r.Hook.Retries {
+			return
+		}
+
+		// consecutive pulls must be at least 5 seconds apart
+		if delay < 5*time.Second {
+			delay = 5 * time.Second
+		}
+		r.logger().Printf("No new changes after webhook, retrying in %v.\n", delay)
+	}
+}
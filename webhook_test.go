@@ -0,0 +1,349 @@
+package git
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abiosoft/caddy-git/gittest"
+)
+
+func TestHookDelay(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook.Delay = time.Second
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	// webhooks during the delay are coalesced
+	for i := 0; i < 3; i++ {
+		check(t, repo.HookPull())
+	}
+	repo.hookPulls.Wait()
+
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if n := strings.Count(string(out), "pulled."); n != 1 {
+		t.Errorf("Expected 1 pull found %v: %v", n, string(out))
+	}
+	if n := strings.Count(string(out), "Pull already scheduled"); n != 2 {
+		t.Errorf("Expected 2 coalesced webhooks found %v: %v", n, string(out))
+	}
+}
+
+func TestHookMaxSize(t *testing.T) {
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/generic_deploy", Type: "generic", MaxSize: 64}}
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		body          string
+		contentLength int64
+		code          int
+	}{
+		{strings.Repeat("x", 65), 65, http.StatusRequestEntityTooLarge},
+		// unknown length, e.g. chunked
+		{strings.Repeat("x", 65), -1, http.StatusRequestEntityTooLarge},
+		// within the limit the generic handler parses the payload
+		{`{"ref": "refs/heads/other"}`, -1, http.StatusOK},
+	}
+
+	for i, test := range tests {
+		req, err := http.NewRequest("POST", "/generic_deploy", strings.NewReader(test.body))
+		check(t, err)
+		req.ContentLength = test.contentLength
+		code, _ := hook.ServeHTTP(httptest.NewRecorder(), req)
+		if code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+	}
+}
+
+type teapotHook struct{}
+
+func (teapotHook) DoesHandle(h http.Header) bool {
+	return h.Get("X-Teapot") != ""
+}
+
+func (teapotHook) Handle(w http.ResponseWriter, r *http.Request, repo *Repo) (int, error) {
+	return http.StatusTeapot, nil
+}
+
+func TestRegisterHookHandler(t *testing.T) {
+	RegisterHookHandler("teapot", teapotHook{})
+	defer delete(handlers, "teapot")
+
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/teapot", Type: "teapot"}}
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	req, err := http.NewRequest("POST", "/teapot", strings.NewReader(""))
+	check(t, err)
+	req.Header.Set("X-Teapot", "brew")
+	code, _ := hook.ServeHTTP(httptest.NewRecorder(), req)
+	if code != http.StatusTeapot {
+		t.Errorf("Expected code %v found %v", http.StatusTeapot, code)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected registering teapot twice to panic")
+			}
+		}()
+		RegisterHookHandler("teapot", teapotHook{})
+	}()
+}
+
+func TestHookSecretFile(t *testing.T) {
+	defer delete(gittest.FileContents, "/run/secrets/hook")
+
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/gitee_deploy", SecretFile: "/run/secrets/hook"}}
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		secret string
+		token  string
+		code   int
+	}{
+		// missing file
+		{"", "supersecret", http.StatusInternalServerError},
+		{"supersecret\n", "supersecret", http.StatusOK},
+		{"supersecret\n", "wrongsecret", http.StatusBadRequest},
+		// rotated secret
+		{"newsecret\n", "supersecret", http.StatusBadRequest},
+		{"newsecret\n", "newsecret", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		if test.secret != "" {
+			gittest.FileContents["/run/secrets/hook"] = test.secret
+		}
+		req, err := http.NewRequest("POST", "/gitee_deploy", strings.NewReader(`{"ref": "refs/heads/other"}`))
+		check(t, err)
+		req.Header.Set("X-Gitee-Event", "Push Hook")
+		req.Header.Set("X-Gitee-Token", test.token)
+		code, _ := hook.ServeHTTP(httptest.NewRecorder(), req)
+		if code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+	}
+}
+
+func TestTrustPayload(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook = HookConfig{Url: "/gitee_deploy", Secret: "supersecret", IgnorePayload: true}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		token string
+		code  int
+		pull  bool
+	}{
+		{"wrongsecret", http.StatusBadRequest, false},
+		// the payload is for another branch and not even JSON
+		{"supersecret", http.StatusOK, true},
+	}
+
+	for i, test := range tests {
+		repo.lastPull = time.Time{}
+		req, err := http.NewRequest("POST", "/gitee_deploy", strings.NewReader("refs/heads/other"))
+		check(t, err)
+		req.Header.Set("X-Gitee-Event", "Tag Push Hook")
+		req.Header.Set("X-Gitee-Token", test.token)
+		code, _ := hook.ServeHTTP(httptest.NewRecorder(), req)
+		if code != test.code {
+			t.Errorf("Test %v: expected code %v found %v", i, test.code, code)
+		}
+		if pulled := !repo.lastPull.IsZero(); pulled != test.pull {
+			t.Errorf("Test %v: expected pull %v found %v", i, test.pull, pulled)
+		}
+	}
+}
+
+func TestHookStats(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook = HookConfig{Url: "/gitee_deploy", Secret: "supersecret", Type: "gitee"}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		event string
+		token string
+		body  string
+	}{
+		{"Push Hook", "supersecret", `{"ref": "refs/heads/master"}`},
+		{"Push Hook", "wrongsecret", `{"ref": "refs/heads/master"}`},
+		{"Push Hook", "", `{"ref": "refs/heads/master"}`},
+		{"Push Hook", "supersecret", `{"ref": "refs/heads/other"}`},
+		{"Tag Push Hook", "supersecret", `{"ref": "refs/tags/v1.0"}`},
+		{"Push Hook", "supersecret", `{"ref": "master"}`},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest("POST", "/gitee_deploy", strings.NewReader(test.body))
+		check(t, err)
+		if test.event != "" {
+			req.Header.Set("X-Gitee-Event", test.event)
+		}
+		req.Header.Set("X-Gitee-Token", test.token)
+		hook.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	expected := hookStats{Accepted: 1, SignatureFailed: 2, Ignored: 2, Unknown: 1, Rejected: 1}
+	if stats := repo.hookCounts(); stats != expected {
+		t.Errorf("Expected %+v found %+v", expected, stats)
+	}
+}
+
+func TestHookFollowRef(t *testing.T) {
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook = HookConfig{Url: "/gitee_deploy", Type: "gitee", FollowRef: true}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+	hook := WebHook{Repos: []*Repo{repo}}
+
+	tests := []struct {
+		ref    string
+		branch string
+	}{
+		{"refs/heads/feature/login", "feature/login"},
+		{"refs/heads/--upload-pack=evil", "feature/login"},
+		{"refs/heads/fix..HEAD", "feature/login"},
+		{"refs/heads/master", "master"},
+	}
+	for i, test := range tests {
+		gittest.ResetCommands()
+		gittest.Sleep(time.Second * 5)
+		req, err := http.NewRequest("POST", "/gitee_deploy", strings.NewReader(`{"ref": "`+test.ref+`"}`))
+		check(t, err)
+		req.Header.Set("X-Gitee-Event", "Push Hook")
+		if code, _ := hook.ServeHTTP(httptest.NewRecorder(), req); code != http.StatusOK {
+			t.Errorf("Test %v: expected code %v found %v", i, http.StatusOK, code)
+		}
+		if repo.Branch != test.branch {
+			t.Errorf("Test %v: expected branch %v found %v", i, test.branch, repo.Branch)
+		}
+	}
+}
+
+func TestValidBranchName(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"main", true},
+		{"feature/login", true},
+		{"release-1.x", true},
+		{"", false},
+		{"@", false},
+		{"-f", false},
+		{"feature/", false},
+		{"feature/.hidden", false},
+		{"main.lock", false},
+		{"main..other", false},
+		{"main@{1}", false},
+		{"main~1", false},
+		{"a b", false},
+		{"a\\b", false},
+		{"feature//login", false},
+	}
+	for _, test := range tests {
+		if valid := validBranchName(test.name); valid != test.valid {
+			t.Errorf("Expected %q valid %v found %v", test.name, test.valid, valid)
+		}
+	}
+}
+
+func TestHookVerifyCommit(t *testing.T) {
+	const commit = "3f4e5d6c7b8a9f0e1d2c3b4a5f6e7d8c9b0a1f2e"
+	defer delete(gittest.CmdOutputs, "--no-pager")
+	defer delete(gittest.CmdErrors, "merge-base --is-ancestor "+commit+" HEAD")
+
+	logFile := gittest.Open("file")
+	SetLogger(gittest.NewLogger(logFile))
+
+	repo := createRepo(&Repo{Path: "gitdir", URL: "https://github.com/user/repo.git"})
+	repo.Hook = HookConfig{Url: "/deploy", CommitRetries: 2}
+	gittest.CmdOutput = repo.URL
+	check(t, repo.Prepare())
+
+	// only full hashes are verified
+	for _, c := range []string{"", "3f4e5d6", "--upload-pack=evil" + commit[18:], commit} {
+		repo.setHookCommit(c)
+	}
+	if stored := repo.takeHookCommit(); stored != commit {
+		t.Errorf("Expected commit %v to verify found %q", commit, stored)
+	}
+
+	gittest.CmdOutputs["--no-pager"] = "1a2b3c4d5e6f7a8b9c0d1e2f3a4b5c6d7e8f9a0b"
+	gittest.CmdErrors["merge-base --is-ancestor "+commit+" HEAD"] = errors.New("exit status 1")
+	gittest.ResetCommands()
+	repo.retryCommit(commit)
+	pulls := 0
+	for _, command := range gittest.Commands() {
+		if command == "pull origin master" {
+			pulls++
+		}
+	}
+	if pulls != 2 {
+		t.Errorf("Expected 2 retried pulls found %q", gittest.Commands())
+	}
+	out, err := ioutil.ReadAll(logFile)
+	check(t, err)
+	if !strings.Contains(string(out), "does not have commit "+commit+" of the webhook after 2 retries") {
+		t.Errorf("Expected mismatch to be logged: %v", string(out))
+	}
+
+	// HEAD has the commit if it was pushed before newer commits
+	delete(gittest.CmdErrors, "merge-base --is-ancestor "+commit+" HEAD")
+	if !repo.atCommit(commit) {
+		t.Errorf("Expected HEAD to contain commit %v", commit)
+	}
+}
+
+func TestHookPayload(t *testing.T) {
+	form := url.Values{"payload": {pushGBodyOther}}.Encode()
+	tests := []struct {
+		contentType string
+		body        string
+		payload     string
+		shouldErr   bool
+	}{
+		{"", pushGBodyOther, pushGBodyOther, false},
+		{"application/json", pushGBodyOther, pushGBodyOther, false},
+		{"application/x-www-form-urlencoded", form, pushGBodyOther, false},
+		{"application/x-www-form-urlencoded; charset=utf-8", form, pushGBodyOther, false},
+		{"application/x-www-form-urlencoded", "ref=refs/heads/master", "", true},
+		{"application/x-www-form-urlencoded", "payload=%zz", "", true},
+	}
+	for i, test := range tests {
+		req, err := http.NewRequest("POST", "/hook", nil)
+		check(t, err)
+		req.Header.Set("Content-Type", test.contentType)
+		payload, err := hookPayload(req, []byte(test.body))
+		if test.shouldErr != (err != nil) {
+			t.Errorf("Test %v: expected error %v found %v", i, test.shouldErr, err)
+		}
+		if string(payload) != test.payload {
+			t.Errorf("Test %v: expected payload %q found %q", i, test.payload, payload)
+		}
+	}
+
+	// the handlers parse the JSON of form deliveries
+	repo := &Repo{Branch: "master", Hook: HookConfig{Url: "/generic_deploy"}}
+	req, err := http.NewRequest("POST", "/generic_deploy", strings.NewReader(form))
+	check(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if code, err := (GenericHook{}).Handle(httptest.NewRecorder(), req, repo); code != http.StatusOK {
+		t.Errorf("Expected form payload to be handled found %v %v", code, err)
+	}
+}